@@ -3,12 +3,23 @@ package zcore
 type Address struct {
 	function *SexpFunction
 	position int
+
+	// the arguments of the call made from here, for stack traces,
+	// and how many scopes the caller had, for the debugger.
+	args   []Sexp
+	scopes int
 }
 
 func (a Address) IsStackElem() {}
 
 func (stack *Stack) PushAddr(function *SexpFunction, pc int) {
-	stack.Push(Address{function, pc})
+	stack.Push(Address{function: function, position: pc})
+}
+
+// pushCall is PushAddr, also noting the arguments of the call.
+func (stack *Stack) pushCall(function *SexpFunction, pc int, args []Sexp) {
+	stack.Push(Address{function: function, position: pc, args: args,
+		scopes: stack.env.linearstack.Size()})
 }
 
 func (stack *Stack) PopAddr() (*SexpFunction, int, error) {
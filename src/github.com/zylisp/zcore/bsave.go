@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
 
 	"github.com/glycerine/greenpack/msgp"
 )
@@ -56,14 +55,17 @@ func WriteShadowGreenpackToFileFunction(env *Zlisp, name string, args []Sexp) (S
 	default:
 		return SexpNull, fmt.Errorf("error: %s requires a string (SexpStr) path to write to as the second argument. we got type %T / value = %v", name, args[1], args[1])
 	}
+	if err := env.checkWrite(name, fn); err != nil {
+		return SexpNull, err
+	}
 
 	// don't overwrite existing file
-	if FileExists(fn) {
+	if env.fileExists(fn) {
 		return SexpNull, fmt.Errorf("error: %s refusing to write to existing file '%s'",
 			name, fn)
 	}
 
-	f, err := os.Create(fn)
+	f, err := env.createFile(fn)
 	if err != nil {
 		return SexpNull, fmt.Errorf("error: %s sees error trying to create file '%s': '%v'", name, fn, err)
 	}
@@ -111,11 +113,14 @@ func ReadGreenpackFromFileFunction(env *Zlisp, name string, args []Sexp) (Sexp,
 	default:
 		return SexpNull, fmt.Errorf("%s requires a string path to read. we got type %T / value = %v", name, args[0], args[0])
 	}
+	if err := env.checkRead(name, fn); err != nil {
+		return SexpNull, err
+	}
 
-	if !FileExists(string(fn)) {
+	if !env.fileExists(fn) {
 		return SexpNull, fmt.Errorf("file '%s' does not exist", fn)
 	}
-	f, err := os.Open(fn)
+	f, err := env.openFile(fn)
 	if err != nil {
 		return SexpNull, err
 	}
@@ -0,0 +1,171 @@
+package zcore
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Budget limits how much work a script may do in an env. This
+// complements NewZlispSandbox, which only limits which builtins
+// are visible. A zero field means no limit.
+type Budget struct {
+	// MaxInstructions caps the number of VM instructions executed.
+	MaxInstructions int64
+
+	// MaxDataStackDepth caps the depth of the data stack.
+	MaxDataStackDepth int
+
+	// MaxScopeDepth caps the depth of the runtime scope stack.
+	MaxScopeDepth int
+
+	// MaxAllocCells is an approximate cap on allocation. We
+	// count one cell per array element, per hash entry, and per
+	// byte of string created by the builtins that build them.
+	MaxAllocCells int64
+}
+
+// BudgetUsage reports how much of a Budget has been used since
+// the last SetBudget or ResetBudgetUsage.
+type BudgetUsage struct {
+	Instructions      int64
+	MaxDataStackDepth int
+	MaxScopeDepth     int
+	AllocCells        int64
+}
+
+// BudgetLimit names which limit of a Budget was hit.
+type BudgetLimit string
+
+const (
+	LimitInstructions   BudgetLimit = "instructions"
+	LimitDataStackDepth BudgetLimit = "datastack depth"
+	LimitScopeDepth     BudgetLimit = "scope depth"
+	LimitAllocCells     BudgetLimit = "allocated cells"
+)
+
+// BudgetExceededError is returned from Run (and so from EvalString,
+// Apply, etc) when a script goes over its Budget.
+type BudgetExceededError struct {
+	Limit BudgetLimit
+	Max   int64
+	Used  int64
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("budget exceeded: %s limit is %d, used %d",
+		e.Limit, e.Max, e.Used)
+}
+
+// budgetUsage is the BudgetUsage of an env and the envs made from
+// it by Clone and Duplicate (for macros and goroutines), which
+// all count against the same Budget, so it is updated atomically.
+type budgetUsage struct {
+	instructions   atomic.Int64
+	dataStackDepth atomic.Int64
+	scopeDepth     atomic.Int64
+	allocCells     atomic.Int64
+}
+
+// raise sets max to d if d is greater, and reports whether it was.
+func raise(max *atomic.Int64, d int64) bool {
+	for {
+		m := max.Load()
+		if d <= m {
+			return false
+		}
+		if max.CompareAndSwap(m, d) {
+			return true
+		}
+	}
+}
+
+// SetBudget installs b as the env's budget and zeroes the usage
+// counters. Pass the zero Budget to remove all limits. Envs made
+// by Duplicate (for macros and goroutines) inherit the limits and
+// share the usage, so work done in them counts against b too.
+func (env *Zlisp) SetBudget(b Budget) {
+	if b == (Budget{}) {
+		env.budget = nil
+	} else {
+		env.budget = &b
+	}
+	env.ResetBudgetUsage()
+}
+
+// GetBudget returns the current budget; the zero Budget if none.
+func (env *Zlisp) GetBudget() Budget {
+	if env.budget == nil {
+		return Budget{}
+	}
+	return *env.budget
+}
+
+// BudgetUsage: how much work has been done under the current budget.
+func (env *Zlisp) BudgetUsage() BudgetUsage {
+	u := env.usage
+	if u == nil {
+		return BudgetUsage{}
+	}
+	return BudgetUsage{
+		Instructions:      u.instructions.Load(),
+		MaxDataStackDepth: int(u.dataStackDepth.Load()),
+		MaxScopeDepth:     int(u.scopeDepth.Load()),
+		AllocCells:        u.allocCells.Load(),
+	}
+}
+
+// ResetBudgetUsage zeroes the usage counters, e.g. between runs.
+func (env *Zlisp) ResetBudgetUsage() {
+	if env.usage == nil {
+		env.usage = new(budgetUsage)
+	} else {
+		env.usage.instructions.Store(0)
+		env.usage.dataStackDepth.Store(0)
+		env.usage.scopeDepth.Store(0)
+		env.usage.allocCells.Store(0)
+	}
+	env.budgetErr = nil
+}
+
+// chargeInstr is called by Run before each instruction. It also
+// tracks the stack depths.
+func (env *Zlisp) chargeInstr() error {
+	b := env.budget
+	u := env.usage
+	if n := u.instructions.Add(1); b.MaxInstructions > 0 && n > b.MaxInstructions {
+		return env.overBudget(LimitInstructions, b.MaxInstructions, n)
+	}
+	if d := env.datastack.Size(); raise(&u.dataStackDepth, int64(d)) {
+		if b.MaxDataStackDepth > 0 && d > b.MaxDataStackDepth {
+			return env.overBudget(LimitDataStackDepth, int64(b.MaxDataStackDepth), int64(d))
+		}
+	}
+	if d := env.linearstack.Size(); raise(&u.scopeDepth, int64(d)) {
+		if b.MaxScopeDepth > 0 && d > b.MaxScopeDepth {
+			return env.overBudget(LimitScopeDepth, int64(b.MaxScopeDepth), int64(d))
+		}
+	}
+	return nil
+}
+
+// chargeAlloc accounts for n newly allocated cells. Builtins
+// that create arrays, hashes and strings should call it before
+// doing a large allocation, and return any error.
+func (env *Zlisp) chargeAlloc(n int) error {
+	if env == nil || env.budget == nil || n <= 0 {
+		return nil
+	}
+	used := env.usage.allocCells.Add(int64(n))
+	max := env.budget.MaxAllocCells
+	if max > 0 && used > max {
+		return env.overBudget(LimitAllocCells, max, used)
+	}
+	return nil
+}
+
+// overBudget records the error so that Run can report it
+// intact, even if a builtin wrapped it on the way out.
+func (env *Zlisp) overBudget(limit BudgetLimit, max, used int64) error {
+	env.budgetErr = &BudgetExceededError{Limit: limit, Max: max, Used: used}
+	return env.budgetErr
+}
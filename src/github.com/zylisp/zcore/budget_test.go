@@ -0,0 +1,73 @@
+package zcore
+
+import (
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test420BudgetsAbortRunawayScripts(t *testing.T) {
+
+	cv.Convey(`Given a sandboxed env with a Budget, going over any limit should return a *BudgetExceededError naming that limit, and BudgetUsage should report the work done, also by goroutines`, t, func() {
+
+		env := NewZlispSandbox()
+		defer env.Stop()
+
+		env.SetBudget(Budget{MaxInstructions: 1000})
+		_, err := env.EvalString(`(for [(def i 0) true (set i (+ i 1))] i)`)
+		be, ok := err.(*BudgetExceededError)
+		cv.So(ok, cv.ShouldBeTrue)
+		cv.So(be.Limit, cv.ShouldEqual, LimitInstructions)
+		cv.So(env.BudgetUsage().Instructions, cv.ShouldEqual, 1001)
+
+		env.Clear()
+		env.SetBudget(Budget{MaxAllocCells: 100})
+		_, err = env.EvalString(`(makeArray 1000000000 0)`)
+		be, ok = err.(*BudgetExceededError)
+		cv.So(ok, cv.ShouldBeTrue)
+		cv.So(be.Limit, cv.ShouldEqual, LimitAllocCells)
+
+		env.Clear()
+		env.SetBudget(Budget{MaxAllocCells: 100})
+		_, err = env.EvalString(`(def s "") (for [(def i 0) true (set i (+ i 1))] (set s (concat s "ab")))`)
+		be, ok = err.(*BudgetExceededError)
+		cv.So(ok, cv.ShouldBeTrue)
+		cv.So(be.Limit, cv.ShouldEqual, LimitAllocCells)
+
+		env.Clear()
+		env.SetBudget(Budget{MaxScopeDepth: 30})
+		_, err = env.EvalString(`(defn down [n] (cond (== n 0) 0 (+ 1 (down (- n 1))))) (down 100)`)
+		be, ok = err.(*BudgetExceededError)
+		cv.So(ok, cv.ShouldBeTrue)
+		cv.So(be.Limit, cv.ShouldEqual, LimitScopeDepth)
+
+		env.Clear()
+		env.SetBudget(Budget{MaxInstructions: 100000})
+		res, err := env.EvalString(`(down 10)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res, cv.ShouldResemble, &SexpInt{Val: 10})
+		u := env.BudgetUsage()
+		cv.So(u.Instructions, cv.ShouldBeGreaterThan, 0)
+		cv.So(u.MaxScopeDepth, cv.ShouldBeGreaterThan, 10)
+
+		// goroutines count against the same budget, so ten
+		// loops each under the limit are over it together.
+		goenv := NewZlisp()
+		defer goenv.Stop()
+		goenv.StandardSetup()
+		goenv.SetBudget(Budget{MaxInstructions: 50000})
+		_, err = goenv.EvalString(`(for [(def g 0) (< g 10) (++ g)] (go (for [(def i 0) (< i 1000) (++ i)] i)))`)
+		cv.So(err, cv.ShouldBeNil)
+		for end := time.Now().Add(5 * time.Second); goenv.BudgetUsage().Instructions <= 50000 && time.Now().Before(end); {
+			time.Sleep(time.Millisecond)
+		}
+		_, err = goenv.EvalString(`(+ 1 2)`)
+		be, ok = err.(*BudgetExceededError)
+		cv.So(ok, cv.ShouldBeTrue)
+		cv.So(be.Limit, cv.ShouldEqual, LimitInstructions)
+
+		env.SetBudget(Budget{})
+		cv.So(env.GetBudget(), cv.ShouldResemble, Budget{})
+	})
+}
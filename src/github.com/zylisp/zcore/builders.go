@@ -43,6 +43,7 @@ func (env *Zlisp) ImportPackageBuilder() {
 	//	env.AddBuilder("&", AddressOfBuilder)
 
 	env.AddBuilder("import", ImportPackageBuilder)
+	env.AddFunction("reload", ReloadFunction)
 
 	env.AddFunction("sliceOf", SliceOfFunction)
 	env.AddFunction("ptr", PointerToFunction)
@@ -81,7 +82,7 @@ func (r *RecordDefn) SetFields(flds []*SexpField) {
 }
 
 func (p *RecordDefn) Type() *RegisteredType {
-	rt := GoStructRegistry.Registry[p.Name]
+	rt := GoStructRegistry.Lookup(p.Name)
 	//Q("RecordDefn) Type() sees rt = %v", rt)
 	return rt
 }
@@ -0,0 +1,1059 @@
+package zcore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// BytecodeVersion is the version of the .zyc format, and of the
+// instructions it holds. A cache of another version is ignored,
+// and replaced; bump it when either changes.
+const BytecodeVersion = 3
+
+const zycMagic = "ZYC\x00"
+
+// BytecodeName names the cache of the script name: "lib/a.zyc"
+// for "lib/a.zy".
+func BytecodeName(name string) string {
+	if strings.HasSuffix(name, ".zy") {
+		return name + "c"
+	}
+	return name + ".zyc"
+}
+
+// errNotCacheable is why compiled code was not cached: it holds
+// values the .zyc format cannot, or depended on the env in ways
+// a cache cannot check, such as expanding a macro.
+var errNotCacheable = errors.New("code cannot be cached")
+
+// sourceCached sources the script name, as sourceItem does, but
+// through its .zyc cache. A cache is used if it has the right
+// version, and was made from the same source, by an env with the
+// same builtins, macros and builders; otherwise the script is
+// compiled, and the cache written by writeBytecode.
+func (env *Zlisp) sourceCached(name string) error {
+	src, err := fs.ReadFile(env.FS(), env.fsName(name))
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(src)
+	fp := env.compileFingerprint()
+
+	zycName := BytecodeName(name)
+	if data, err := fs.ReadFile(env.FS(), env.fsName(zycName)); err == nil {
+		if fun, err := env.decodeBytecode(data, name, src, sum, fp); err == nil {
+			env.zycLoads++
+			return env.runSource(fun)
+		}
+	}
+
+	env.Parser.ResetAddNewInput(&NamedInput{RuneScanner: bufio.NewReader(bytes.NewReader(src)), Name: name})
+	expressions, err := env.Parser.ParseTokens()
+	if err != nil {
+		return fmt.Errorf("Error parsing on line %d: %v\n", env.Parser.Lexer.Linenum(), err)
+	}
+	deps := env.genDeps
+	fun, err := env.compileSource(expressions)
+	if err != nil {
+		return err
+	}
+	if env.genDeps == deps {
+		if data, err := encodeBytecode(fun, name, sum, fp, env.symtable); err == nil {
+			env.writeBytecode(zycName, data)
+		}
+	}
+	return env.runSource(fun)
+}
+
+// zycTemps numbers the temporary files caches are written to.
+var zycTemps int64
+
+// writeBytecode writes data to the cache zycName, if the env's
+// policy allows writing there and env.FS() is a RenameFS. It is
+// written to a temporary file beside it, then renamed over it,
+// so that readers see the old cache or the whole new one, and a
+// symlink at zycName is replaced rather than written through.
+func (env *Zlisp) writeBytecode(zycName string, data []byte) error {
+	rfs, ok := env.FS().(RenameFS)
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: zycName, Err: ErrReadOnlyFS}
+	}
+	tmp := fmt.Sprintf("%s.%d-%d.tmp", zycName, os.Getpid(), atomic.AddInt64(&zycTemps, 1))
+	for _, name := range []string{zycName, tmp} {
+		if err := env.checkWrite("source", name); err != nil {
+			return err
+		}
+	}
+	w, err := env.createFile(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = rfs.Rename(env.fsName(tmp), env.fsName(zycName))
+	}
+	if err != nil {
+		rfs.Remove(env.fsName(tmp))
+	}
+	return err
+}
+
+// compileFingerprint sums what the generator looks up in env,
+// and a script cannot change as it compiles: the builtins, the
+// reserved words, the macros and builders there are, and
+// whether the code is optimized.
+func (env *Zlisp) compileFingerprint() [sha256.Size]byte {
+	var names []string
+	for _, f := range env.builtins {
+		names = append(names, "b "+f.name)
+	}
+	for num := range env.reserved {
+		names = append(names, "r "+env.symtable.name(num))
+	}
+	env.macros.mu.RLock()
+	for num := range env.macros.m {
+		names = append(names, "m "+env.symtable.name(num))
+	}
+	env.macros.mu.RUnlock()
+	for i := 0; i <= env.linearstack.tos; i++ {
+		sc, ok := env.linearstack.elements[i].(*Scope)
+		if !ok {
+			continue
+		}
+		sc.each(func(num int, x Sexp) {
+			if f, ok := x.(*SexpFunction); ok && f.isBuilder {
+				names = append(names, "B "+env.symtable.name(num))
+			}
+		})
+	}
+	if env.NoOptimize {
+		names = append(names, "noopt")
+	}
+	sort.Strings(names)
+	return sha256.Sum256([]byte(strings.Join(names, "\n")))
+}
+
+// The .zyc format is
+//
+//	magic, version, source sha256, fingerprint, body length, body, body crc32
+//
+// where the body is the script's top level function. Each Sexp,
+// function, loop and symbol name is written in full where first
+// used, and after that as its number; numbers start at 1, and 0
+// is nil. Positions are line and column only: the file is the
+// one being sourced, and the line texts come from its source.
+
+// Sexp kinds.
+const (
+	zycSentinel = iota + 1
+	zycInt
+	zycUint64
+	zycFloat
+	zycChar
+	zycStr
+	zycBool
+	zycRaw
+	zycSymbol
+	zycPair
+	zycArray
+	zycComment
+	zycSemicolon
+	zycComma
+)
+
+type zycEncoder struct {
+	buf      []byte
+	file     string
+	symtable *symbolTable
+	sexps    map[interface{}]int
+	funcs    map[interface{}]int
+	loops    map[interface{}]int
+	layouts  map[interface{}]int
+	names    map[interface{}]int
+}
+
+func encodeBytecode(fun *SexpFunction, file string, sum, fp [sha256.Size]byte, symtable *symbolTable) ([]byte, error) {
+	e := &zycEncoder{
+		file:     file,
+		symtable: symtable,
+		sexps:    map[interface{}]int{},
+		funcs:    map[interface{}]int{},
+		loops:    map[interface{}]int{},
+		layouts:  map[interface{}]int{},
+		names:    map[interface{}]int{},
+	}
+	if err := e.function(fun); err != nil {
+		return nil, err
+	}
+	body := e.buf
+
+	out := []byte(zycMagic)
+	out = binary.AppendUvarint(out, BytecodeVersion)
+	out = append(out, sum[:]...)
+	out = append(out, fp[:]...)
+	out = binary.AppendUvarint(out, uint64(len(body)))
+	out = append(out, body...)
+	return binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(body)), nil
+}
+
+func (e *zycEncoder) putUint(x uint64) {
+	e.buf = binary.AppendUvarint(e.buf, x)
+}
+
+func (e *zycEncoder) putInt(x int64) {
+	e.buf = binary.AppendVarint(e.buf, x)
+}
+
+func (e *zycEncoder) putBool(b bool) {
+	if b {
+		e.putUint(1)
+	} else {
+		e.putUint(0)
+	}
+}
+
+func (e *zycEncoder) putString(s string) {
+	e.putUint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// ref writes the number of x, from seen; it reports if this is
+// the first use of x, which the caller must then write out.
+func (e *zycEncoder) ref(seen map[interface{}]int, x interface{}) bool {
+	if id, ok := seen[x]; ok {
+		e.putUint(uint64(id))
+		return false
+	}
+	id := len(seen) + 1
+	seen[x] = id
+	e.putUint(uint64(id))
+	return true
+}
+
+func (e *zycEncoder) pos(p *SrcPos) error {
+	if p == nil {
+		e.putUint(0)
+		return nil
+	}
+	if p.File != e.file || p.Line < 1 {
+		return fmt.Errorf("%w: code from %s", errNotCacheable, p)
+	}
+	e.putUint(uint64(p.Line))
+	e.putUint(uint64(p.Col))
+	return nil
+}
+
+func (e *zycEncoder) sexp(x Sexp) error {
+	if x == nil {
+		e.putUint(0)
+		return nil
+	}
+	switch x.(type) {
+	case *SexpSentinel, *SexpInt, *SexpUint64, *SexpFloat, *SexpChar, *SexpStr, *SexpBool,
+		*SexpRaw, *SexpSymbol, *SexpPair, *SexpArray, *SexpComment, *SexpSemicolon, *SexpComma:
+	default:
+		return fmt.Errorf("%w: %T", errNotCacheable, x)
+	}
+	if sexpTyp(x) != nil {
+		return fmt.Errorf("%w: typed %T", errNotCacheable, x)
+	}
+	if !e.ref(e.sexps, x) {
+		return nil
+	}
+
+	switch t := x.(type) {
+	case *SexpSentinel:
+		e.putUint(zycSentinel)
+		e.putUint(uint64(t.Val))
+	case *SexpInt:
+		e.putUint(zycInt)
+		e.putInt(t.Val)
+	case *SexpUint64:
+		e.putUint(zycUint64)
+		e.putUint(t.Val)
+	case *SexpFloat:
+		e.putUint(zycFloat)
+		e.putUint(math.Float64bits(t.Val))
+		e.putBool(t.Scientific)
+	case *SexpChar:
+		e.putUint(zycChar)
+		e.putInt(int64(t.Val))
+	case *SexpStr:
+		e.putUint(zycStr)
+		e.putString(t.S)
+		e.putBool(t.Backtick)
+	case *SexpBool:
+		e.putUint(zycBool)
+		e.putBool(t.Val)
+	case *SexpRaw:
+		e.putUint(zycRaw)
+		e.putString(string(t.Val))
+	case *SexpSymbol:
+		e.putUint(zycSymbol)
+		if e.ref(e.names, t.name) {
+			e.putString(t.name)
+			e.putBool(e.symtable.isGensym(t.name))
+		}
+		e.putBool(t.isDot)
+		e.putBool(t.colonTail)
+		return e.pos(t.pos)
+	case *SexpPair:
+		e.putUint(zycPair)
+		if err := e.pos(t.pos); err != nil {
+			return err
+		}
+		if err := e.sexp(t.Head); err != nil {
+			return err
+		}
+		return e.sexp(t.Tail)
+	case *SexpArray:
+		e.putUint(zycArray)
+		e.putBool(t.Infix)
+		e.putBool(t.IsFuncDeclTypeArray)
+		if err := e.pos(t.pos); err != nil {
+			return err
+		}
+		e.putUint(uint64(len(t.Val)))
+		for _, v := range t.Val {
+			if err := e.sexp(v); err != nil {
+				return err
+			}
+		}
+	case *SexpComment:
+		e.putUint(zycComment)
+		e.putString(t.Comment)
+		e.putBool(t.Block)
+	case *SexpSemicolon:
+		e.putUint(zycSemicolon)
+	case *SexpComma:
+		e.putUint(zycComma)
+	}
+	return nil
+}
+
+// sexpTyp is the Typ of x, of the kinds that have one.
+func sexpTyp(x Sexp) *RegisteredType {
+	switch t := x.(type) {
+	case *SexpInt:
+		return t.Typ
+	case *SexpUint64:
+		return t.Typ
+	case *SexpFloat:
+		return t.Typ
+	case *SexpChar:
+		return t.Typ
+	case *SexpStr:
+		return t.Typ
+	case *SexpBool:
+		return t.Typ
+	case *SexpRaw:
+		return t.Typ
+	case *SexpArray:
+		return t.Typ
+	}
+	return nil
+}
+
+func (e *zycEncoder) symbol(sym *SexpSymbol) error {
+	if sym == nil {
+		return e.sexp(nil)
+	}
+	return e.sexp(sym)
+}
+
+func (e *zycEncoder) loop(loop *Loop) error {
+	if loop == nil {
+		return fmt.Errorf("%w: no loop", errNotCacheable)
+	}
+	if !e.ref(e.loops, loop) {
+		return nil
+	}
+	if err := e.symbol(loop.stmtname); err != nil {
+		return err
+	}
+	if err := e.symbol(loop.label); err != nil {
+		return err
+	}
+	for _, x := range []int{loop.loopStart, loop.loopLen, loop.breakOffset, loop.continueOffset, loop.depth} {
+		e.putInt(int64(x))
+	}
+	return nil
+}
+
+// layout writes a scope layout, or 0 for none.
+func (e *zycEncoder) layout(layout *scopeLayout) error {
+	if layout == nil {
+		e.putUint(0)
+		return nil
+	}
+	if !e.ref(e.layouts, layout) {
+		return nil
+	}
+	e.putUint(uint64(len(layout.syms)))
+	for _, sym := range layout.syms {
+		if err := e.symbol(sym); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lexAddr writes where a reference was resolved to; an address
+// not resolved has no local layouts.
+func (e *zycEncoder) lexAddr(a *lexAddr) error {
+	for _, path := range [][]*scopeLayout{a.local, a.captured} {
+		e.putUint(uint64(len(path)))
+		for _, layout := range path {
+			if err := e.layout(layout); err != nil {
+				return err
+			}
+		}
+	}
+	e.putInt(int64(a.slot))
+	return nil
+}
+
+func (e *zycEncoder) function(fun *SexpFunction) error {
+	if fun.user || fun.inputTypes != nil || fun.returnTypes != nil {
+		return fmt.Errorf("%w: function %s", errNotCacheable, fun.name)
+	}
+	if !e.ref(e.funcs, fun) {
+		return nil
+	}
+	e.putString(fun.name)
+	e.putUint(uint64(fun.nargs))
+	e.putBool(fun.varargs)
+	e.putBool(fun.isBuilder)
+	e.putBool(fun.hasBody)
+	if err := e.sexp(fun.orig); err != nil {
+		return err
+	}
+	e.putUint(uint64(len(fun.fun)))
+	for _, instr := range fun.fun {
+		if err := e.instr(fun, instr); err != nil {
+			return err
+		}
+	}
+	e.putUint(uint64(len(fun.srcmap)))
+	for _, p := range fun.srcmap {
+		if err := e.pos(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *zycEncoder) instr(fun *SexpFunction, instr Instruction) error {
+	switch t := instr.(type) {
+	case JumpInstr:
+		e.putUint(opJump)
+		e.putInt(int64(t.addpc))
+		e.putString(t.where)
+	case GotoInstr:
+		e.putUint(opGoto)
+		e.putInt(int64(t.location))
+	case BranchInstr:
+		e.putUint(opBranch)
+		e.putBool(t.direction)
+		e.putInt(int64(t.location))
+	case PushInstr:
+		e.putUint(opPush)
+		return e.sexp(t.expr)
+	case PopInstr:
+		e.putUint(opPop)
+		e.putInt(int64(t))
+	case DupInstr:
+		e.putUint(opDup)
+		e.putInt(int64(t))
+	case EnvToStackInstr:
+		e.putUint(opEnvToStack)
+		return e.symbol(t.sym)
+	case PopStackPutEnvInstr:
+		e.putUint(opPopStackPutEnv)
+		return e.symbol(t.sym)
+	case UpdateInstr:
+		e.putUint(opUpdate)
+		return e.symbol(t.sym)
+	case CallInstr:
+		e.putUint(opCall)
+		e.putInt(int64(t.nargs))
+		return e.symbol(t.sym)
+	case DispatchInstr:
+		e.putUint(opDispatch)
+		e.putInt(int64(t.nargs))
+	case ReturnInstr:
+		e.putUint(opReturn)
+		e.putBool(t.err != nil)
+		if t.err != nil {
+			e.putString(t.err.Error())
+		}
+	case AddScopeInstr:
+		e.putUint(opAddScope)
+		e.putString(t.Name)
+		e.putBool(t.Package)
+		return e.layout(t.layout)
+	case AddFuncScopeInstr:
+		if t.Helper != nil && t.Helper.MyFunction != fun {
+			return fmt.Errorf("%w: scope of another function", errNotCacheable)
+		}
+		e.putUint(opAddFuncScope)
+		e.putString(t.Name)
+		e.putBool(t.Helper != nil)
+		return e.layout(t.layout)
+	case RemoveScopeInstr:
+		e.putUint(opRemoveScope)
+	case ExplodeInstr:
+		e.putUint(opExplode)
+		e.putInt(int64(t))
+	case SquashInstr:
+		e.putUint(opSquash)
+		e.putInt(int64(t))
+	case BindlistInstr:
+		e.putUint(opBindlist)
+		e.putUint(uint64(len(t.syms)))
+		for _, sym := range t.syms {
+			if err := e.symbol(sym); err != nil {
+				return err
+			}
+		}
+	case VectorizeInstr:
+		e.putUint(opVectorize)
+		e.putInt(int64(t))
+	case HashizeInstr:
+		e.putUint(opHashize)
+		e.putInt(int64(t.HashLen))
+		e.putString(t.TypeName)
+	case LabelInstr:
+		e.putUint(opLabel)
+		e.putString(t.label)
+	case *BreakInstr:
+		e.putUint(opBreak)
+		e.putInt(int64(t.pos))
+		return e.loop(t.loop)
+	case *ContinueInstr:
+		e.putUint(opContinue)
+		e.putInt(int64(t.pos))
+		return e.loop(t.loop)
+	case LoopStartInstr:
+		e.putUint(opLoopStart)
+		return e.loop(t.loop)
+	case PushStackmarkInstr:
+		e.putUint(opPushStackmark)
+		return e.symbol(t.sym)
+	case PopUntilStackmarkInstr:
+		e.putUint(opPopUntilStackmark)
+		return e.symbol(t.sym)
+	case ClearStackmarkInstr:
+		e.putUint(opClearStackmark)
+		return e.symbol(t.sym)
+	case DebugInstr:
+		e.putUint(opDebug)
+		e.putString(t.diagnostic)
+	case CreateClosureInstr:
+		e.putUint(opCreateClosure)
+		return e.function(t.sfun)
+	case AssignInstr:
+		e.putUint(opAssign)
+	case PopScopeTransferToDataStackInstr:
+		e.putUint(opPopScopeTransfer)
+		e.putString(t.PackageName)
+	case TryStartInstr:
+		e.putUint(opTryStart)
+		e.putInt(int64(t.catch))
+	case TryEndInstr:
+		e.putUint(opTryEnd)
+	case ThrowInstr:
+		e.putUint(opThrow)
+	case DeftestInstr:
+		e.putUint(opDeftest)
+		e.putString(t.name)
+		return e.pos(t.pos)
+	case AssertErrorInstr:
+		e.putUint(opAssertError)
+		e.putBool(t.pattern)
+		e.putString(t.expr)
+	case LexToStackInstr:
+		e.putUint(opLexToStack)
+		if err := e.symbol(t.sym); err != nil {
+			return err
+		}
+		return e.lexAddr(t.addr)
+	case LexUpdateInstr:
+		e.putUint(opLexUpdate)
+		if err := e.symbol(t.sym); err != nil {
+			return err
+		}
+		return e.lexAddr(t.addr)
+	case IncrInstr:
+		e.putUint(opIncr)
+		if err := e.symbol(t.sym); err != nil {
+			return err
+		}
+		if err := e.symbol(t.op); err != nil {
+			return err
+		}
+		e.putBool(t.def)
+		e.putBool(t.addr != nil)
+		if t.addr != nil {
+			return e.lexAddr(t.addr)
+		}
+	default:
+		return fmt.Errorf("%w: instruction %T", errNotCacheable, instr)
+	}
+	return nil
+}
+
+type zycDecoder struct {
+	env   *Zlisp
+	buf   []byte
+	err   error
+	file  string
+	lines []*srcLine
+	poses map[[2]int]*SrcPos
+	sexps []Sexp
+	funcs []*SexpFunction
+	loops []*Loop
+	lays  []*scopeLayout
+	names []string
+}
+
+// decodeBytecode reads the function cached in data, if it is
+// current for the source src of the script file.
+func (env *Zlisp) decodeBytecode(data []byte, file string, src []byte, sum, fp [sha256.Size]byte) (*SexpFunction, error) {
+	stale := errors.New("stale or damaged cache")
+	if !bytes.HasPrefix(data, []byte(zycMagic)) {
+		return nil, stale
+	}
+	data = data[len(zycMagic):]
+	version, n := binary.Uvarint(data)
+	if n <= 0 || version != BytecodeVersion {
+		return nil, stale
+	}
+	data = data[n:]
+	if len(data) < 2*sha256.Size ||
+		!bytes.Equal(data[:sha256.Size], sum[:]) ||
+		!bytes.Equal(data[sha256.Size:2*sha256.Size], fp[:]) {
+		return nil, stale
+	}
+	data = data[2*sha256.Size:]
+	size, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) != size+4 {
+		return nil, stale
+	}
+	body := data[n : n+int(size)]
+	if binary.LittleEndian.Uint32(data[n+int(size):]) != crc32.ChecksumIEEE(body) {
+		return nil, stale
+	}
+
+	d := &zycDecoder{env: env, buf: body, file: file, poses: map[[2]int]*SrcPos{}}
+	for _, text := range strings.Split(string(src), "\n") {
+		d.lines = append(d.lines, &srcLine{text: strings.TrimSuffix(text, "\r")})
+	}
+	fun := d.function()
+	if d.err == nil && len(d.buf) != 0 {
+		d.fail("%d bytes left over", len(d.buf))
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return fun, nil
+}
+
+func (d *zycDecoder) fail(format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("bad bytecode: "+format, args...)
+	}
+}
+
+func (d *zycDecoder) getUint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail("truncated")
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return x
+}
+
+func (d *zycDecoder) getInt() int64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.fail("truncated")
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return x
+}
+
+func (d *zycDecoder) getBool() bool {
+	return d.getUint() != 0
+}
+
+func (d *zycDecoder) getString() string {
+	n := d.getUint()
+	if n > uint64(len(d.buf)) {
+		d.fail("truncated")
+		return ""
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
+
+// getCount reads a count of things of at least a byte each.
+func (d *zycDecoder) getCount() int {
+	n := d.getUint()
+	if n > uint64(len(d.buf)) {
+		d.fail("count %d too large", n)
+		return 0
+	}
+	return int(n)
+}
+
+// newRef reads a number, as ref wrote it: old says if it is one
+// already read, or 0, and new if it is the next one, to read now.
+func (d *zycDecoder) newRef(have int) (id int, isNew bool) {
+	x := d.getUint()
+	switch {
+	case x <= uint64(have):
+		return int(x), false
+	case x == uint64(have)+1:
+		return int(x), true
+	}
+	d.fail("reference %d out of order", x)
+	return 0, false
+}
+
+func (d *zycDecoder) pos() *SrcPos {
+	line := int(d.getUint())
+	if line == 0 {
+		return nil
+	}
+	col := int(d.getUint())
+	key := [2]int{line, col}
+	if p, ok := d.poses[key]; ok {
+		return p
+	}
+	p := &SrcPos{File: d.file, Line: line, Col: col}
+	if line <= len(d.lines) {
+		p.src = d.lines[line-1]
+	}
+	d.poses[key] = p
+	return p
+}
+
+func (d *zycDecoder) sexp() Sexp {
+	id, isNew := d.newRef(len(d.sexps))
+	if !isNew {
+		if id == 0 || d.err != nil {
+			return nil
+		}
+		return d.sexps[id-1]
+	}
+	d.sexps = append(d.sexps, nil)
+	var x Sexp
+	switch kind := d.getUint(); kind {
+	case zycSentinel:
+		switch d.getUint() {
+		case 0:
+			x = SexpNull
+		case 1:
+			x = SexpEnd
+		case 2:
+			x = SexpMarker
+		default:
+			d.fail("bad sentinel")
+		}
+	case zycInt:
+		x = &SexpInt{Val: d.getInt()}
+	case zycUint64:
+		x = &SexpUint64{Val: d.getUint()}
+	case zycFloat:
+		x = &SexpFloat{Val: math.Float64frombits(d.getUint()), Scientific: d.getBool()}
+	case zycChar:
+		x = &SexpChar{Val: rune(d.getInt())}
+	case zycStr:
+		x = &SexpStr{S: d.getString(), Backtick: d.getBool()}
+	case zycBool:
+		x = &SexpBool{Val: d.getBool()}
+	case zycRaw:
+		x = &SexpRaw{Val: []byte(d.getString())}
+	case zycSymbol:
+		nameID, isNewName := d.newRef(len(d.names))
+		if isNewName {
+			name := d.getString()
+			if d.getBool() {
+				// a fresh one, so as not to meet the env's own.
+				name = d.env.GenSymbol(strings.TrimRight(name, "0123456789")).name
+			}
+			d.names = append(d.names, name)
+		}
+		if nameID == 0 || d.err != nil {
+			d.fail("symbol without a name")
+			return nil
+		}
+		sym := d.env.MakeSymbol(d.names[nameID-1])
+		sym.isDot = d.getBool()
+		sym.colonTail = d.getBool()
+		sym.pos = d.pos()
+		x = sym
+	case zycPair:
+		pair := &SexpPair{pos: d.pos()}
+		pair.Head = d.sexp()
+		pair.Tail = d.sexp()
+		x = pair
+	case zycArray:
+		arr := &SexpArray{Infix: d.getBool(), IsFuncDeclTypeArray: d.getBool(), Env: d.env}
+		arr.pos = d.pos()
+		n := d.getCount()
+		arr.Val = make([]Sexp, n)
+		for i := range arr.Val {
+			arr.Val[i] = d.sexp()
+		}
+		x = arr
+	case zycComment:
+		x = &SexpComment{Comment: d.getString(), Block: d.getBool()}
+	case zycSemicolon:
+		x = &SexpSemicolon{}
+	case zycComma:
+		x = &SexpComma{}
+	default:
+		d.fail("unknown kind %d", kind)
+	}
+	d.sexps[id-1] = x
+	return x
+}
+
+func (d *zycDecoder) symbol() *SexpSymbol {
+	x := d.sexp()
+	if x == nil {
+		return nil
+	}
+	sym, ok := x.(*SexpSymbol)
+	if !ok {
+		d.fail("%T where a symbol should be", x)
+	}
+	return sym
+}
+
+func (d *zycDecoder) loop() *Loop {
+	id, isNew := d.newRef(len(d.loops))
+	if !isNew {
+		if id == 0 || d.err != nil {
+			d.fail("no loop")
+			return nil
+		}
+		return d.loops[id-1]
+	}
+	loop := &Loop{}
+	d.loops = append(d.loops, loop)
+	loop.stmtname = d.symbol()
+	loop.label = d.symbol()
+	for _, x := range []*int{&loop.loopStart, &loop.loopLen, &loop.breakOffset, &loop.continueOffset, &loop.depth} {
+		*x = int(d.getInt())
+	}
+	return loop
+}
+
+func (d *zycDecoder) layout() *scopeLayout {
+	id, isNew := d.newRef(len(d.lays))
+	if !isNew {
+		if id == 0 || d.err != nil {
+			return nil
+		}
+		return d.lays[id-1]
+	}
+	layout := &scopeLayout{}
+	d.lays = append(d.lays, layout)
+	layout.syms = make([]*SexpSymbol, d.getCount())
+	for i := range layout.syms {
+		layout.syms[i] = d.symbol()
+	}
+	return layout
+}
+
+func (d *zycDecoder) lexAddr() *lexAddr {
+	a := &lexAddr{}
+	for _, path := range []*[]*scopeLayout{&a.local, &a.captured} {
+		if n := d.getCount(); n > 0 {
+			*path = make([]*scopeLayout, n)
+			for i := range *path {
+				(*path)[i] = d.layout()
+			}
+		}
+	}
+	a.slot = int(d.getInt())
+	return a
+}
+
+func (d *zycDecoder) function() *SexpFunction {
+	id, isNew := d.newRef(len(d.funcs))
+	if !isNew {
+		if id == 0 || d.err != nil || d.funcs[id-1] == nil {
+			d.fail("no function")
+			return nil
+		}
+		return d.funcs[id-1]
+	}
+	d.funcs = append(d.funcs, nil)
+	name := d.getString()
+	nargs := int(d.getUint())
+	varargs := d.getBool()
+	isBuilder := d.getBool()
+	hasBody := d.getBool()
+	orig := d.sexp()
+	helper := &AddFuncScopeHelper{}
+	code := make([]Instruction, d.getCount())
+	for i := range code {
+		code[i] = d.instr(helper)
+	}
+	srcmap := make([]*SrcPos, d.getCount())
+	for i := range srcmap {
+		srcmap[i] = d.pos()
+	}
+	if d.err != nil {
+		return nil
+	}
+
+	fun := d.env.MakeFunction(name, nargs, varargs, code, orig)
+	fun.isBuilder = isBuilder
+	fun.hasBody = hasBody
+	fun.srcmap = srcmap
+	helper.MyFunction = fun
+	if d.env.coverage != nil {
+		d.env.coverage.add(srcmap)
+	}
+	d.funcs[id-1] = fun
+	return fun
+}
+
+func (d *zycDecoder) instr(helper *AddFuncScopeHelper) Instruction {
+	switch op := d.getUint(); op {
+	case opJump:
+		return JumpInstr{addpc: int(d.getInt()), where: d.getString()}
+	case opGoto:
+		return GotoInstr{location: int(d.getInt())}
+	case opBranch:
+		return BranchInstr{direction: d.getBool(), location: int(d.getInt())}
+	case opPush:
+		return PushInstr{expr: d.sexp()}
+	case opPop:
+		return PopInstr(d.getInt())
+	case opDup:
+		return DupInstr(d.getInt())
+	case opEnvToStack:
+		return EnvToStackInstr{sym: d.symbol()}
+	case opPopStackPutEnv:
+		return PopStackPutEnvInstr{sym: d.symbol()}
+	case opUpdate:
+		return UpdateInstr{sym: d.symbol()}
+	case opCall:
+		nargs := int(d.getInt())
+		return CallInstr{nargs: nargs, sym: d.symbol()}
+	case opDispatch:
+		return DispatchInstr{nargs: int(d.getInt())}
+	case opReturn:
+		var err error
+		if d.getBool() {
+			err = errors.New(d.getString())
+		}
+		return ReturnInstr{err: err}
+	case opAddScope:
+		return AddScopeInstr{Name: d.getString(), Package: d.getBool(), layout: d.layout()}
+	case opAddFuncScope:
+		a := AddFuncScopeInstr{Name: d.getString()}
+		if d.getBool() {
+			a.Helper = helper
+		}
+		a.layout = d.layout()
+		return a
+	case opRemoveScope:
+		return RemoveScopeInstr{}
+	case opExplode:
+		return ExplodeInstr(d.getInt())
+	case opSquash:
+		return SquashInstr(d.getInt())
+	case opBindlist:
+		syms := make([]*SexpSymbol, d.getCount())
+		for i := range syms {
+			syms[i] = d.symbol()
+		}
+		return BindlistInstr{syms: syms}
+	case opVectorize:
+		return VectorizeInstr(d.getInt())
+	case opHashize:
+		return HashizeInstr{HashLen: int(d.getInt()), TypeName: d.getString()}
+	case opLabel:
+		return LabelInstr{label: d.getString()}
+	case opBreak:
+		pos := int(d.getInt())
+		return &BreakInstr{pos: pos, loop: d.loop()}
+	case opContinue:
+		pos := int(d.getInt())
+		return &ContinueInstr{pos: pos, loop: d.loop()}
+	case opLoopStart:
+		return LoopStartInstr{loop: d.loop()}
+	case opPushStackmark:
+		return PushStackmarkInstr{sym: d.symbol()}
+	case opPopUntilStackmark:
+		return PopUntilStackmarkInstr{sym: d.symbol()}
+	case opClearStackmark:
+		return ClearStackmarkInstr{sym: d.symbol()}
+	case opDebug:
+		return DebugInstr{diagnostic: d.getString()}
+	case opCreateClosure:
+		return CreateClosureInstr{sfun: d.function()}
+	case opAssign:
+		return AssignInstr{}
+	case opPopScopeTransfer:
+		return PopScopeTransferToDataStackInstr{PackageName: d.getString()}
+	case opTryStart:
+		return TryStartInstr{catch: int(d.getInt())}
+	case opTryEnd:
+		return TryEndInstr{}
+	case opThrow:
+		return ThrowInstr{}
+	case opDeftest:
+		name := d.getString()
+		return DeftestInstr{name: name, pos: d.pos()}
+	case opAssertError:
+		return AssertErrorInstr{pattern: d.getBool(), expr: d.getString()}
+	case opLexToStack:
+		sym := d.symbol()
+		return LexToStackInstr{sym: sym, addr: d.lexAddr()}
+	case opLexUpdate:
+		sym := d.symbol()
+		return LexUpdateInstr{sym: sym, addr: d.lexAddr()}
+	case opIncr:
+		sym := d.symbol()
+		op := d.symbol()
+		a := IncrInstr{sym: sym, op: op, def: d.getBool()}
+		if d.getBool() {
+			a.addr = d.lexAddr()
+		}
+		return a
+	default:
+		d.fail("unknown opcode %d", op)
+		return nil
+	}
+}
@@ -0,0 +1,183 @@
+package zcore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test570SourceUsesAndRefreshesTheZycCache(t *testing.T) {
+
+	cv.Convey(`Given CacheBytecode, source should write a .zyc beside the script, a fresh env should run the cache instead of compiling, with the same results and error positions, and a changed script, another version or a damaged cache should be compiled afresh`, t, func() {
+
+		script := `(defn sumTo [n]
+  (let [t 0]
+    (for [(def i 0) true (set i (+ i 1))]
+      (cond (> i n) (break)
+            (set t (+ t i))))
+    t))
+(def words (quote (a "b" 3.5 [1 2] (x 1))))
+(def caught (try (undefinedFn) (catch e "caught")))
+(defn fail [] (undefinedFn 1))
+`
+		files := fstest.MapFS{
+			"lib/sums.zy":  {Data: []byte(script)},
+			"lib/mac.zy":   {Data: []byte("(defmac twice [x] ^(* 2 ~x))\n(def y (twice 3))\n")},
+			"lib/kit.zy":   {Data: []byte(`(package "kit" (def Name "cat"))`)},
+			"lib/other.zy": {Data: []byte(`(def z 1)`)},
+		}
+		newEnv := func() *Zlisp {
+			env := NewZlisp()
+			env.StandardSetup()
+			env.SetFS(memFS{files})
+			env.CacheBytecode = true
+			return env
+		}
+		check := func(env *Zlisp) {
+			res, err := env.EvalString(`(sumTo 10)`)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(res.SexpString(nil), cv.ShouldEqual, `55`)
+			res, err = env.EvalString(`[words caught]`)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(res.SexpString(nil), cv.ShouldEqual, `[(a "b" 3.5 [1 2] (x 1)) "caught"]`)
+
+			env.Clear()
+			_, err = env.EvalString(`(fail)`)
+			cv.So(err, cv.ShouldNotBeNil)
+			cv.So(env.Position().String(), cv.ShouldEqual, "lib/sums.zy:9:15")
+			cv.So(env.Position().Source(), cv.ShouldEqual, "(defn fail [] (undefinedFn 1))")
+		}
+
+		cv.So(BytecodeName("lib/sums.zy"), cv.ShouldEqual, "lib/sums.zyc")
+		cv.So(BytecodeName("lib/sums"), cv.ShouldEqual, "lib/sums.zyc")
+
+		env := newEnv()
+		_, err := env.EvalString(`(source "lib/sums.zy")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(env.zycLoads, cv.ShouldEqual, 0)
+		zyc, ok := files["lib/sums.zyc"]
+		cv.So(ok, cv.ShouldBeTrue)
+		check(env)
+		env.Stop()
+
+		env = newEnv()
+		_, err = env.EvalString(`(source "lib/sums.zy")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(env.zycLoads, cv.ShouldEqual, 1)
+		check(env)
+		env.Stop()
+
+		// a changed script is compiled, and its cache replaced.
+		files["lib/sums.zy"] = &fstest.MapFile{Data: []byte(strings.Replace(script, "(+ t i)", "(+ t i i)", 1))}
+		env = newEnv()
+		res, err := env.EvalString(`(source "lib/sums.zy") (sumTo 10)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `110`)
+		cv.So(env.zycLoads, cv.ShouldEqual, 0)
+		cv.So(string(files["lib/sums.zyc"].Data), cv.ShouldNotEqual, string(zyc.Data))
+		env.Stop()
+		files["lib/sums.zy"] = &fstest.MapFile{Data: []byte(script)}
+
+		// as are those whose cache is of another version, or damaged.
+		for _, damage := range []func([]byte){
+			func(b []byte) { b[len(zycMagic)] = BytecodeVersion + 1 },
+			func(b []byte) { b[len(b)-10] ^= 0xff },
+			func(b []byte) { b[0] = 'X' },
+		} {
+			bad := append([]byte(nil), zyc.Data...)
+			damage(bad)
+			files["lib/sums.zyc"] = &fstest.MapFile{Data: bad}
+			env = newEnv()
+			_, err = env.EvalString(`(source "lib/sums.zy")`)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(env.zycLoads, cv.ShouldEqual, 0)
+			check(env)
+			env.Stop()
+			cv.So(string(files["lib/sums.zyc"].Data), cv.ShouldEqual, string(zyc.Data))
+		}
+
+		// import goes through the cache too.
+		for loads := 0; loads < 2; loads++ {
+			env = newEnv()
+			res, err = env.EvalString(`(import "lib/kit.zy") (concat kit.Name "")`)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(res.SexpString(nil), cv.ShouldEqual, `"cat"`)
+			cv.So(env.zycLoads, cv.ShouldEqual, loads)
+			env.Stop()
+		}
+
+		// what a macro made depends on the macro, so is not cached.
+		env = newEnv()
+		res, err = env.EvalString(`(source "lib/mac.zy") y`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `6`)
+		_, ok = files["lib/mac.zyc"]
+		cv.So(ok, cv.ShouldBeFalse)
+		env.Stop()
+
+		// nor is one env's cache used by an env with other macros.
+		env = newEnv()
+		_, err = env.EvalString(`(defmac other [x] x)`)
+		cv.So(err, cv.ShouldBeNil)
+		_, err = env.EvalString(`(source "lib/sums.zy")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(env.zycLoads, cv.ShouldEqual, 0)
+		env.Stop()
+
+		// and without CacheBytecode, no cache is written.
+		env = newEnv()
+		env.CacheBytecode = false
+		_, err = env.EvalString(`(source "lib/other.zy")`)
+		cv.So(err, cv.ShouldBeNil)
+		_, ok = files["lib/other.zyc"]
+		cv.So(ok, cv.ShouldBeFalse)
+		env.Stop()
+	})
+}
+
+func Test630ZycCacheIsWrittenOnlyWhereThePolicyAllows(t *testing.T) {
+
+	cv.Convey(`Given CacheBytecode under a SandboxPolicy, source should write no .zyc where the policy only allows reading, or through a symlink out of a write root, and where it may write, should leave only the whole cache and no temporary file`, t, func() {
+
+		dir := t.TempDir()
+		ro := filepath.Join(dir, "ro")
+		rw := filepath.Join(dir, "rw")
+		out := filepath.Join(dir, "out")
+		for _, d := range []string{ro, rw, out} {
+			cv.So(os.Mkdir(d, 0755), cv.ShouldBeNil)
+			cv.So(os.WriteFile(filepath.Join(d, "s.zy"), []byte("(def x 1)\n"), 0644), cv.ShouldBeNil)
+		}
+		cv.So(os.Symlink(filepath.Join(out, "s.zyc"), filepath.Join(rw, "t.zyc")), cv.ShouldBeNil)
+		cv.So(os.WriteFile(filepath.Join(rw, "t.zy"), []byte("(def y 2)\n"), 0644), cv.ShouldBeNil)
+
+		env := NewZlispWithPolicy(SandboxPolicy{ReadRoots: []string{ro, rw}, WriteRoots: []string{rw}})
+		defer env.Stop()
+		env.CacheBytecode = true
+
+		res, err := env.EvalString(`(source "` + ro + `/s.zy") x`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "1")
+		_, err = os.Stat(filepath.Join(ro, "s.zyc"))
+		cv.So(errors.Is(err, os.ErrNotExist), cv.ShouldBeTrue)
+		_, err = env.EvalString(`(writef "x" "` + ro + `/w.txt")`)
+		cv.So(errors.Is(err, os.ErrPermission), cv.ShouldBeTrue)
+		env.Clear()
+
+		res, err = env.EvalString(`(source "` + rw + `/t.zy") y`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "2")
+		_, err = os.Stat(filepath.Join(out, "s.zyc"))
+		cv.So(errors.Is(err, os.ErrNotExist), cv.ShouldBeTrue)
+
+		_, err = env.EvalString(`(source "` + rw + `/s.zy")`)
+		cv.So(err, cv.ShouldBeNil)
+		names, err := filepath.Glob(filepath.Join(rw, "s.zy*"))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(names, cv.ShouldResemble, []string{filepath.Join(rw, "s.zy"), filepath.Join(rw, "s.zyc")})
+	})
+}
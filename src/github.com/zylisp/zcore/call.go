@@ -0,0 +1,92 @@
+package zcore
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Call looks up the script function called name and applies it
+// to args, which are converted from Go with FromGoValue. The
+// result is converted back to Go with SexpToGo. The name may be a
+// dotted path into a package, as in "hi.Myfun".
+//
+// Call may be used between evaluations, or from within a builtin;
+// the interpreter's position and stacks are restored afterwards.
+func (env *Zlisp) Call(name string, args ...interface{}) (interface{}, error) {
+	res, err := env.callByName(name, args)
+	if err != nil {
+		return nil, err
+	}
+	return SexpToGo(res, env, nil), nil
+}
+
+// CallAs is Call, but decodes the result into a T with ToGoValue,
+// so for example a record can be returned as a registered Go struct.
+func CallAs[T any](env *Zlisp, name string, args ...interface{}) (T, error) {
+	var zero T
+	res, err := env.callByName(name, args)
+	if err != nil {
+		return zero, err
+	}
+	va, err := env.ToGoValue(res, reflect.TypeOf(&zero).Elem())
+	if err != nil {
+		return zero, fmt.Errorf("result of '%s': %s", name, err)
+	}
+	return va.Interface().(T), nil
+}
+
+// LookupFunction finds the function called name in the global
+// scope, or, given a dotted path such as "pkg.Fun", in a package.
+func (env *Zlisp) LookupFunction(name string) (*SexpFunction, error) {
+	path := strings.Split(name, ".")
+	obj, found := env.FindObject(path[0])
+	if !found {
+		return nil, fmt.Errorf("function '%s' not found", name)
+	}
+	if len(path) > 1 {
+		pkg, isStack := obj.(*Stack)
+		if !isStack || !pkg.IsPackage {
+			return nil, fmt.Errorf("'%s' is not a package", path[0])
+		}
+		var err error
+		obj, err = pkg.nestedPathGetSet(env, path[1:], nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	fun, isFun := obj.(*SexpFunction)
+	if !isFun {
+		return nil, fmt.Errorf("'%s' is not a function, but %T", name, obj)
+	}
+	return fun, nil
+}
+
+func (env *Zlisp) callByName(name string, args []interface{}) (Sexp, error) {
+	fun, err := env.LookupFunction(name)
+	if err != nil {
+		return SexpNull, err
+	}
+	sargs := make([]Sexp, len(args))
+	for i, a := range args {
+		sargs[i], err = env.FromGoValue(reflect.ValueOf(a))
+		if err != nil {
+			return SexpNull, fmt.Errorf("argument %d of %s: %s", i, name, err)
+		}
+	}
+	return env.applyAndRestore(fun, sargs)
+}
+
+// applyAndRestore is Apply, but afterwards puts back pc, curfunc
+// and the stacks, which Apply leaves pointing past the call.
+func (env *Zlisp) applyAndRestore(fun *SexpFunction, args []Sexp) (Sexp, error) {
+	pc, curfunc := env.pc, env.curfunc
+	ds, as, ls := env.datastack.Size(), env.addrstack.Size(), env.linearstack.Size()
+	defer func() {
+		env.pc, env.curfunc = pc, curfunc
+		env.datastack.TruncateToSize(ds)
+		env.addrstack.TruncateToSize(as)
+		env.linearstack.TruncateToSize(ls)
+	}()
+	return env.Apply(fun, args)
+}
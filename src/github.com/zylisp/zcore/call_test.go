@@ -0,0 +1,55 @@
+package zcore
+
+import (
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test451CallScriptFunctionsFromGo(t *testing.T) {
+
+	cv.Convey(`Given script functions, including one inside a package, env.Call and CallAs should call them by name with Go arguments, decode the result, and leave the env ready for further evaluation`, t, func() {
+
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		_, err := env.EvalString(`
+(defn add [a b] (+ a b))
+(defn greet [who] (concat "hi " who))
+(defn mkHornet [name] (hornet Nickname:name Mass:2.5))
+(defn boom [] (error "boom"))
+(def pk (package "pk" { (defn Twice [x] (* 2 x)) }))
+`)
+		cv.So(err, cv.ShouldBeNil)
+
+		res, err := env.Call("add", 2, 3)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res, cv.ShouldEqual, int64(5))
+
+		s, err := CallAs[string](env, "greet", "bob")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(s, cv.ShouldEqual, "hi bob")
+
+		n, err := CallAs[int](env, "pk.Twice", 21)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(n, cv.ShouldEqual, 42)
+
+		h, err := CallAs[*Hornet](env, "mkHornet", "zip")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(h.Nickname, cv.ShouldEqual, "zip")
+		cv.So(h.Mass, cv.ShouldEqual, 2.5)
+
+		_, err = env.Call("boom")
+		cv.So(err, cv.ShouldNotBeNil)
+		_, err = env.Call("nosuchfunc")
+		cv.So(err, cv.ShouldNotBeNil)
+		_, err = CallAs[int](env, "greet", "bob")
+		cv.So(err, cv.ShouldNotBeNil)
+
+		// the env is still usable afterwards.
+		r, err := env.EvalString(`(add 1 1)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(r, cv.ShouldResemble, &SexpInt{Val: 2})
+	})
+}
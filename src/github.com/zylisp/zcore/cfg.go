@@ -2,12 +2,16 @@ package zcore
 
 import (
 	"flag"
+	"os"
 )
 
 // configure a glisp repl
 type ZlispConfig struct {
 	CpuProfile          string
 	MemProfile          string
+	ScriptProfile       string
+	CoverProfile        string
+	CoverHTML           string
 	ExitOnFailure       bool
 	CountFuncCalls      bool
 	Flags               *flag.FlagSet
@@ -18,6 +22,13 @@ type ZlispConfig struct {
 	Trace               bool
 	LoadDemoStructs     bool
 	AfterScriptDontExit bool
+	RePanic             bool
+	ModulePath          string
+	CacheBytecode       bool
+	NoOptimize          bool
+	MaxRecursionDepth   int
+	MaxDataStackDepth   int
+	MaxScopeDepth       int
 
 	// liner bombs under emacs, avoid it with this flag.
 	NoLiner bool
@@ -35,6 +46,9 @@ func NewZlispConfig(cmdname string) *ZlispConfig {
 func (c *ZlispConfig) DefineFlags() {
 	c.Flags.StringVar(&c.CpuProfile, "cpuprofile", "", "write cpu profile to file")
 	c.Flags.StringVar(&c.MemProfile, "memprofile", "", "write mem profile to file")
+	c.Flags.StringVar(&c.CoverProfile, "coverprofile", "", "record which parts of the scripts run; print a summary, and write a go tool cover style profile to file")
+	c.Flags.StringVar(&c.CoverHTML, "coverhtml", "", "record which parts of the scripts run; print a summary, and write them as HTML to file")
+	c.Flags.StringVar(&c.ScriptProfile, "scriptprofile", "", "write a profile of the script's own functions and lines to file, for go tool pprof")
 	c.Flags.BoolVar(&c.ExitOnFailure, "exitonfail", false, "exit on failure instead of starting repl")
 	c.Flags.BoolVar(&c.CountFuncCalls, "countcalls", false, "count how many times each function is run")
 	c.Flags.StringVar(&c.Command, "c", "", "expressions to evaluate")
@@ -43,6 +57,13 @@ func (c *ZlispConfig) DefineFlags() {
 	c.Flags.BoolVar(&c.Quiet, "quiet", false, "start repl without printing the version/mode/help banner")
 	c.Flags.BoolVar(&c.Trace, "trace", false, "trace execution (warning: very verbose and slow)")
 	c.Flags.BoolVar(&c.LoadDemoStructs, "demo", false, "load the demo structs: Event, Snoopy, Hornet, Weather and friends.")
+	c.Flags.BoolVar(&c.RePanic, "repanic", false, "let Go panics in builtins crash with their stack, instead of becoming script errors (for debugging)")
+	c.Flags.BoolVar(&c.NoOptimize, "noopt", false, "run the code as generated, without folding constants, threading jumps or removing dead code (for debugging)")
+	c.Flags.IntVar(&c.MaxRecursionDepth, "maxdepth", DefaultMaxRecursionDepth, "how deeply calls may nest before they fail with a maximum recursion depth error; negative for no limit")
+	c.Flags.IntVar(&c.MaxDataStackDepth, "maxdatastack", 0, "how deep the data stack may grow before the script fails with a budget error; 0 for no limit")
+	c.Flags.IntVar(&c.MaxScopeDepth, "maxscopes", 0, "how deep the scope stack may grow before the script fails with a budget error; 0 for no limit")
+	c.Flags.BoolVar(&c.CacheBytecode, "zyc", false, "keep the code compiled for sourced and imported scripts in .zyc files beside them, and reuse it while they are unchanged")
+	c.Flags.StringVar(&c.ModulePath, "modpath", os.Getenv(ModulePathEnvVar), "directories, separated as in PATH, for import to find modules by name in")
 }
 
 // ValidateConfig: call c.ValidateConfig() after myflags.Parse()
@@ -10,7 +10,7 @@ func (p *SexpComment) SexpString(ps *PrintState) string {
 }
 
 func (p *SexpComment) Type() *RegisteredType {
-	return GoStructRegistry.Registry["comment"]
+	return GoStructRegistry.Lookup("comment")
 }
 
 // Filters return true to keep, false to drop.
@@ -50,7 +50,7 @@ func RemoveCommasFilter(x Sexp) bool {
 func (env *Zlisp) FilterAny(x Sexp, f Filter) (filtered Sexp, keep bool) {
 	switch ele := x.(type) {
 	case *SexpArray:
-		res := &SexpArray{Val: env.FilterArray(ele.Val, f), Typ: ele.Typ, IsFuncDeclTypeArray: ele.IsFuncDeclTypeArray, Env: env}
+		res := &SexpArray{Val: env.FilterArray(ele.Val, f), Typ: ele.Typ, IsFuncDeclTypeArray: ele.IsFuncDeclTypeArray, Env: env, pos: ele.pos}
 		return res, true
 	case *SexpPair:
 		return env.FilterList(ele, f), true
@@ -101,5 +101,7 @@ func (env *Zlisp) FilterList(h *SexpPair, f Filter) Sexp {
 		return h
 	}
 	res = env.FilterArray(arr, f)
-	return MakeList(res)
+	lst := MakeList(res)
+	setPos(lst, h.pos)
+	return lst
 }
@@ -0,0 +1,98 @@
+package zcore
+
+import (
+	"context"
+	"fmt"
+)
+
+var ErrCanceled error = fmt.Errorf("evaluation canceled")
+
+var ErrDeadlineExceeded error = fmt.Errorf("evaluation deadline exceeded")
+
+// RunContext is like Run, but stops executing instructions
+// once ctx is done, returning ErrCanceled or ErrDeadlineExceeded.
+// After an interruption the env is reset with Clear(), so
+// it remains usable for further evaluation.
+func (env *Zlisp) RunContext(ctx context.Context) (Sexp, error) {
+	prev := env.ctx
+	env.ctx = ctx
+	defer func() {
+		env.ctx = prev
+	}()
+
+	res, err := env.Run()
+	if err != nil && prev == nil {
+		// builtins may have wrapped our error, so ask ctx directly.
+		if cerr := contextErr(ctx.Err()); cerr != nil {
+			env.Clear()
+			return SexpNull, cerr
+		}
+	}
+	return res, err
+}
+
+// EvalStringContext: EvalString, but cancelable via ctx, also
+// while str is compiled and its macros expanded.
+func (env *Zlisp) EvalStringContext(ctx context.Context, str string) (Sexp, error) {
+	prev := env.ctx
+	env.ctx = ctx
+	err := env.LoadString(str)
+	env.ctx = prev
+	if err != nil {
+		if cerr := contextErr(ctx.Err()); cerr != nil && prev == nil {
+			env.Clear()
+			return SexpNull, cerr
+		}
+		return SexpNull, err
+	}
+	return env.RunContext(ctx)
+}
+
+// ApplyContext: Apply, but cancelable via ctx. As with Apply,
+// builtin (Go) functions are called directly and so are only
+// checked for cancellation before the call.
+func (env *Zlisp) ApplyContext(ctx context.Context, fun *SexpFunction, args []Sexp) (Sexp, error) {
+	if err := contextErr(ctx.Err()); err != nil {
+		return SexpNull, err
+	}
+	if fun.user {
+		return env.callGuarded(fun, fun.name, args)
+	}
+
+	env.pc = -2
+	for _, expr := range args {
+		env.datastack.PushExpr(expr)
+	}
+
+	err := env.CallFunction(fun, len(args))
+	if err != nil {
+		return SexpNull, err
+	}
+
+	return env.RunContext(ctx)
+}
+
+// checkDone is consulted by Run before each instruction.
+func (env *Zlisp) checkDone() error {
+	if env.ctx == nil {
+		return nil
+	}
+	select {
+	case <-env.ctx.Done():
+		return contextErr(env.ctx.Err())
+	default:
+		return nil
+	}
+}
+
+// contextErr translates context errors into our own.
+func contextErr(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return ErrDeadlineExceeded
+	default:
+		return ErrCanceled
+	}
+}
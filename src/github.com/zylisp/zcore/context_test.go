@@ -0,0 +1,53 @@
+package zcore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test410RunContextStopsRunawayScripts(t *testing.T) {
+
+	cv.Convey(`Given an infinite loop, EvalStringContext should return ErrDeadlineExceeded or ErrCanceled once the context is done, also while a macro is expanded, and leave the env usable`, t, func() {
+
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := env.EvalStringContext(ctx, `(for [(def i 0) true (set i (+ i 1))] i)`)
+		cv.So(err, cv.ShouldEqual, ErrDeadlineExceeded)
+
+		ctx2, cancel2 := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			cancel2()
+		}()
+		_, err = env.EvalStringContext(ctx2, `(defn spin [] (spin)) (spin)`)
+		cv.So(err, cv.ShouldEqual, ErrCanceled)
+
+		res, err := env.EvalString(`(+ 1 2)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res, cv.ShouldResemble, &SexpInt{Val: 3})
+
+		// as should a macro that never finishes expanding.
+		ctx3, cancel3 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel3()
+		start := time.Now()
+		_, err = env.EvalStringContext(ctx3, `(defmac m [] (for [(def i 0) true (set i (+ i 1))] 1)) (m)`)
+		cv.So(err, cv.ShouldEqual, ErrDeadlineExceeded)
+		cv.So(time.Since(start), cv.ShouldBeLessThan, 2*time.Second)
+
+		res, err = env.EvalString(`(+ 1 2)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res, cv.ShouldResemble, &SexpInt{Val: 3})
+
+		f, found := env.FindObject("spin")
+		cv.So(found, cv.ShouldBeTrue)
+		_, err = env.ApplyContext(ctx2, f.(*SexpFunction), []Sexp{})
+		cv.So(err, cv.ShouldEqual, ErrCanceled)
+	})
+}
@@ -88,6 +88,7 @@ func CoreFunctions() map[string]ZlispUserFunction {
 		"sll":         BinaryIntFunction,
 		"sra":         BinaryIntFunction,
 		"srl":         BinaryIntFunction,
+		"stacktrace":  StackTraceFunction,
 		"stop":        StopFunction,
 		"str":         StringifyFunction,
 		"string?":     TypeQueryFunction,
@@ -175,10 +176,6 @@ func DotFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	if len(args) != 2 {
 		return SexpNull, WrongNargs
 	}
-	P("in DotFunction(), name='%v', args[0] = '%v', args[1]= '%v'",
-		name,
-		args[0].SexpString(nil),
-		args[1].SexpString(nil))
 	return SexpNull, nil
 	/*
 		var ret Sexp = SexpNull
@@ -243,6 +240,11 @@ func NumericFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 		op = Pow
 	}
 
+	if len(args) > 1 {
+		if res, ok := numericAccum(op, args); ok {
+			return res, nil
+		}
+	}
 	for _, expr := range args[1:] {
 		accum, err = NumericDo(op, accum, expr)
 		if err != nil {
@@ -571,9 +573,17 @@ func ConcatFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 
 	switch t := args[0].(type) {
 	case *SexpArray:
-		return ConcatArray(t, args[1:])
+		res, err := ConcatArray(t, args[1:])
+		if err == nil {
+			err = env.chargeAlloc(len(res.(*SexpArray).Val))
+		}
+		return res, err
 	case *SexpStr:
-		return ConcatStr(t, args[1:])
+		res, err := ConcatStr(t, args[1:])
+		if err == nil {
+			err = env.chargeAlloc(len(res.S))
+		}
+		return res, err
 	case *SexpPair:
 		n := len(args)
 		switch {
@@ -612,7 +622,7 @@ func TypeQueryFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 
 	switch name {
 	case "type?":
-		return TypeOf(args[0]), nil
+		return TypeOfErr(args[0])
 	case "list?":
 		result = IsList(args[0])
 	case "null?":
@@ -729,6 +739,9 @@ func MakeArrayFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 		fill = SexpNull
 	}
 
+	if err := env.chargeAlloc(size); err != nil {
+		return SexpNull, err
+	}
 	arr := make([]Sexp, size)
 	for i := range arr {
 		arr[i] = fill
@@ -740,6 +753,9 @@ func MakeArrayFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 func ConstructorFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	switch name {
 	case "array":
+		if err := env.chargeAlloc(len(args)); err != nil {
+			return SexpNull, err
+		}
 		return env.NewSexpArray(args), nil
 	case "list":
 		return MakeList(args), nil
@@ -1006,7 +1022,11 @@ func AsUint64Function(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	case *SexpFloat:
 		val = uint64(x.Val)
 	default:
-		return SexpNull, fmt.Errorf("Cannot convert %s to uint64", TypeOf(args[0]).SexpString(nil))
+		typ, err := TypeOfErr(args[0])
+		if err != nil {
+			return SexpNull, err
+		}
+		return SexpNull, fmt.Errorf("Cannot convert %s to uint64", typ.SexpString(nil))
 
 	}
 	return &SexpUint64{Val: val}, nil
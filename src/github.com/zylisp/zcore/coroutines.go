@@ -19,7 +19,19 @@ func StartGoroutineFunction(env *Zlisp, name string,
 	args []Sexp) (Sexp, error) {
 	switch t := args[0].(type) {
 	case *SexpGoroutine:
-		go t.env.Run()
+		// a fresh env for each start, as the same (go ...) may run
+		// many times in a loop. It shares the symbol table, macros and
+		// global scope with its parent; those are synchronized. It gets
+		// its own Parser, which is not safe for concurrent use.
+		goenv := t.env.Duplicate()
+		goenv.Parser = goenv.NewParser()
+		goenv.Parser.Start()
+		goenv.mainfunc = t.env.mainfunc
+		goenv.curfunc = goenv.mainfunc
+		go func() {
+			defer goenv.Stop()
+			goenv.Run()
+		}()
 	default:
 		return SexpNull, errors.New("not a goroutine")
 	}
@@ -0,0 +1,55 @@
+package zcore
+
+import (
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test440ManyConcurrentGoBlocksAreRaceFree(t *testing.T) {
+
+	cv.Convey(`Given many (go ...) blocks that intern new symbols, define and set globals, create new record types, and define macros while the parent does the same, running under -race should report no data races, and symbols should agree across goroutines`, t, func() {
+
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		res, err := env.EvalString(`
+(def n 50)
+(def ch (makeChan n))
+(def shared 0)
+(for [(def i 0) (< i n) (set i (+ i 1))]
+  (go
+    (def mine (str2sym (sprintf "goro_%v" (gensym))))
+    (def shared (+ 1 0))
+    (set shared 2)
+    (defmap ranch)
+    (def rec (ranch cowboy:1))
+    (struct Pt [(field x:int64)])
+    (def pt (Pt x:1))
+    (defmac twice [x] ^(+ ~x ~x))
+    (send ch [(twice 1) %fromgoro (:cowboy rec) (:x pt)])))
+
+// keep the parent busy interning and defining while they run.
+(for [(def j 0) (< j 200) (set j (+ j 1))]
+  (def parentsym (str2sym (sprintf "parent_%v" j))))
+
+(def got 0)
+(for [(def k 0) (< k n) (set k (+ k 1))]
+  (def msg (<! ch))
+  (assert (== (aget msg 0) 2))
+  (assert (== (aget msg 1) %fromgoro))
+  (assert (== (aget msg 2) 1))
+  (assert (== (aget msg 3) 1))
+  (set got (+ got 1)))
+got
+`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res, cv.ShouldResemble, &SexpInt{Val: 50})
+
+		// interning is consistent: the same name gives the same number.
+		a := env.MakeSymbol("fromgoro")
+		b := env.Duplicate().MakeSymbol("fromgoro")
+		cv.So(a.number, cv.ShouldEqual, b.number)
+	})
+}
@@ -0,0 +1,323 @@
+package zcore
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Coverage records which parts of the scripts an env runs. Each
+// list or symbol that generates code is a block, from where it
+// starts to where the next block starts, or the end of the line;
+// so branches of cond and bodies of for that are not taken are
+// blocks that never ran. Literals have no position of their own,
+// and count with the form around them. Attach a Coverage with
+// SetCoverage before loading the scripts to be covered: code
+// compiled before then is left out.
+type Coverage struct {
+	mu     sync.Mutex
+	blocks map[covKey]*covBlock
+	byPos  map[*SrcPos]*covBlock
+}
+
+type covKey struct {
+	file      string
+	line, col int
+}
+
+type covBlock struct {
+	pos   *SrcPos
+	count int64
+}
+
+// NewCoverage returns an empty Coverage.
+func NewCoverage() *Coverage {
+	return &Coverage{
+		blocks: make(map[covKey]*covBlock),
+		byPos:  make(map[*SrcPos]*covBlock),
+	}
+}
+
+// SetCoverage has env record coverage in c; nil stops it.
+// Clones and Duplicates, and so sourced files, share it.
+func (env *Zlisp) SetCoverage(c *Coverage) {
+	env.coverage = c
+}
+
+// Coverage returns the Coverage env records in, if any.
+func (env *Zlisp) Coverage() *Coverage {
+	return env.coverage
+}
+
+// block finds or makes the block at pos. Call with c.mu held.
+func (c *Coverage) block(pos *SrcPos) *covBlock {
+	if b, ok := c.byPos[pos]; ok {
+		return b
+	}
+	k := covKey{file: pos.File, line: pos.Line, col: pos.Col}
+	b := c.blocks[k]
+	if b == nil {
+		b = &covBlock{pos: pos}
+		c.blocks[k] = b
+	}
+	c.byPos[pos] = b
+	return b
+}
+
+// add notes the blocks of newly compiled code.
+func (c *Coverage) add(srcmap []*SrcPos) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, pos := range srcmap {
+		if pos != nil && pos.File != "" {
+			c.block(pos)
+		}
+	}
+}
+
+// hit counts a run of the instruction at pos.
+func (c *Coverage) hit(pos *SrcPos) {
+	if pos == nil || pos.File == "" {
+		return
+	}
+	c.mu.Lock()
+	c.block(pos).count++
+	c.mu.Unlock()
+}
+
+// covRange is a block as a range of a line, with 1-based byte
+// columns, end exclusive.
+type covRange struct {
+	line, start, end int
+	count            int64
+}
+
+// ranges returns the files covered, and the ranges of each in order.
+func (c *Coverage) ranges() ([]string, map[string][]covRange) {
+	c.mu.Lock()
+	blocks := make([]*covBlock, 0, len(c.blocks))
+	counts := make([]int64, 0, len(c.blocks))
+	for _, b := range c.blocks {
+		blocks = append(blocks, b)
+		counts = append(counts, b.count)
+	}
+	c.mu.Unlock()
+
+	byFile := map[string][]int{}
+	for i, b := range blocks {
+		byFile[b.pos.File] = append(byFile[b.pos.File], i)
+	}
+	files := make([]string, 0, len(byFile))
+	res := make(map[string][]covRange, len(byFile))
+	for file, idx := range byFile {
+		files = append(files, file)
+		sort.Slice(idx, func(i, j int) bool {
+			a, b := blocks[idx[i]].pos, blocks[idx[j]].pos
+			return a.Line < b.Line || a.Line == b.Line && a.Col < b.Col
+		})
+		rs := make([]covRange, len(idx))
+		for i, bi := range idx {
+			pos := blocks[bi].pos
+			text := pos.Source()
+			r := covRange{line: pos.Line, start: byteCol(text, pos.Col), count: counts[bi]}
+			r.end = len(text) + 1
+			if i+1 < len(idx) {
+				if next := blocks[idx[i+1]].pos; next.Line == pos.Line {
+					r.end = byteCol(text, next.Col)
+				}
+			}
+			if r.end <= r.start {
+				r.end = r.start + 1
+			}
+			rs[i] = r
+		}
+		res[file] = rs
+	}
+	sort.Strings(files)
+	return files, res
+}
+
+// byteCol converts a 1-based rune column in line to a byte one.
+func byteCol(line string, col int) int {
+	b := 0
+	for i := 1; i < col; i++ {
+		if b < len(line) {
+			_, size := utf8.DecodeRuneInString(line[b:])
+			b += size
+		} else {
+			b++
+		}
+	}
+	return b + 1
+}
+
+// FileCoverage is the summary for one file.
+type FileCoverage struct {
+	File    string
+	Blocks  int   // how many blocks it has
+	Covered int   // how many of them ran
+	NotRun  []int // the lines with a block that did not run
+}
+
+// Percent is the share of the blocks that ran.
+func (f FileCoverage) Percent() float64 {
+	if f.Blocks == 0 {
+		return 100
+	}
+	return 100 * float64(f.Covered) / float64(f.Blocks)
+}
+
+// Summary returns the coverage of each file.
+func (c *Coverage) Summary() []FileCoverage {
+	return summarize(c.ranges())
+}
+
+func summarize(files []string, ranges map[string][]covRange) []FileCoverage {
+	res := make([]FileCoverage, len(files))
+	for i, file := range files {
+		fc := FileCoverage{File: file, Blocks: len(ranges[file])}
+		for _, r := range ranges[file] {
+			switch {
+			case r.count > 0:
+				fc.Covered++
+			case len(fc.NotRun) == 0 || fc.NotRun[len(fc.NotRun)-1] != r.line:
+				fc.NotRun = append(fc.NotRun, r.line)
+			}
+		}
+		res[i] = fc
+	}
+	return res
+}
+
+// WriteSummary writes the Summary as text, a line per file and
+// a total.
+func (c *Coverage) WriteSummary(w io.Writer) error {
+	var total FileCoverage
+	for _, f := range c.Summary() {
+		total.Blocks += f.Blocks
+		total.Covered += f.Covered
+		_, err := fmt.Fprintf(w, "%s: %.1f%% of %d blocks", f.File, f.Percent(), f.Blocks)
+		if err != nil {
+			return err
+		}
+		if len(f.NotRun) > 0 {
+			fmt.Fprintf(w, "; not run on lines %s", lineRanges(f.NotRun))
+		}
+		fmt.Fprintln(w)
+	}
+	_, err := fmt.Fprintf(w, "total: %.1f%% of %d blocks\n", total.Percent(), total.Blocks)
+	return err
+}
+
+// lineRanges renders sorted line numbers as e.g. "3, 7-9".
+func lineRanges(lines []int) string {
+	var parts []string
+	for i := 0; i < len(lines); {
+		j := i
+		for j+1 < len(lines) && lines[j+1] == lines[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, fmt.Sprint(lines[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", lines[i], lines[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ", ")
+}
+
+// WriteProfile writes the blocks in the format of go test
+// -coverprofile, in count mode, for go tool cover -func and
+// other tools that read it.
+func (c *Coverage) WriteProfile(w io.Writer) error {
+	if _, err := fmt.Fprintln(w, "mode: count"); err != nil {
+		return err
+	}
+	files, ranges := c.ranges()
+	for _, file := range files {
+		for _, r := range ranges[file] {
+			_, err := fmt.Fprintf(w, "%s:%d.%d,%d.%d 1 %d\n",
+				file, r.line, r.start, r.line, r.end, r.count)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteHTML writes a page showing each file, read from fsys
+// (OSFS if nil), with the blocks that ran in green and those
+// that did not in red.
+func (c *Coverage) WriteHTML(w io.Writer, fsys fs.FS) error {
+	if fsys == nil {
+		fsys = OSFS()
+	}
+	files, ranges := c.ranges()
+	summary := summarize(files, ranges)
+
+	var b strings.Builder
+	b.WriteString(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>zylisp coverage</title>
+<style>
+body { font-family: sans-serif; }
+pre { background: #fafafa; padding: 0.5em; }
+.cov { background: #c8f0c8; }
+.nocov { background: #f8c8c8; }
+.ln { color: #999; }
+</style></head><body>
+`)
+	for i, file := range files {
+		fmt.Fprintf(&b, "<h2 id=\"f%d\">%s: %.1f%%</h2>\n<pre>", i,
+			html.EscapeString(file), summary[i].Percent())
+		src, err := fs.ReadFile(fsys, fsPath(fsys, file))
+		if err != nil {
+			fmt.Fprintf(&b, "%s</pre>\n", html.EscapeString(err.Error()))
+			continue
+		}
+		rs := ranges[file]
+		for n, line := range strings.Split(string(src), "\n") {
+			fmt.Fprintf(&b, "<span class=\"ln\">%4d</span>  ", n+1)
+			// at is the byte offset in line written up to.
+			at := 0
+			for ; len(rs) > 0 && rs[0].line <= n+1; rs = rs[1:] {
+				r := rs[0]
+				if r.line < n+1 {
+					continue
+				}
+				start := clampCol(r.start-1, at, len(line))
+				end := clampCol(r.end-1, start, len(line))
+				class := "cov"
+				if r.count == 0 {
+					class = "nocov"
+				}
+				fmt.Fprintf(&b, "%s<span class=\"%s\" title=\"%d\">%s</span>",
+					html.EscapeString(line[at:start]), class, r.count,
+					html.EscapeString(line[start:end]))
+				at = end
+			}
+			b.WriteString(html.EscapeString(line[at:]))
+			b.WriteString("\n")
+		}
+		b.WriteString("</pre>\n")
+	}
+	b.WriteString("</body></html>\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func clampCol(x, lo, hi int) int {
+	if x < lo {
+		x = lo
+	}
+	if x > hi {
+		x = hi
+	}
+	return x
+}
@@ -0,0 +1,59 @@
+package zcore
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test550CoverageCountsBlocksRun(t *testing.T) {
+
+	cv.Convey(`Given coverage on, a sourced script's branches not taken should be reported not run, in the summary, the cover profile and the HTML`, t, func() {
+
+		env := NewZlisp()
+		defer env.Stop()
+		cv.So(env.StandardSetup(), cv.ShouldBeNil)
+
+		files := fstest.MapFS{
+			"lib/rules.zy": {Data: []byte("(defn sign [n]\n  (cond (< n 0) (str \"neg\")\n    (str \"pos\")))\n(def s (sign 3))\n")},
+		}
+		env.SetFS(files)
+		cov := NewCoverage()
+		env.SetCoverage(cov)
+		cv.So(env.Coverage(), cv.ShouldEqual, cov)
+
+		_, err := env.EvalString(`(source "lib/rules.zy")`)
+		cv.So(err, cv.ShouldBeNil)
+
+		sum := cov.Summary()
+		cv.So(len(sum), cv.ShouldEqual, 1)
+		cv.So(sum[0].File, cv.ShouldEqual, "lib/rules.zy")
+		cv.So(sum[0].Covered, cv.ShouldBeLessThan, sum[0].Blocks)
+		cv.So(sum[0].NotRun, cv.ShouldResemble, []int{2})
+
+		var text bytes.Buffer
+		cv.So(cov.WriteSummary(&text), cv.ShouldBeNil)
+		cv.So(text.String(), cv.ShouldContainSubstring, "not run on lines 2")
+
+		var prof bytes.Buffer
+		cv.So(cov.WriteProfile(&prof), cv.ShouldBeNil)
+		lines := strings.Split(strings.TrimSpace(prof.String()), "\n")
+		cv.So(lines[0], cv.ShouldEqual, "mode: count")
+		zero := 0
+		for _, l := range lines[1:] {
+			cv.So(l, cv.ShouldStartWith, "lib/rules.zy:")
+			if strings.HasPrefix(l, "lib/rules.zy:2.") && strings.HasSuffix(l, " 1 0") {
+				zero++
+			}
+		}
+		cv.So(zero, cv.ShouldBeGreaterThan, 0)
+
+		var page bytes.Buffer
+		cv.So(cov.WriteHTML(&page, files), cv.ShouldBeNil)
+		cv.So(page.String(), cv.ShouldContainSubstring, `class="nocov"`)
+		cv.So(page.String(), cv.ShouldContainSubstring, `class="cov"`)
+	})
+}
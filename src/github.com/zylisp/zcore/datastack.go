@@ -3,6 +3,8 @@ package zcore
 import (
 	"errors"
 	"fmt"
+	"io"
+	"os"
 )
 
 type DataStackElem struct {
@@ -12,6 +14,12 @@ type DataStackElem struct {
 func (d DataStackElem) IsStackElem() {}
 
 func (stack *Stack) PushExpr(expr Sexp) {
+	if x, ok := expr.(*SexpInt); ok {
+		if elem, shared := sharedIntElem(x); shared {
+			stack.Push(elem)
+			return
+		}
+	}
 	stack.Push(DataStackElem{expr})
 }
 
@@ -61,9 +69,13 @@ func (stack *Stack) GetExpr(n int) (Sexp, error) {
 }
 
 func (stack *Stack) PrintStack() {
+	var w io.Writer = os.Stdout
+	if stack.env != nil {
+		w = stack.env.Stdout
+	}
 	for i := 0; i <= stack.tos; i++ {
 		expr := stack.elements[i].(DataStackElem).expr
-		fmt.Println("\t" + expr.SexpString(nil))
+		fmt.Fprintln(w, "\t"+expr.SexpString(nil))
 	}
 }
 
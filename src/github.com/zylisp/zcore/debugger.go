@@ -0,0 +1,240 @@
+package zcore
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// StepMode says how a paused Debugger goes on.
+type StepMode int
+
+const (
+	// Continue runs to the next breakpoint.
+	Continue StepMode = iota
+
+	// Step stops at the next source line, in the paused
+	// function or in any function it calls.
+	Step
+
+	// Next stops at the next source line in the paused
+	// function, or in its caller once it returns.
+	Next
+
+	// Abort stops the run with ErrDebugAbort.
+	Abort
+)
+
+// ErrDebugAbort ends a run that the debugger was told to abort.
+// try does not catch it.
+var ErrDebugAbort = errors.New("aborted in the debugger")
+
+// Breakpoint is a place for a Debugger to stop: on entering the
+// function Func, or at File:Line.
+type Breakpoint struct {
+	Func string
+	File string
+	Line int
+}
+
+func (b Breakpoint) String() string {
+	if b.Func != "" {
+		return b.Func
+	}
+	return fmt.Sprintf("%s:%d", b.File, b.Line)
+}
+
+// ParseBreakpoint reads "fn" or "file:line".
+func ParseBreakpoint(spec string) (Breakpoint, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return Breakpoint{}, fmt.Errorf("empty breakpoint")
+	}
+	if i := strings.LastIndex(spec, ":"); i > 0 {
+		if line, err := strconv.Atoi(spec[i+1:]); err == nil {
+			if line < 1 {
+				return Breakpoint{}, fmt.Errorf("bad line number in breakpoint '%s'", spec)
+			}
+			return Breakpoint{File: spec[:i], Line: line}, nil
+		}
+	}
+	return Breakpoint{Func: spec}, nil
+}
+
+// matches says if the line at pos is at the breakpoint. File
+// names match on their last elements, so "a.zy" matches "lib/a.zy".
+func (b Breakpoint) matches(pos *SrcPos) bool {
+	if b.Func != "" || pos.Line != b.Line {
+		return false
+	}
+	return pos.File == b.File ||
+		strings.HasSuffix(filepath.ToSlash(pos.File), "/"+strings.TrimPrefix(filepath.ToSlash(b.File), "./"))
+}
+
+// Debugger pauses an env at instruction boundaries, on its
+// breakpoints or as it steps, and calls OnPause. Attach one
+// with SetDebugger.
+type Debugger struct {
+	// OnPause is called, on the interpreter's goroutine, each
+	// time the run pauses, with why. It may look at env with
+	// Frames, FrameScopes and EvalInFrame, but not run env
+	// itself; it returns how to go on.
+	OnPause func(env *Zlisp, pos *SrcPos, why string) StepMode
+
+	mu     sync.Mutex
+	breaks []Breakpoint
+	mode   StepMode
+
+	// where it last paused, or passed a line, to tell when a
+	// new one is reached.
+	lastFun   *SexpFunction
+	lastLine  int
+	lastDepth int
+	depth     int // for Next, the depth it was given at
+
+	// a function with a breakpoint just entered, to stop at
+	// its first line.
+	entered      string
+	enteredDepth int
+}
+
+// SetDebugger attaches d to env; nil detaches it. Unlike a
+// Tracer, a Debugger is not shared with Clones and Duplicates.
+func (env *Zlisp) SetDebugger(d *Debugger) {
+	env.debugger = d
+}
+
+// Debugger returns the Debugger attached to env, if any.
+func (env *Zlisp) Debugger() *Debugger {
+	return env.debugger
+}
+
+// AddBreakpoint adds b, if d does not already have it.
+func (d *Debugger) AddBreakpoint(b Breakpoint) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, have := range d.breaks {
+		if have == b {
+			return
+		}
+	}
+	d.breaks = append(d.breaks, b)
+}
+
+// ClearBreakpoints removes all the breakpoints.
+func (d *Debugger) ClearBreakpoints() {
+	d.mu.Lock()
+	d.breaks = nil
+	d.mu.Unlock()
+}
+
+// Breakpoints returns the breakpoints set.
+func (d *Debugger) Breakpoints() []Breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Breakpoint{}, d.breaks...)
+}
+
+// SetMode sets how the next run goes, as if d had just paused.
+// Step, say, stops at the first line of the next expression.
+func (d *Debugger) SetMode(mode StepMode) {
+	d.mu.Lock()
+	d.mode = mode
+	d.depth = 1 << 30
+	d.mu.Unlock()
+}
+
+// check is called before each instruction runs.
+func (d *Debugger) check(env *Zlisp) error {
+	fun, pc := env.curfunc, env.pc
+	pos := fun.SrcPos(pc)
+	depth := env.addrstack.Size()
+
+	d.mu.Lock()
+	newLine := pos != nil &&
+		(fun != d.lastFun || pos.Line != d.lastLine || depth != d.lastDepth)
+	if newLine {
+		d.lastFun, d.lastLine, d.lastDepth = fun, pos.Line, depth
+	}
+
+	why := ""
+	if pc == 0 {
+		for _, b := range d.breaks {
+			if b.Func == fun.name {
+				d.entered, d.enteredDepth = b.Func, depth
+			}
+		}
+	}
+	if newLine {
+		switch {
+		case d.entered != "" && depth == d.enteredDepth:
+			why = "breakpoint " + d.entered
+			d.entered = ""
+		case d.mode == Step:
+			why = "step"
+		case d.mode == Next && depth <= d.depth:
+			why = "next"
+		}
+		for _, b := range d.breaks {
+			if why == "" && b.matches(pos) {
+				why = "breakpoint " + b.String()
+			}
+		}
+	}
+	d.mu.Unlock()
+	if why == "" || d.OnPause == nil {
+		return nil
+	}
+
+	mode := d.OnPause(env, pos, why)
+	d.mu.Lock()
+	d.mode, d.depth = mode, depth
+	d.mu.Unlock()
+	if mode == Abort {
+		return ErrDebugAbort
+	}
+	return nil
+}
+
+// FrameScopes returns the scopes visible in frame n of Frames,
+// innermost first, as far as the scope of the function running
+// in it. The global scope is left out.
+func (env *Zlisp) FrameScopes(n int) ([]*Scope, error) {
+	frames := env.Frames()
+	if n < 0 || n >= len(frames) {
+		return nil, fmt.Errorf("no frame %d; there are %d", n, len(frames))
+	}
+	if frames[n].Builtin {
+		return nil, nil
+	}
+	var scopes []*Scope
+	for i := frames[n].scopes - 1; i > 0; i-- {
+		sc, ok := env.linearstack.elements[i].(*Scope)
+		if !ok {
+			continue
+		}
+		scopes = append(scopes, sc)
+		if sc.IsFunction {
+			break
+		}
+	}
+	return scopes, nil
+}
+
+// EvalInFrame evaluates src as if in frame n of Frames, seeing
+// its variables. It runs on a Duplicate of env, so that a
+// paused env is left as it was, save for what src changes.
+func (env *Zlisp) EvalInFrame(n int, src string) (Sexp, error) {
+	frames := env.Frames()
+	if n < 0 || n >= len(frames) {
+		return SexpNull, fmt.Errorf("no frame %d; there are %d", n, len(frames))
+	}
+	dup := env.Duplicate()
+	for i := 1; i < frames[n].scopes; i++ {
+		dup.linearstack.Push(env.linearstack.elements[i])
+	}
+	return dup.EvalString(src)
+}
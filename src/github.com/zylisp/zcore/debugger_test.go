@@ -0,0 +1,78 @@
+package zcore
+
+import (
+	"errors"
+	"testing"
+	"testing/fstest"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test530DebuggerPausesAtBreakpointsAndSteps(t *testing.T) {
+
+	cv.Convey(`Given a Debugger with breakpoints, the run should pause at a function's first line and at a file:line, let the paused frames be inspected and evaluated in, step line by line, and abort past any try`, t, func() {
+
+		env := NewZlisp()
+		defer env.Stop()
+		cv.So(env.StandardSetup(), cv.ShouldBeNil)
+		env.SetFS(fstest.MapFS{
+			"lib/sq.zy": {Data: []byte("(defn sq [x]\n  (let [y (* x x)]\n    (+ y 0)))\n(defn f [a]\n  (sq (+ a 1)))\n")},
+		})
+		_, err := env.EvalString(`(source "lib/sq.zy")`)
+		cv.So(err, cv.ShouldBeNil)
+
+		var stops []string
+		var seen []string
+		modes := []StepMode{Step, Continue}
+		d := &Debugger{OnPause: func(env *Zlisp, pos *SrcPos, why string) StepMode {
+			stops = append(stops, why+" at "+pos.String())
+			res, err := env.EvalInFrame(0, `(+ x 0)`)
+			if err == nil {
+				seen = append(seen, "x="+res.SexpString(nil))
+			}
+			res, err = env.EvalInFrame(1, `(+ a 0)`)
+			if err == nil {
+				seen = append(seen, "a="+res.SexpString(nil))
+			}
+			scopes, err := env.FrameScopes(0)
+			if err == nil {
+				seen = append(seen, scopes[len(scopes)-1].Name[:2])
+			}
+			mode := modes[0]
+			modes = modes[1:]
+			return mode
+		}}
+		_, err = ParseBreakpoint("")
+		cv.So(err, cv.ShouldNotBeNil)
+		b, err := ParseBreakpoint("sq")
+		cv.So(err, cv.ShouldBeNil)
+		d.AddBreakpoint(b)
+		env.SetDebugger(d)
+
+		res, err := env.EvalString(`(f 2)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `9`)
+		cv.So(stops, cv.ShouldResemble, []string{
+			"breakpoint sq at lib/sq.zy:2:3",
+			"step at lib/sq.zy:3:8",
+		})
+		cv.So(seen, cv.ShouldResemble, []string{"x=3", "a=2", "sq", "x=3", "a=2", "sq"})
+
+		d.ClearBreakpoints()
+		b, err = ParseBreakpoint("sq.zy:5")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(b, cv.ShouldResemble, Breakpoint{File: "sq.zy", Line: 5})
+		d.AddBreakpoint(b)
+		stops = nil
+		modes = []StepMode{Abort}
+		_, err = env.EvalString(`(try (f 5) (catch e 0))`)
+		cv.So(errors.Is(err, ErrDebugAbort), cv.ShouldBeTrue)
+		cv.So(stops, cv.ShouldResemble, []string{"breakpoint sq.zy:5 at lib/sq.zy:5:10"})
+
+		env.Clear()
+		env.SetDebugger(nil)
+		res, err = env.EvalString(`(f 1)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `4`)
+	})
+}
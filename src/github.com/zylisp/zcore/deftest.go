@@ -0,0 +1,343 @@
+package zcore
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// TestCase is a test defined with (deftest name body...).
+type TestCase struct {
+	Name string
+	Pos  *SrcPos // where the deftest is
+
+	fun *SexpFunction
+}
+
+// testSet holds the tests an env, and its Clones and Duplicates,
+// have defined, in the order defined.
+type testSet struct {
+	mu    sync.Mutex
+	cases []*TestCase
+}
+
+func (s *testSet) add(tc *TestCase) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, have := range s.cases {
+		if have.Name == tc.Name {
+			// like defn, a later deftest replaces the earlier.
+			s.cases[i] = tc
+			return
+		}
+	}
+	s.cases = append(s.cases, tc)
+}
+
+// Tests returns the tests defined so far.
+func (env *Zlisp) Tests() []*TestCase {
+	env.tests.mu.Lock()
+	defer env.tests.mu.Unlock()
+	return append([]*TestCase{}, env.tests.cases...)
+}
+
+// RunTest runs tc, which env must have defined. A test passes
+// if its body raises no error.
+func (env *Zlisp) RunTest(tc *TestCase) error {
+	_, err := env.Apply(tc.fun, nil)
+	return err
+}
+
+// GenerateDeftest compiles (deftest name body...), which
+// defines a test, without running it; see TestRunner.
+func (gen *Generator) GenerateDeftest(args []Sexp, orig Sexp) error {
+	if len(args) < 1 {
+		return WrongNargs
+	}
+	var name string
+	switch x := args[0].(type) {
+	case *SexpSymbol:
+		name = x.name
+	case *SexpStr:
+		name = x.S
+	default:
+		return fmt.Errorf("deftest name must be a symbol or string")
+	}
+	body := args[1:]
+	if len(body) == 0 {
+		body = []Sexp{SexpNull}
+	}
+	// the space keeps the name from matching a call in the body,
+	// which would then be taken for a tail call.
+	sfun, err := buildSexpFun(gen.env, "deftest "+name, &SexpArray{Env: gen.env}, body, orig, gen.lex)
+	if err != nil {
+		return err
+	}
+	gen.AddInstruction(CreateClosureInstr{sfun})
+	gen.AddInstruction(DeftestInstr{name: name, pos: PosOf(orig)})
+	return nil
+}
+
+// DeftestInstr takes the closure of a test's body off the stack,
+// and adds the test to the env.
+type DeftestInstr struct {
+	name string
+	pos  *SrcPos
+}
+
+func (d DeftestInstr) InstrString() string {
+	return "deftest " + d.name
+}
+
+func (d DeftestInstr) Execute(env *Zlisp) error {
+	expr, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+	fun, ok := expr.(*SexpFunction)
+	if !ok {
+		return fmt.Errorf("deftest %s: body is not a function", d.name)
+	}
+	env.tests.add(&TestCase{Name: d.name, Pos: d.pos, fun: fun})
+	env.datastack.PushExpr(SexpNull)
+	env.pc++
+	return nil
+}
+
+// AssertionError is the error of an assertion that failed.
+type AssertionError struct {
+	Assertion string // assertEqual, assertError or assertMatch
+	Msg       string // the message given to the assertion, if any
+	Expected  string
+	Actual    string
+
+	// the values compared, when they are strings, to diff.
+	expectedText, actualText *string
+}
+
+func (e *AssertionError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Assertion + " failed")
+	if e.Msg != "" {
+		b.WriteString(": " + e.Msg)
+	}
+	fmt.Fprintf(&b, "\n    expected: %s\n    actual:   %s", e.Expected, e.Actual)
+	if e.expectedText != nil && e.actualText != nil &&
+		(strings.Contains(*e.expectedText, "\n") || strings.Contains(*e.actualText, "\n")) {
+		b.WriteString("\n    diff (-expected +actual):")
+		for _, line := range lineDiff(strings.Split(*e.expectedText, "\n"), strings.Split(*e.actualText, "\n")) {
+			b.WriteString("\n      " + line)
+		}
+	}
+	return b.String()
+}
+
+// lineDiff gives the lines of a and b, each marked " " if in both,
+// "-" if only in a, or "+" if only in b, by their longest common
+// subsequence.
+func lineDiff(a, b []string) []string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var res []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			res = append(res, "  "+a[i])
+			i++
+			j++
+		case j == len(b) || i < len(a) && lcs[i+1][j] >= lcs[i][j+1]:
+			res = append(res, "- "+a[i])
+			i++
+		default:
+			res = append(res, "+ "+b[j])
+			j++
+		}
+	}
+	return res
+}
+
+// TestFunctions returns the assertions for deftest bodies. They
+// are camel case, assertEqual rather than assert=, since the lexer
+// would read assert= as the symbols assert and =, and assert-match
+// as assert - match; assert itself stays the one-argument check.
+func TestFunctions() map[string]ZlispUserFunction {
+	return map[string]ZlispUserFunction{
+		"assertEqual": AssertEqualFunction,
+		"assertMatch": AssertMatchFunction,
+	}
+}
+
+// assertionMsg reads the optional message argument at i.
+func assertionMsg(name string, args []Sexp, i int) (string, error) {
+	if len(args) <= i {
+		return "", nil
+	}
+	s, ok := args[i].(*SexpStr)
+	if !ok {
+		return "", fmt.Errorf("%s: message must be a string", name)
+	}
+	return s.S, nil
+}
+
+// AssertEqualFunction is (assertEqual expected actual [msg]).
+// Values are equal if they compare so, or else are of one type
+// and print the same.
+func AssertEqualFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return SexpNull, WrongNargs
+	}
+	msg, err := assertionMsg(name, args, 2)
+	if err != nil {
+		return SexpNull, err
+	}
+	expected, actual := args[0], args[1]
+	exps, acts := expected.SexpString(nil), actual.SexpString(nil)
+	cmp, err := env.Compare(expected, actual)
+	if err == nil && cmp == 0 ||
+		err != nil && fmt.Sprintf("%T", expected) == fmt.Sprintf("%T", actual) && exps == acts {
+		return SexpNull, nil
+	}
+	ae := &AssertionError{Assertion: name, Msg: msg, Expected: exps, Actual: acts}
+	if e, ok := expected.(*SexpStr); ok {
+		if a, ok := actual.(*SexpStr); ok {
+			ae.expectedText, ae.actualText = &e.S, &a.S
+		}
+	}
+	return SexpNull, ae
+}
+
+// compileAssertPattern takes a regexp, as a string or compiled.
+func compileAssertPattern(name string, pat Sexp) (*regexp.Regexp, error) {
+	switch p := pat.(type) {
+	case *SexpStr:
+		re, err := regexp.Compile(p.S)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad pattern: %v", name, err)
+		}
+		return re, nil
+	case *SexpRegexp:
+		return (*regexp.Regexp)(p), nil
+	}
+	return nil, fmt.Errorf("%s: pattern must be a string or a regexp", name)
+}
+
+// AssertMatchFunction is (assertMatch pattern actual [msg]),
+// which needs the string actual to match the regexp pattern.
+func AssertMatchFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return SexpNull, WrongNargs
+	}
+	msg, err := assertionMsg(name, args, 2)
+	if err != nil {
+		return SexpNull, err
+	}
+	re, err := compileAssertPattern(name, args[0])
+	if err != nil {
+		return SexpNull, err
+	}
+	s, ok := args[1].(*SexpStr)
+	if ok && re.MatchString(s.S) {
+		return SexpNull, nil
+	}
+	return SexpNull, &AssertionError{Assertion: name, Msg: msg,
+		Expected: "a string matching /" + re.String() + "/", Actual: args[1].SexpString(nil)}
+}
+
+// GenerateAssertError compiles (assertError expr), which needs
+// expr to raise an error, or (assertError pattern expr), which
+// needs the error's message to match the regexp pattern too. It
+// runs as
+//
+//	(array expr)
+//
+// in a try whose catch gives the error hash, so that
+// AssertErrorInstr can tell a value from an error.
+func (gen *Generator) GenerateAssertError(args []Sexp) error {
+	if len(args) < 1 || len(args) > 2 {
+		return WrongNargs
+	}
+	expr := args[len(args)-1]
+	if len(args) == 2 {
+		if err := gen.Generate(args[0]); err != nil {
+			return err
+		}
+	}
+	env := gen.env
+	e := env.GenSymbol("__err")
+	try := MakeList([]Sexp{
+		env.MakeSymbol("try"),
+		MakeList([]Sexp{env.MakeSymbol("array"), expr}),
+		MakeList([]Sexp{env.MakeSymbol("catch"), e, e}),
+	})
+	gen.Tail = false
+	if err := gen.Generate(try); err != nil {
+		return err
+	}
+	gen.AddInstruction(AssertErrorInstr{pattern: len(args) == 2, expr: expr.SexpString(nil)})
+	return nil
+}
+
+// AssertErrorInstr checks the outcome of an assertError.
+type AssertErrorInstr struct {
+	pattern bool
+	expr    string
+}
+
+func (a AssertErrorInstr) InstrString() string {
+	return "assertError " + a.expr
+}
+
+func (a AssertErrorInstr) Execute(env *Zlisp) error {
+	res, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+	var re *regexp.Regexp
+	if a.pattern {
+		pat, err := env.datastack.PopExpr()
+		if err != nil {
+			return err
+		}
+		if re, err = compileAssertPattern("assertError", pat); err != nil {
+			return err
+		}
+	}
+
+	expected := "an error"
+	if re != nil {
+		expected += " matching /" + re.String() + "/"
+	}
+	switch r := res.(type) {
+	case *SexpArray:
+		return &AssertionError{Assertion: "assertError", Expected: expected,
+			Actual: "no error, but " + r.Val[0].SexpString(nil) + " from " + a.expr}
+	case *SexpHash:
+		msg, err := r.HashGet(env, env.MakeSymbol("msg"))
+		if err != nil {
+			return err
+		}
+		if re != nil && !re.MatchString(msg.(*SexpStr).S) {
+			return &AssertionError{Assertion: "assertError", Expected: expected,
+				Actual: msg.SexpString(nil)}
+		}
+	}
+	env.datastack.PushExpr(SexpNull)
+	env.pc++
+	return nil
+}
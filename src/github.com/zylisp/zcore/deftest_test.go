@@ -0,0 +1,124 @@
+package zcore
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test560DeftestRunnerGoesOnPastFailures(t *testing.T) {
+
+	cv.Convey(`Given test files, the runner should find them, run each deftest in a fresh env past failures, filter with -run, and report expected and actual values in human, TAP and JUnit forms`, t, func() {
+
+		files := fstest.MapFS{
+			"t/math_test.zy": {Data: []byte(`(def counter 0)
+(defn sq [x] (* x x))
+(deftest squares
+  (set counter (+ counter 1))
+  (assertEqual 1 counter)
+  (assertEqual 9 (sq 3)))
+(deftest wrong
+  (println "about to fail")
+  (assertEqual 10 (sq 3) "sq of 3"))
+(deftest errors
+  (assertError (sq "a"))
+  (assertError "undefinedFn. not found" (undefinedFn))
+  (assertMatch "^ab+$" (concat "a" "bbb")))
+(deftest noError
+  (assertError (sq 2)))
+`)},
+			"t/sub/text_test.zy": {Data: []byte("(deftest lines\n  (assertEqual \"a\\nb\\nc\" \"a\\nB\\nc\"))\n")},
+			"t/bad_test.zy":      {Data: []byte("(deftest ok (assertEqual 1 1))\n(undefinedFn)\n")},
+			"t/helper.zy":        {Data: []byte("(def h 1)\n")},
+		}
+		newEnv := func() (*Zlisp, error) {
+			env := NewZlisp()
+			env.SetFS(files)
+			return env, env.StandardSetup()
+		}
+
+		found, err := FindTestFiles(files, []string{"t"})
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(found, cv.ShouldResemble, []string{"t/bad_test.zy", "t/math_test.zy", "t/sub/text_test.zy"})
+
+		var seen []string
+		tr := &TestRunner{NewEnv: newEnv, Report: func(r TestResult) { seen = append(seen, r.Name) }}
+		results := tr.RunFiles(found)
+		cv.So(seen, cv.ShouldResemble, []string{LoadFailure, "squares", "wrong", "errors", "noError", "lines"})
+		passed, failed := TestCounts(results)
+		cv.So(passed, cv.ShouldEqual, 2)
+		cv.So(failed, cv.ShouldEqual, 4)
+
+		byName := map[string]TestResult{}
+		for _, r := range results {
+			byName[r.Name] = r
+		}
+		// each test has a fresh env, so counter starts at 0 in squares.
+		cv.So(byName["squares"].Passed(), cv.ShouldBeTrue)
+		cv.So(byName["errors"].Passed(), cv.ShouldBeTrue)
+
+		wrong := byName["wrong"]
+		var ae *AssertionError
+		cv.So(errors.As(wrong.Err, &ae), cv.ShouldBeTrue)
+		cv.So(ae.Expected, cv.ShouldEqual, "10")
+		cv.So(ae.Actual, cv.ShouldEqual, "9")
+		cv.So(wrong.Message(), cv.ShouldStartWith, "assertEqual failed: sq of 3")
+		cv.So(wrong.Pos.String(), cv.ShouldEqual, "t/math_test.zy:9:3")
+		cv.So(wrong.Output, cv.ShouldEqual, "about to fail\n")
+
+		cv.So(byName["noError"].Message(), cv.ShouldContainSubstring, "no error, but 4 from (sq 2)")
+		cv.So(byName["lines"].Message(), cv.ShouldContainSubstring, "diff (-expected +actual):\n        a\n      - b\n      + B\n        c")
+		cv.So(byName[LoadFailure].File, cv.ShouldEqual, "t/bad_test.zy")
+
+		tr.Run = regexp.MustCompile("^sq")
+		tr.Report = nil
+		only := tr.RunFiles([]string{"t/math_test.zy"})
+		cv.So(len(only), cv.ShouldEqual, 1)
+		cv.So(only[0].Name, cv.ShouldEqual, "squares")
+
+		var human bytes.Buffer
+		for _, r := range results {
+			cv.So(WriteTestHuman(&human, r, false), cv.ShouldBeNil)
+		}
+		cv.So(human.String(), cv.ShouldContainSubstring, "--- FAIL: wrong (t/math_test.zy)")
+		cv.So(human.String(), cv.ShouldContainSubstring, "expected: 10\n        actual:   9")
+		cv.So(human.String(), cv.ShouldNotContainSubstring, "squares")
+
+		var tap bytes.Buffer
+		cv.So(WriteTestTAP(&tap, results), cv.ShouldBeNil)
+		cv.So(tap.String(), cv.ShouldStartWith, "TAP version 13\n1..6\n")
+		cv.So(tap.String(), cv.ShouldContainSubstring, "ok 2 - t/math_test.zy: squares\n")
+		cv.So(tap.String(), cv.ShouldContainSubstring, "not ok 3 - t/math_test.zy: wrong\n  ---\n")
+
+		var junit bytes.Buffer
+		cv.So(WriteTestJUnit(&junit, results), cv.ShouldBeNil)
+		cv.So(junit.String(), cv.ShouldContainSubstring, `<testsuite name="t/math_test.zy" tests="4" failures="2"`)
+		cv.So(strings.Count(junit.String(), "<failure "), cv.ShouldEqual, 4)
+	})
+}
+
+func Test561SplitAssertionNamesPointToTheCamelCaseOnes(t *testing.T) {
+
+	cv.Convey(`Given assert=, assert-error or assert-match, which the lexer splits into assert and more, the error should name the assertion meant rather than report wrong arguments`, t, func() {
+		env := NewZlisp()
+
+		for src, name := range map[string]string{
+			`(assert= 1 1)`:          "assertEqual",
+			`(assert-error (foo))`:   "assertError",
+			`(assert-match "a" "a")`: "assertMatch",
+		} {
+			_, err := env.EvalString(src)
+			cv.So(err, cv.ShouldNotBeNil)
+			cv.So(err.Error(), cv.ShouldContainSubstring, "use "+name)
+			cv.So(err.Error(), cv.ShouldNotContainSubstring, "wrong number of arguments")
+		}
+
+		_, err := env.EvalString(`(assert 1 2)`)
+		cv.So(errors.Is(err, WrongNargs), cv.ShouldBeTrue)
+	})
+}
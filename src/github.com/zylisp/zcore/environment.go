@@ -3,13 +3,14 @@ package zcore
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
-	"runtime"
-	"strconv"
+	"sync"
 )
 
 type PreHook func(*Zlisp, string, []Sexp)
@@ -26,31 +27,108 @@ type Zlisp struct {
 	// loopstack: let break and continue find the nearest enclosing loop.
 	loopstack *Stack
 
-	symtable    map[string]int
-	revsymtable map[int]string
-	builtins    map[int]*SexpFunction
-	reserved    map[int]bool
-	macros      map[int]*SexpFunction
-	curfunc     *SexpFunction
-	mainfunc    *SexpFunction
-	pc          int
-	nextsymbol  int
-	before      []PreHook
-	after       []PostHook
-
+	// trystack: the (try) forms being compiled, for break and continue.
+	trystack []*tryBlock
+
+	// handlers: the (try) forms now running, innermost last.
+	handlers []tryHandler
+	runDepth int
+
+	// symtable and macros are shared by Clones and Duplicates,
+	// and so internally synchronized.
+	symtable *symbolTable
+	builtins map[int]*SexpFunction
+	reserved map[int]bool
+	macros   *macroTable
+	curfunc  *SexpFunction
+	mainfunc *SexpFunction
+	pc       int
+	before   []PreHook
+	after    []PostHook
+
+	// DebugExec dumps the whole environment before every
+	// instruction. A LogTracer (see SetTracer) is usually
+	// more use.
 	DebugExec           bool
 	debugSymbolNotFound bool
 
+	// RePanic lets Go panics in builtins and in the VM crash
+	// the program, with their stack, rather than become
+	// *PanicError script errors. For debugging.
+	RePanic bool
+
 	ShowGlobalScope bool
 	baseTypeCtor    *SexpFunction
 
 	infixOps map[string]*InfixOp
 	Pretty   bool
 
+	// Stdout, Stderr and Stdin are where print, printf, timeit,
+	// the debug dumps and the repl write and read. NewZlisp sets
+	// them to the process's own; Clone and Duplicate share them.
+	Stdout io.Writer
+	Stderr io.Writer
+	Stdin  io.Reader
+
+	// fsys is what the file builtins read and write; see SetFS.
+	fsys fs.FS
+
+	// tracer, if set, is told of each step; see SetTracer.
+	tracer Tracer
+
+	// debugger, if set, may pause the run; see SetDebugger.
+	debugger *Debugger
+
+	// profiler, if set, samples the run; see StartScriptProfile.
+	profiler *scriptProfiler
+
+	// coverage, if set, counts the blocks run; see SetCoverage.
+	coverage *Coverage
+
+	// modules caches the packages import has loaded; importing
+	// holds the paths being imported now, to catch cycles.
+	modules   *moduleCache
+	importing []string
+
+	// tests holds the deftests defined; see Tests.
+	tests *testSet
+
+	// CacheBytecode has source and import keep the code they
+	// compile in a .zyc file beside each script, and load that
+	// instead while the script is unchanged; see BytecodeName.
+	CacheBytecode bool
+
+	// NoOptimize leaves the code as the generator makes it,
+	// without the passes of optimize; for debugging the
+	// generator, or stepping through every instruction.
+	NoOptimize bool
+
+	// MaxRecursionDepth caps how deeply calls may nest; a call
+	// past it fails with a *RecursionDepthError. Zero means
+	// DefaultMaxRecursionDepth, and a negative number no cap.
+	MaxRecursionDepth int
+
+	// genDeps counts the times the generator has relied on the
+	// env in ways a .zyc cache cannot check, such as expanding a
+	// macro; zycLoads counts the caches loaded.
+	genDeps  int
+	zycLoads int
+
 	booter Booter
 
 	// API use, since infix is already default at repl
 	WrapLoadExpressionsInInfix bool
+
+	// ctx is set during RunContext; nil otherwise.
+	ctx context.Context
+
+	// budget is nil unless SetBudget was called.
+	budget    *Budget
+	usage     *budgetUsage
+	budgetErr *BudgetExceededError
+
+	// policy is nil unless made by NewZlispWithPolicy.
+	policy *SandboxPolicy
 }
 
 // SetBooter: allow clients to establish a callback to
@@ -64,13 +142,15 @@ func (env *Zlisp) SetBooter(b Booter) {
 // for any new Go struct created by the ToGoFunction (togo).
 type Booter func(s interface{})
 
+// The sizes the stacks of an env start at. They grow as needed;
+// see MaxRecursionDepth and Budget for what limits them.
 const CallStackSize = 25
 const ScopeStackSize = 50
 const DataStackSize = 100
 const StackStackSize = 5
 const LoopStackSize = 5
 
-var ReservedWords = []string{"byte", "defbuild", "builder", "field", "and", "or", "cond", "quote", "def", "mdef", "fn", "defn", "begin", "let", "letseq", "assert", "defmac", "macexpand", "syntaxQuote", "include", "for", "set", "break", "continue", "newScope", "_ls", "int8", "int16", "int32", "int64", "uint8", "uint16", "uint32", "uint64", "float32", "float64", "complex64", "complex128", "bool", "string", "any", "break", "case", "chan", "const", "continue", "default", "else", "defer", "fallthrough", "for", "func", "go", "goto", "if", "import", "interface", "map", "package", "range", "return", "select", "struct", "switch", "type", "var", "append", "cap", "close", "complex", "copy", "delete", "imag", "len", "make", "new", "panic", "print", "println", "real", "recover", "null", "nil", "-", "+", "--", "++", "-=", "+=", ":=", "=", ">", "<", ">=", "<=", "send", "NaN", "nan"}
+var ReservedWords = []string{"byte", "defbuild", "try", "throw", "builder", "field", "and", "or", "cond", "quote", "def", "mdef", "fn", "defn", "begin", "let", "letseq", "assert", "deftest", "assertError", "defmac", "macexpand", "syntaxQuote", "include", "for", "set", "break", "continue", "newScope", "_ls", "int8", "int16", "int32", "int64", "uint8", "uint16", "uint32", "uint64", "float32", "float64", "complex64", "complex128", "bool", "string", "any", "break", "case", "chan", "const", "continue", "default", "else", "defer", "fallthrough", "for", "func", "go", "goto", "if", "import", "interface", "map", "package", "range", "return", "select", "struct", "switch", "type", "var", "append", "cap", "close", "complex", "copy", "delete", "imag", "len", "make", "new", "panic", "print", "println", "real", "recover", "null", "nil", "-", "+", "--", "++", "-=", "+=", ":=", "=", ">", "<", ">=", "<=", "send", "NaN", "nan"}
 
 func NewZlisp() *Zlisp {
 	return NewZlispWithFuncs(AllBuiltinFunctions())
@@ -89,6 +169,7 @@ func NewZlispSandbox() *Zlisp {
 // NewZlispWithFuncs returns a new *Zlisp instance with access to only the given builtin functions
 func NewZlispWithFuncs(funcs map[string]ZlispUserFunction) *Zlisp {
 	env := new(Zlisp)
+	env.Stdout, env.Stderr, env.Stdin = os.Stdout, os.Stderr, os.Stdin
 	env.baseTypeCtor = MakeUserFunction("__basetype_ctor", BaseTypeConstructorFunction)
 	env.Parser = env.NewParser()
 	env.Parser.Start()
@@ -97,15 +178,16 @@ func NewZlispWithFuncs(funcs map[string]ZlispUserFunction) *Zlisp {
 
 	glob := env.NewNamedScope("global")
 	glob.IsGlobal = true
+	glob.mu = new(sync.RWMutex)
 	env.linearstack.Push(glob)
 	env.addrstack = env.NewStack(CallStackSize)
 	env.loopstack = env.NewStack(LoopStackSize)
 	env.builtins = make(map[int]*SexpFunction)
 	env.reserved = make(map[int]bool)
-	env.macros = make(map[int]*SexpFunction)
-	env.symtable = make(map[string]int)
-	env.revsymtable = make(map[int]string)
-	env.nextsymbol = 1
+	env.macros = newMacroTable()
+	env.symtable = newSymbolTable()
+	env.modules = newModuleCache()
+	env.tests = &testSet{}
 	env.before = []PreHook{}
 	env.after = []PostHook{}
 	env.infixOps = make(map[string]*InfixOp)
@@ -143,13 +225,12 @@ func (env *Zlisp) Clone() *Zlisp {
 	dupenv.datastack = env.datastack.Clone()
 	dupenv.linearstack = env.linearstack.Clone()
 	dupenv.addrstack = env.addrstack.Clone()
+	dupenv.loopstack = dupenv.NewStack(LoopStackSize)
 
 	dupenv.builtins = env.builtins
 	dupenv.reserved = env.reserved
 	dupenv.macros = env.macros
 	dupenv.symtable = env.symtable
-	dupenv.revsymtable = env.revsymtable
-	dupenv.nextsymbol = env.nextsymbol
 	dupenv.before = env.before
 	dupenv.after = env.after
 	dupenv.infixOps = env.infixOps
@@ -159,9 +240,7 @@ func (env *Zlisp) Clone() *Zlisp {
 		make([]Instruction, 0), nil)
 	dupenv.curfunc = dupenv.mainfunc
 	dupenv.pc = 0
-	dupenv.DebugExec = env.DebugExec
-	dupenv.debugSymbolNotFound = env.debugSymbolNotFound
-	dupenv.ShowGlobalScope = env.ShowGlobalScope
+	env.copyRuntimeSettings(dupenv)
 	return dupenv
 }
 
@@ -172,12 +251,11 @@ func (env *Zlisp) Duplicate() *Zlisp {
 	dupenv.datastack = dupenv.NewStack(DataStackSize)
 	dupenv.linearstack = dupenv.NewStack(ScopeStackSize)
 	dupenv.addrstack = dupenv.NewStack(CallStackSize)
+	dupenv.loopstack = dupenv.NewStack(LoopStackSize)
 	dupenv.builtins = env.builtins
 	dupenv.reserved = env.reserved
 	dupenv.macros = env.macros
 	dupenv.symtable = env.symtable
-	dupenv.revsymtable = env.revsymtable
-	dupenv.nextsymbol = env.nextsymbol
 	dupenv.before = env.before
 	dupenv.after = env.after
 	dupenv.infixOps = env.infixOps
@@ -188,13 +266,36 @@ func (env *Zlisp) Duplicate() *Zlisp {
 		make([]Instruction, 0), nil)
 	dupenv.curfunc = dupenv.mainfunc
 	dupenv.pc = 0
-	dupenv.DebugExec = env.DebugExec
-	dupenv.debugSymbolNotFound = env.debugSymbolNotFound
-	dupenv.ShowGlobalScope = env.ShowGlobalScope
+	env.copyRuntimeSettings(dupenv)
 
 	return dupenv
 }
 
+// copyRuntimeSettings gives dst, a Clone or Duplicate of env,
+// env's settings and the state its copies share: debugging and
+// tracing, limits, policy, io, file system, modules and tests.
+// A field for either belongs here, so that both get it.
+func (env *Zlisp) copyRuntimeSettings(dst *Zlisp) {
+	dst.DebugExec = env.DebugExec
+	dst.tracer = env.tracer
+	dst.profiler = env.profiler
+	dst.coverage = env.coverage
+	dst.RePanic = env.RePanic
+	dst.CacheBytecode = env.CacheBytecode
+	dst.NoOptimize = env.NoOptimize
+	dst.MaxRecursionDepth = env.MaxRecursionDepth
+	dst.Stdout, dst.Stderr, dst.Stdin = env.Stdout, env.Stderr, env.Stdin
+	dst.fsys = env.fsys
+	dst.modules = env.modules
+	dst.tests = env.tests
+	dst.debugSymbolNotFound = env.debugSymbolNotFound
+	dst.ShowGlobalScope = env.ShowGlobalScope
+	dst.budget = env.budget
+	dst.usage = env.usage
+	dst.policy = env.policy
+	dst.ctx = env.ctx
+}
+
 func (env *Zlisp) MakeDotSymbol(name string) *SexpSymbol {
 	x := env.MakeSymbol(name)
 	x.isDot = true
@@ -221,33 +322,30 @@ func (env *Zlisp) DetectSigils(sym *SexpSymbol) {
 	}
 }
 
-func (env *Zlisp) DumpSymTable() {
-	for kk, vv := range env.symtable {
-		fmt.Printf("symtable entry: kk: '%v' -> '%v'\n", kk, vv)
+// stderr is env.Stderr, or the process's for a nil env.
+func (env *Zlisp) stderr() io.Writer {
+	if env == nil || env.Stderr == nil {
+		return os.Stderr
 	}
+	return env.Stderr
+}
+
+func (env *Zlisp) DumpSymTable() {
+	env.symtable.each(func(kk string, vv int) {
+		fmt.Fprintf(env.Stdout, "symtable entry: kk: '%v' -> '%v'\n", kk, vv)
+	})
 }
 func (env *Zlisp) MakeSymbol(name string) *SexpSymbol {
 	if env == nil {
 		panic("internal problem:  env.MakeSymbol called with nil env")
 	}
-	symnum, ok := env.symtable[name]
-	if ok {
-		symbol := &SexpSymbol{name: name, number: symnum}
-		env.DetectSigils(symbol)
-		return symbol
-	}
-	symbol := &SexpSymbol{name: name, number: env.nextsymbol}
-	env.symtable[name] = symbol.number
-	env.revsymtable[symbol.number] = name
-
-	env.nextsymbol++
+	symbol := &SexpSymbol{name: name, number: env.symtable.intern(name)}
 	env.DetectSigils(symbol)
 	return symbol
 }
 
 func (env *Zlisp) GenSymbol(prefix string) *SexpSymbol {
-	symname := prefix + strconv.Itoa(env.nextsymbol)
-	return env.MakeSymbol(symname)
+	return env.MakeSymbol(env.symtable.gensym(prefix))
 }
 
 func (env *Zlisp) CurrentFunctionSize() int {
@@ -276,6 +374,16 @@ func (env *Zlisp) wrangleOptargs(fnargs, nargs int) error {
 }
 
 func (env *Zlisp) CallFunction(function *SexpFunction, nargs int) error {
+	// snapshot the arguments as given, for a tracer or debugger;
+	// otherwise Frames reads them back from the parameters.
+	var args []Sexp
+	var err error
+	if env.tracer != nil || env.debugger != nil {
+		args, err = env.datastack.GetExpressions(nargs)
+		if err != nil {
+			return err
+		}
+	}
 	for _, prehook := range env.before {
 		expressions, err := env.datastack.GetExpressions(nargs)
 		if err != nil {
@@ -285,7 +393,7 @@ func (env *Zlisp) CallFunction(function *SexpFunction, nargs int) error {
 	}
 
 	// do name and type checking
-	err := env.FunctionCallNameTypeCheck(function, &nargs)
+	err = env.FunctionCallNameTypeCheck(function, &nargs)
 	if err != nil {
 		return err
 	}
@@ -305,7 +413,9 @@ func (env *Zlisp) CallFunction(function *SexpFunction, nargs int) error {
 		panic("where's the global scope?")
 	}
 
-	env.addrstack.PushAddr(env.curfunc, env.pc+1)
+	if err := env.pushCall(args); err != nil {
+		return err
+	}
 
 	//P("DEBUG linearstack with this next:")
 	//env.showStackHelper(env.linearstack, "linearstack")
@@ -314,6 +424,9 @@ func (env *Zlisp) CallFunction(function *SexpFunction, nargs int) error {
 	// next instructions to happen once we exit.
 	env.curfunc = function
 	env.pc = 0
+	if env.tracer != nil {
+		env.tracer.Call(env, function, args)
+	}
 
 	//Q("\n CallFunction starting with stack:\n")
 	//env.ShowStackStackAndScopeStack()
@@ -329,6 +442,13 @@ func (env *Zlisp) ReturnFromFunction() error {
 		}
 		posthook(env, env.curfunc.name, retval)
 	}
+	if env.tracer != nil {
+		retval, err := env.datastack.GetExpr(0)
+		if err != nil {
+			retval = SexpNull
+		}
+		env.tracer.Return(env, env.curfunc, retval)
+	}
 	var err error
 	env.curfunc, env.pc, err = env.addrstack.PopAddr()
 	return err
@@ -351,46 +471,32 @@ func (env *Zlisp) CallUserFunction(
 			fmt.Sprintf("Error calling '%s': %v", name, err))
 	}
 
-	env.addrstack.PushAddr(env.curfunc, env.pc+1)
+	if err := env.pushCall(args); err != nil {
+		return 0, err
+	}
 	env.curfunc = function
 	env.pc = -1
+	if env.tracer != nil {
+		env.tracer.Call(env, function, args)
+	}
 
 	//P("DEBUG linearstack with this next, just before calling function.userfun:")
 	//env.showStackHelper(env.linearstack, "linearstack")
 
 	// protect against bad calls/bad reflection in usercalls
-	var wasPanic bool
-	var recovered interface{}
-	tr := make([]byte, 16384)
-	trace := &tr
-	res, err := func() (Sexp, error) {
-		defer func() {
-			recovered = recover()
-			if recovered != nil {
-				wasPanic = true
-				nbyte := runtime.Stack(*trace, false)
-				*trace = (*trace)[:nbyte]
-			}
-		}()
-
-		// the point we were getting to, before the panic protection:
-		return function.userfun(env, name, args)
-	}()
-
-	//P("DEBUG linearstack with this next, just *after* calling function.userfun:")
-	//env.showStackHelper(env.linearstack, "linearstack")
-
-	if wasPanic {
-		err = fmt.Errorf("CallUserFunction caught panic during call of "+
-			"'%s': '%v'\n stack trace:\n%v\n",
-			name, recovered, string(*trace))
+	res, err := env.callGuarded(function, name, args)
+	if env.profiler != nil {
+		env.profiler.sample(env)
 	}
+
 	if err != nil {
-		return 0, errors.New(
-			fmt.Sprintf("Error calling '%s': %v", name, err))
+		return 0, fmt.Errorf("Error calling '%s': %w", name, err)
 	}
 
 	env.datastack.PushExpr(res)
+	if env.tracer != nil {
+		env.tracer.Return(env, function, res)
+	}
 
 	for _, posthook := range env.after {
 		posthook(env, name, res)
@@ -423,14 +529,20 @@ func (env *Zlisp) LoadExpressions(xs []Sexp) error {
 		return err
 	}
 
-	env.mainfunc.fun = append(env.mainfunc.fun, gen.instructions...)
+	code, positions := env.optimize(gen.instructions, gen.positions)
+	env.mainfunc.fun = append(env.mainfunc.fun, code...)
+	env.mainfunc.code = env.mainfunc.code.extend(env.mainfunc.fun)
+	env.mainfunc.srcmap = append(env.mainfunc.srcmap, positions...)
+	if env.coverage != nil {
+		env.coverage.add(positions)
+	}
 	env.curfunc = env.mainfunc
 
 	return nil
 }
 
 func (env *Zlisp) ParseFile(file string) ([]Sexp, error) {
-	in, err := os.Open(file)
+	in, err := env.openFile(file)
 	if err != nil {
 		return nil, err
 	}
@@ -438,10 +550,10 @@ func (env *Zlisp) ParseFile(file string) ([]Sexp, error) {
 	var exp []Sexp
 
 	env.Parser.Reset()
-	env.Parser.NewInput(bufio.NewReader(in))
+	env.Parser.NewInput(&NamedInput{RuneScanner: bufio.NewReader(in), Name: file})
 	exp, err = env.Parser.ParseTokens()
 	if err != nil {
-		return nil, fmt.Errorf("Error on line %d: %v\n", env.Parser.Lexer.Linenum(), err)
+		return nil, fmt.Errorf("Error at %s: %v\n", env.Parser.Lexer.Position(), err)
 	}
 
 	in.Close()
@@ -453,7 +565,7 @@ func (env *Zlisp) LoadStream(stream io.RuneScanner) error {
 	env.Parser.ResetAddNewInput(stream)
 	expressions, err := env.Parser.ParseTokens()
 	if err != nil {
-		return fmt.Errorf("Error on line %d: %v\n", env.Parser.Lexer.Linenum(), err)
+		return fmt.Errorf("Error at %s: %v\n", env.Parser.Lexer.Position(), err)
 	}
 	return env.LoadExpressions(expressions)
 }
@@ -481,7 +593,12 @@ func (env *Zlisp) EvalExpressions(xs []Sexp) (Sexp, error) {
 	return env.Run()
 }
 
+// LoadFile: if file has a Name(), as an *os.File does, source
+// positions will refer to it by that name.
 func (env *Zlisp) LoadFile(file io.Reader) error {
+	if named, ok := file.(interface{ Name() string }); ok {
+		return env.LoadStream(&NamedInput{RuneScanner: bufio.NewReader(file), Name: named.Name()})
+	}
 	return env.LoadStream(bufio.NewReader(file))
 }
 
@@ -499,16 +616,16 @@ func (env *Zlisp) AddBuilder(name string, function ZlispUserFunction) {
 
 func (env *Zlisp) AddGlobal(name string, obj Sexp) {
 	sym := env.MakeSymbol(name)
-	env.linearstack.elements[0].(*Scope).Map[sym.number] = obj
+	env.linearstack.elements[0].(*Scope).store(sym.number, obj)
 }
 
 func (env *Zlisp) AddMacro(name string, function ZlispUserFunction) {
 	sym := env.MakeSymbol(name)
-	env.macros[sym.number] = MakeUserFunction(name, function)
+	env.macros.set(sym.number, MakeUserFunction(name, function))
 }
 
 func (env *Zlisp) HasMacro(sym *SexpSymbol) bool {
-	_, found := env.macros[sym.number]
+	_, found := env.macros.get(sym.number)
 	return found
 }
 
@@ -533,12 +650,17 @@ func (env *Zlisp) DumpFunctionByName(name string) error {
 	default:
 		return errors.New("dump by name error: not a function")
 	}
-	DumpFunction(fun, -1)
+	FdumpFunction(env.Stdout, fun, -1)
 	return nil
 }
 
 // DumpFunction: if pc is -1, don't show it.
 func DumpFunction(fun ZlispFunction, pc int) {
+	FdumpFunction(os.Stdout, fun, pc)
+}
+
+// FdumpFunction is DumpFunction, writing to w.
+func FdumpFunction(w io.Writer, fun ZlispFunction, pc int) {
 	blank := "      "
 	extra := blank
 	for i, instr := range fun {
@@ -547,22 +669,22 @@ func DumpFunction(fun ZlispFunction, pc int) {
 		} else {
 			extra = blank
 		}
-		fmt.Printf("%s %d: %s\n", extra, i, instr.InstrString())
+		fmt.Fprintf(w, "%s %d: %s\n", extra, i, instr.InstrString())
 	}
 	if pc == len(fun) {
-		fmt.Printf(" PC just past end at %d -----\n\n", pc)
+		fmt.Fprintf(w, " PC just past end at %d -----\n\n", pc)
 	}
 }
 
 func (env *Zlisp) DumpEnvironment() {
-	fmt.Printf("PC: %d\n", env.pc)
-	fmt.Println("Instructions:")
+	fmt.Fprintf(env.Stdout, "PC: %d\n", env.pc)
+	fmt.Fprintln(env.Stdout, "Instructions:")
 	if !env.curfunc.user {
-		DumpFunction(env.curfunc.fun, env.pc)
+		FdumpFunction(env.Stdout, env.curfunc.fun, env.pc)
 	}
-	fmt.Printf("DataStack (%p): (length %d)\n", env.datastack, env.datastack.Size())
+	fmt.Fprintf(env.Stdout, "DataStack (%p): (length %d)\n", env.datastack, env.datastack.Size())
 	env.datastack.PrintStack()
-	fmt.Printf("Linear stack: (length %d)\n", env.linearstack.Size())
+	fmt.Fprintf(env.Stdout, "Linear stack: (length %d)\n", env.linearstack.Size())
 	//env.linearstack.PrintScopeStack()
 	// instead of the above, try:
 	env.showStackHelper(env.linearstack, "linearstack")
@@ -572,20 +694,29 @@ func (env *Zlisp) ReachedEnd() bool {
 	return env.pc == env.CurrentFunctionSize()
 }
 
+// GetStackTrace describes err and where it happened, followed by
+// the active calls (see Frames). The stack is left as it was.
 func (env *Zlisp) GetStackTrace(err error) string {
-	str := fmt.Sprintf("error in %s:%d: %v\n",
-		env.curfunc.name, env.pc, err)
-	for !env.addrstack.IsEmpty() {
-		fun, pos, _ := env.addrstack.PopAddr()
-		str += fmt.Sprintf("in %s:%d\n", fun.name, pos)
+	var str string
+	if pos := env.Position(); pos != nil {
+		str = fmt.Sprintf("error at %s: %v\n%s", pos, err, pos.showSource())
+	} else {
+		str = fmt.Sprintf("error in %s:%d: %v\n",
+			env.curfunc.name, env.pc, err)
+	}
+	str += formatFrames(env.Frames())
+	var pe *PanicError
+	if errors.As(err, &pe) {
+		str += "Go stack at the panic:\n" + string(pe.Stack)
 	}
 	return str
 }
 
 func (env *Zlisp) Clear() {
-	env.datastack.tos = -1
-	env.linearstack.tos = 0
-	env.addrstack.tos = -1
+	env.datastack.TruncateToSize(0)
+	env.linearstack.TruncateToSize(1)
+	env.addrstack.TruncateToSize(0)
+	env.handlers = env.handlers[:0]
 
 	env.mainfunc = env.MakeFunction("__main", 0, false,
 		make([]Instruction, 0), nil)
@@ -605,7 +736,7 @@ func (env *Zlisp) FindObject(name string) (Sexp, bool) {
 func (env *Zlisp) Apply(fun *SexpFunction, args []Sexp) (Sexp, error) {
 	VPrintf("\n\n debug Apply not working on user funcs: fun = '%#v'   and args = '%#v'\n\n", fun, args)
 	if fun.user {
-		return fun.userfun(env, fun.name, args)
+		return env.callGuarded(fun, fun.name, args)
 	}
 
 	env.pc = -2
@@ -623,30 +754,24 @@ func (env *Zlisp) Apply(fun *SexpFunction, args []Sexp) (Sexp, error) {
 }
 
 func (env *Zlisp) Run() (Sexp, error) {
+	env.runDepth++
+	defer env.endRun()
 
-	for env.pc != -1 && !env.ReachedEnd() {
-		instr := env.curfunc.fun[env.pc]
-		if env.DebugExec {
-			fmt.Printf("\n ====== in '%s', about to run: '%v'\n",
-				env.curfunc.name, instr.InstrString())
-			env.DumpEnvironment()
-			fmt.Printf("\n ====== in '%s', now running the above.\n",
-				env.curfunc.name)
+	for {
+		err := env.runInstructions()
+		if err == nil {
+			break
 		}
-		err := instr.Execute(env)
-		if err == StackUnderFlowErr {
-			err = nil
+		if env.tracer != nil {
+			env.tracer.Error(env, err)
 		}
-		if err != nil {
-			return SexpNull, err
+		if env.budgetErr != nil {
+			return SexpNull, env.budgetErr
 		}
-		if env.DebugExec {
-			fmt.Printf("\n ****** in '%s', after running, stack is: \n",
-				env.curfunc.name)
-			env.DumpEnvironment()
-			fmt.Printf("\n ****** \n")
-
+		if env.catch(err) {
+			continue
 		}
+		return SexpNull, err
 	}
 
 	if env.datastack.IsEmpty() {
@@ -658,6 +783,56 @@ func (env *Zlisp) Run() (Sexp, error) {
 	return env.datastack.PopExpr()
 }
 
+// runInstructions runs until the end, or an error. A Go panic
+// is returned as a *PanicError, unless env.RePanic is set; the
+// environment is left as for any other error.
+func (env *Zlisp) runInstructions() (err error) {
+	defer func() {
+		if env.RePanic {
+			return
+		}
+		if r := recover(); r != nil {
+			err = env.panicError(r)
+		}
+	}()
+
+	for env.pc != -1 && !env.ReachedEnd() {
+		if err := env.checkDone(); err != nil {
+			return err
+		}
+		if env.budget != nil {
+			if err := env.chargeInstr(); err != nil {
+				return err
+			}
+		}
+		if env.profiler != nil {
+			env.profiler.sample(env)
+		}
+		if env.coverage != nil {
+			env.coverage.hit(env.curfunc.SrcPos(env.pc))
+		}
+		if env.debugger != nil {
+			if err := env.debugger.check(env); err != nil {
+				return err
+			}
+		}
+		if env.tracer != nil {
+			env.tracer.Instr(env, env.curfunc, env.pc, env.curfunc.fun[env.pc])
+		}
+		if env.DebugExec {
+			env.dumpInstr(env.curfunc.fun[env.pc])
+		}
+		err := env.step()
+		if err == StackUnderFlowErr {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (env *Zlisp) AddPreHook(fun PreHook) {
 	env.before = append(env.before, fun)
 }
@@ -689,7 +864,7 @@ func (env *Zlisp) showStackHelper(stack *Stack, name string) {
 	if n < 0 {
 		note = "(empty)"
 	}
-	fmt.Printf(" ========  env(%p).%s is %v deep: %s\n", env, name, n+1, note)
+	fmt.Fprintf(env.Stdout, " ========  env(%p).%s is %v deep: %s\n", env, name, n+1, note)
 	s := ""
 	for i := 0; i <= n; i++ {
 		ele, err := stack.Get(n - i)
@@ -710,7 +885,7 @@ func (env *Zlisp) showStackHelper(stack *Stack, name string) {
 			panic(fmt.Errorf("unrecognized element on %s: %T/val=%v",
 				name, x, x))
 		}
-		fmt.Println(s)
+		fmt.Fprintln(env.Stdout, s)
 	}
 }
 
@@ -719,8 +894,8 @@ func (env *Zlisp) dumpParentChain(curfunc *SexpFunction) {
 	cur := curfunc
 	par := cur.parent
 	for par != nil {
-		fmt.Printf(" parent chain: cur:%v -> parent:%v\n", cur.name, par.name)
-		fmt.Printf("        cur.closures = %s", ClosureToString(cur, env))
+		fmt.Fprintf(env.Stdout, " parent chain: cur:%v -> parent:%v\n", cur.name, par.name)
+		fmt.Fprintf(env.Stdout, "        cur.closures = %s", ClosureToString(cur, env))
 		cur = par
 		par = par.parent
 	}
@@ -728,9 +903,9 @@ func (env *Zlisp) dumpParentChain(curfunc *SexpFunction) {
 
 func (env *Zlisp) ShowStackStackAndScopeStack() error {
 	env.showStackHelper(env.linearstack, "linearstack")
-	fmt.Println(" --- done with env.linearstack, now here is env.curfunc --- ")
-	fmt.Println(ClosureToString(env.curfunc, env))
-	fmt.Println(" --- done with env.curfunc closure, now here is parent chain: --- ")
+	fmt.Fprintln(env.Stdout, " --- done with env.linearstack, now here is env.curfunc --- ")
+	fmt.Fprintln(env.Stdout, ClosureToString(env.curfunc, env))
+	fmt.Fprintln(env.Stdout, " --- done with env.curfunc closure, now here is parent chain: --- ")
 	env.dumpParentChain(env.curfunc)
 	return nil
 }
@@ -834,7 +1009,7 @@ func (env *Zlisp) IsBuiltinSym(sym *SexpSymbol) (builtin bool, typ string) {
 	if isBuiltin {
 		return true, "built-in function"
 	}
-	_, isBuiltin = env.macros[sym.number]
+	_, isBuiltin = env.macros.get(sym.number)
 	if isBuiltin {
 		return true, "macro"
 	}
@@ -863,51 +1038,20 @@ func (env *Zlisp) ResolveDotSym(arg []Sexp) ([]Sexp, error) {
 	return r, nil
 }
 
-func (env *Zlisp) StandardSetup() {
+// StandardSetup imports the standard library of builtins
+// and macros.
+func (env *Zlisp) StandardSetup() error {
 	env.ImportBaseTypes()
 	env.ImportEval()
 	env.ImportTime()
 	env.ImportPackageBuilder()
 	env.ImportMsgpackMap()
 
-	defmap := `(defmac defmap [name] ^(defn ~name [& rest] (msgmap (quote ~name) rest)))`
-	_, err := env.EvalString(defmap)
-	PanicOn(err)
-
-	//	colonOp := `(defmac : [key hmap & def] ^(hget ~hmap (quote ~key) ~@def))`
-	//	_, err = env.EvalString(colonOp)
-	//	PanicOn(err)
-
-	// XXX Let's put these macros in their own file as string constants
-	// XXX Let's create a SafeEvalString string that does what happens below, wrapping EvalString
-	rangeMacro := `(defmac range [key value myhash & body]
-  ^(let [n (len ~myhash)]
-      (for [(def i 0) (< i n) (def i (+ i 1))]
-        (begin
-          (mdef (quote ~key) (quote ~value) (hpair ~myhash i))
-          ~@body))))`
-	_, err = env.EvalString(rangeMacro)
-	PanicOn(err)
-
-	reqMacro := `(defmac req [a] ^(source (sym2str (quote ~a))))`
-	_, err = env.EvalString(reqMacro)
-	PanicOn(err)
-
-	incrMacro := `(defmac ++ [a] ^(set ~a (+ ~a 1)))`
-	_, err = env.EvalString(incrMacro)
-	PanicOn(err)
-
-	incrEqMacro := `(defmac += [a b] ^(set ~a (+ ~a ~b)))`
-	_, err = env.EvalString(incrEqMacro)
-	PanicOn(err)
-
-	decrMacro := `(defmac -- [a] ^(set ~a (- ~a 1)))`
-	_, err = env.EvalString(decrMacro)
-	PanicOn(err)
-
-	decrEqMacro := `(defmac -= [a b] ^(set ~a (- ~a ~b)))`
-	_, err = env.EvalString(decrEqMacro)
-	PanicOn(err)
+	for _, macro := range standardMacros {
+		if _, err := env.EvalString(macro); err != nil {
+			return fmt.Errorf("StandardSetup: %v", err)
+		}
+	}
 
 	env.ImportChannels()
 	env.ImportGoroutines()
@@ -916,4 +1060,25 @@ func (env *Zlisp) StandardSetup() {
 
 	gob.Register(SexpHash{})
 	gob.Register(SexpArray{})
+	return nil
+}
+
+// XXX Let's put these macros in their own file as string constants
+var standardMacros = []string{
+	`(defmac defmap [name] ^(defn ~name [& rest] (msgmap (quote ~name) rest)))`,
+
+	//	`(defmac : [key hmap & def] ^(hget ~hmap (quote ~key) ~@def))`,
+
+	`(defmac range [key value myhash & body]
+  ^(let [n (len ~myhash)]
+      (for [(def i 0) (< i n) (def i (+ i 1))]
+        (begin
+          (mdef (quote ~key) (quote ~value) (hpair ~myhash i))
+          ~@body))))`,
+
+	`(defmac req [a] ^(source (sym2str (quote ~a))))`,
+	`(defmac ++ [a] ^(set ~a (+ ~a 1)))`,
+	`(defmac += [a b] ^(set ~a (+ ~a ~b)))`,
+	`(defmac -- [a] ^(set ~a (- ~a 1)))`,
+	`(defmac -= [a b] ^(set ~a (- ~a ~b)))`,
 }
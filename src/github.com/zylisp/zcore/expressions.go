@@ -26,6 +26,8 @@ type Sexp interface {
 type SexpPair struct {
 	Head Sexp
 	Tail Sexp
+
+	pos *SrcPos // where parsed from, if we were
 }
 
 type SexpPointer struct {
@@ -97,27 +99,27 @@ type SexpStr struct {
 }
 
 func (r SexpStr) Type() *RegisteredType {
-	return GoStructRegistry.Registry["string"]
+	return GoStructRegistry.Lookup("string")
 }
 
 func (r *SexpInt) Type() *RegisteredType {
-	return GoStructRegistry.Registry["int64"]
+	return GoStructRegistry.Lookup("int64")
 }
 
 func (r *SexpUint64) Type() *RegisteredType {
-	return GoStructRegistry.Registry["uint64"]
+	return GoStructRegistry.Lookup("uint64")
 }
 
 func (r *SexpFloat) Type() *RegisteredType {
-	return GoStructRegistry.Registry["float64"]
+	return GoStructRegistry.Lookup("float64")
 }
 
 func (r *SexpBool) Type() *RegisteredType {
-	return GoStructRegistry.Registry["bool"]
+	return GoStructRegistry.Lookup("bool")
 }
 
 func (r *SexpChar) Type() *RegisteredType {
-	return GoStructRegistry.Registry["int32"]
+	return GoStructRegistry.Lookup("int32")
 }
 
 func (r *RegisteredType) Type() *RegisteredType {
@@ -140,8 +142,8 @@ type SexpReflect struct {
 func (r *SexpReflect) Type() *RegisteredType {
 	k := reflectName(reflect.Value(r.Val))
 	Q("SexpReflect.Type() looking up type named '%s'", k)
-	ty, ok := GoStructRegistry.Registry[k]
-	if !ok {
+	ty := GoStructRegistry.Lookup(k)
+	if ty == nil {
 		Q("SexpReflect.Type(): type named '%s' not found", k)
 		return nil
 	}
@@ -154,7 +156,7 @@ type SexpError struct {
 }
 
 func (r *SexpError) Type() *RegisteredType {
-	return GoStructRegistry.Registry["error"]
+	return GoStructRegistry.Lookup("error")
 }
 
 func (r *SexpSentinel) Type() *RegisteredType {
@@ -219,7 +221,7 @@ func (sent *SexpSentinel) SexpString(ps *PrintState) string {
 }
 
 func Cons(a Sexp, b Sexp) *SexpPair {
-	return &SexpPair{a, b}
+	return &SexpPair{Head: a, Tail: b}
 }
 
 func (pair *SexpPair) SexpString(ps *PrintState) string {
@@ -258,6 +260,8 @@ type SexpArray struct {
 	Infix               bool
 
 	Env *Zlisp
+
+	pos *SrcPos
 }
 
 func (r *SexpArray) Type() *RegisteredType {
@@ -503,6 +507,7 @@ type SexpSymbol struct {
 	isSigil   bool
 	colonTail bool
 	sigil     string
+	pos       *SrcPos
 }
 
 func (sym *SexpSymbol) RHS(env *Zlisp) (Sexp, error) {
@@ -528,7 +533,7 @@ func (sym *SexpSymbol) SexpString(ps *PrintState) string {
 }
 
 func (r *SexpSymbol) Type() *RegisteredType {
-	return GoStructRegistry.Registry["symbol"]
+	return GoStructRegistry.Lookup("symbol")
 }
 
 func (sym SexpSymbol) Name() string {
@@ -567,7 +572,7 @@ func (r *SexpInterfaceDecl) SexpString(ps *PrintState) string {
 
 func (r *SexpInterfaceDecl) Type() *RegisteredType {
 	// todo: how to register/what to register?
-	return GoStructRegistry.Registry[r.name]
+	return GoStructRegistry.Lookup(r.name)
 }
 
 // SexpFunction
@@ -577,6 +582,7 @@ type SexpFunction struct {
 	nargs             int
 	varargs           bool
 	fun               ZlispFunction
+	code              *vmcode // fun, assembled
 	userfun           ZlispUserFunction
 	orig              Sexp
 	closingOverScopes *Closing
@@ -584,7 +590,8 @@ type SexpFunction struct {
 	isBuilder         bool // see defbuild; builders are builtins that receive un-evaluated expressions
 	inputTypes        *SexpHash
 	returnTypes       *SexpHash
-	hasBody           bool // could just be declaration in an interface, without a body
+	hasBody           bool      // could just be declaration in an interface, without a body
+	srcmap            []*SrcPos // source position of each instruction in fun
 }
 
 func (sf *SexpFunction) Type() *RegisteredType {
@@ -0,0 +1,169 @@
+package zcore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Frame describes one active function call.
+type Frame struct {
+	Function string  // the function's name
+	Package  string  // the package it was defined in, if any
+	Pos      *SrcPos // where execution is in the function, if known
+	Args     []Sexp  // the arguments it was called with
+	Builtin  bool    // a Go function, rather than a script one
+
+	scopes int // the size of the scope stack in the frame
+}
+
+// String gives the frame as a call, e.g. (hi.Myfun "yes") at f.zy:3:7
+func (f *Frame) String() string {
+	name := f.Function
+	if f.Package != "" {
+		name = f.Package + "." + name
+	}
+	var call strings.Builder
+	call.WriteString("(" + name)
+	for _, a := range f.Args {
+		call.WriteString(" " + a.SexpString(nil))
+	}
+	call.WriteString(")")
+	if f.Pos != nil {
+		return call.String() + " at " + f.Pos.String()
+	}
+	return call.String()
+}
+
+// Frames returns the calls now active, innermost first. It only
+// reads the stacks, so may be called mid-run, as by (stacktrace),
+// tracers and error reports. Unless a tracer or debugger was
+// attached at the call, a script function's arguments are read
+// back from its parameters, and so show any later assignment.
+func (env *Zlisp) Frames() []Frame {
+	n := env.addrstack.Size()
+	frames := make([]Frame, 0, n+1)
+	fun, pc := env.curfunc, env.pc
+	scopes := env.linearstack.Size()
+	for i := n - 1; ; i-- {
+		var args []Sexp
+		var caller Address
+		if i >= 0 {
+			caller = env.addrstack.elements[i].(Address)
+			args = caller.args
+			if args == nil && !fun.user {
+				args = env.paramArgs(fun, caller.scopes)
+			}
+		}
+		frames = append(frames, Frame{
+			Function: fun.name,
+			Package:  fun.packageName(),
+			Pos:      fun.SrcPos(pc),
+			Args:     args,
+			Builtin:  fun.user,
+			scopes:   scopes,
+		})
+		if i < 0 {
+			break
+		}
+		// return addresses are just past the call.
+		fun, pc = caller.function, caller.position-1
+		scopes = caller.scopes
+	}
+	return frames
+}
+
+// paramArgs gives the arguments of a call to the script function
+// fun, as bound to its parameters in the scope at linearstack depth
+// depth; nil if they are not all bound yet.
+func (env *Zlisp) paramArgs(fun *SexpFunction, depth int) []Sexp {
+	if depth >= env.linearstack.Size() || len(fun.fun) == 0 {
+		return nil
+	}
+	scope, ok := env.linearstack.elements[depth].(*Scope)
+	if !ok {
+		return nil
+	}
+	if _, ok := fun.fun[0].(AddFuncScopeInstr); !ok {
+		return nil
+	}
+	// the parameters are bound last to first, just after the
+	// function scope is added.
+	var params []*SexpSymbol
+	for _, instr := range fun.fun[1:] {
+		put, ok := instr.(PopStackPutEnvInstr)
+		if !ok {
+			break
+		}
+		params = append(params, put.sym)
+	}
+	args := make([]Sexp, 0, len(params))
+	for i := len(params) - 1; i >= 0; i-- {
+		val, found := scope.lookup(params[i].number)
+		if !found {
+			return nil
+		}
+		args = append(args, val)
+	}
+	if fun.varargs && len(args) > 0 {
+		rest, err := ListToArray(args[len(args)-1])
+		if err == nil {
+			args = append(args[:len(args)-1], rest...)
+		}
+	}
+	return args
+}
+
+// packageName finds the package, if any, that sf was defined in.
+func (sf *SexpFunction) packageName() string {
+	if sf.closingOverScopes == nil {
+		return ""
+	}
+	elems := sf.closingOverScopes.Stack.elements
+	for i := len(elems) - 1; i >= 0; i-- {
+		if s, ok := elems[i].(*Scope); ok && s.PackageName != "" {
+			return s.PackageName
+		}
+	}
+	return ""
+}
+
+// StackTraceFunction: (stacktrace) returns an array of the active
+// calls, innermost first, each a hash of fn, pkg, pos and args.
+func StackTraceFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 0 {
+		return SexpNull, WrongNargs
+	}
+	// skip our own frame.
+	frames := env.Frames()[1:]
+	res := make([]Sexp, len(frames))
+	for i, f := range frames {
+		var pos Sexp = SexpNull
+		if f.Pos != nil {
+			pos = &SexpStr{S: f.Pos.String()}
+		}
+		var pkg Sexp = SexpNull
+		if f.Package != "" {
+			pkg = &SexpStr{S: f.Package}
+		}
+		h, err := MakeHash([]Sexp{
+			env.MakeSymbol("fn"), &SexpStr{S: f.Function},
+			env.MakeSymbol("pkg"), pkg,
+			env.MakeSymbol("pos"), pos,
+			env.MakeSymbol("args"), env.NewSexpArray(append([]Sexp{}, f.Args...)),
+		}, "hash", env)
+		if err != nil {
+			return SexpNull, err
+		}
+		res[i] = h
+	}
+	return env.NewSexpArray(res), nil
+}
+
+// formatFrames renders frames one per line, as for a traceback.
+func formatFrames(frames []Frame) string {
+	var b strings.Builder
+	for i := range frames {
+		fmt.Fprintf(&b, "  in %s\n", frames[i].String())
+	}
+	return b.String()
+}
@@ -0,0 +1,82 @@
+package zcore
+
+import (
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test461FramesSnapshotTheCallStack(t *testing.T) {
+
+	cv.Convey(`Given nested calls, including into a package, Frames and (stacktrace) should list each active call innermost first, with its name, package, position and arguments, without disturbing the stack`, t, func() {
+
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		var seen []Frame
+		env.AddFunction("peek", func(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+			seen = env.Frames()
+			// asking twice gives the same answer: nothing was consumed.
+			cv.So(env.Frames(), cv.ShouldResemble, seen)
+			return SexpNull, nil
+		})
+
+		res, err := env.EvalString(`
+(def pk (package "pk" { (defn Inner [x y] (peek) (stacktrace)) }))
+(defn outer [n] (pk.Inner n "two"))
+(outer 1)
+`)
+		cv.So(err, cv.ShouldBeNil)
+
+		cv.So(len(seen), cv.ShouldEqual, 4)
+		cv.So(seen[0].Function, cv.ShouldEqual, "peek")
+		cv.So(seen[0].Builtin, cv.ShouldBeTrue)
+		cv.So(seen[1].Function, cv.ShouldEqual, "Inner")
+		cv.So(seen[1].Package, cv.ShouldEqual, "pk")
+		cv.So(seen[1].Pos.String(), cv.ShouldEqual, "2:43")
+		cv.So(seen[1].String(), cv.ShouldEqual, `(pk.Inner 1 "two") at 2:43`)
+		cv.So(seen[2].Function, cv.ShouldEqual, "outer")
+		cv.So(seen[2].Package, cv.ShouldEqual, "")
+		cv.So(seen[2].String(), cv.ShouldEqual, `(outer 1) at 3:17`)
+		cv.So(seen[3].Function, cv.ShouldEqual, "__main")
+		cv.So(seen[3].Pos.String(), cv.ShouldEqual, "4:1")
+
+		// the script sees the same, less the stacktrace call itself.
+		arr := res.(*SexpArray)
+		cv.So(len(arr.Val), cv.ShouldEqual, 3)
+		inner := arr.Val[0].(*SexpHash)
+		fn, err := inner.HashGet(env, env.MakeSymbol("fn"))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(fn.SexpString(nil), cv.ShouldEqual, `"Inner"`)
+		args, err := inner.HashGet(env, env.MakeSymbol("args"))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(args.SexpString(nil), cv.ShouldEqual, `[1 "two"]`)
+		pos, err := inner.HashGet(env, env.MakeSymbol("pos"))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(pos.SexpString(nil), cv.ShouldEqual, `"2:50"`)
+	})
+}
+
+func Test462FramesReadArgsBackWithoutTracer(t *testing.T) {
+
+	cv.Convey(`Given no tracer or debugger, calls should not snapshot their arguments, but a traceback should still show them, read back from the parameters`, t, func() {
+
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		_, err := env.EvalString(`
+(defn g [a & more] (error "boom"))
+(defn f [x] (g x "y" 3))
+(f 2)
+`)
+		cv.So(err, cv.ShouldNotBeNil)
+		trace := env.GetStackTrace(err)
+		cv.So(trace, cv.ShouldContainSubstring, `(g 2 "y" 3)`)
+		cv.So(trace, cv.ShouldContainSubstring, `(f 2)`)
+		for i := 0; i < env.addrstack.Size(); i++ {
+			cv.So(env.addrstack.elements[i].(Address).args, cv.ShouldBeNil)
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package zcore
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+)
+
+// WritableFS is an fs.FS that can also create files, as
+// writef, owritef, save and bsave need to.
+type WritableFS interface {
+	fs.FS
+
+	// Create creates the named file, or truncates it if it exists.
+	Create(name string) (io.WriteCloser, error)
+}
+
+// RenameFS is a WritableFS that can also rename and remove files.
+// The .zyc caches of CacheBytecode are written only to one, as
+// each is written to a temporary file first, then renamed into
+// place.
+type RenameFS interface {
+	WritableFS
+
+	// Rename renames oldname to newname, replacing it if it
+	// exists.
+	Rename(oldname, newname string) error
+
+	// Remove removes the named file.
+	Remove(name string) error
+}
+
+// ErrReadOnlyFS is returned by the writing builtins when the
+// env's filesystem is not a WritableFS.
+var ErrReadOnlyFS = errors.New("filesystem is read-only")
+
+// OSFS returns the real filesystem, which is the default. Unlike
+// os.DirFS, it takes names as the os package does: absolute, or
+// relative to the working directory.
+func OSFS() RenameFS {
+	return osFS{}
+}
+
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Create(name string) (io.WriteCloser, error) {
+	return os.Create(name)
+}
+
+func (osFS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// SetFS sets the filesystem that source, import, include, slurpf,
+// bload and the writing builtins use, for instance an embed.FS of
+// scripts, or an fstest.MapFS in tests. For any filesystem other
+// than OSFS, names are taken relative to its root, so "/lib/a.zy"
+// and "./lib/a.zy" both mean "lib/a.zy". A nil fsys means OSFS.
+// Clones and Duplicates share the filesystem.
+func (env *Zlisp) SetFS(fsys fs.FS) {
+	if fsys == nil {
+		fsys = OSFS()
+	}
+	env.fsys = fsys
+}
+
+// FS returns the env's filesystem.
+func (env *Zlisp) FS() fs.FS {
+	if env.fsys == nil {
+		return OSFS()
+	}
+	return env.fsys
+}
+
+// fsName converts a script's file name for use with env.FS().
+func (env *Zlisp) fsName(name string) string {
+	return fsPath(env.FS(), name)
+}
+
+// fsPath converts a script's file name for use with fsys.
+func fsPath(fsys fs.FS, name string) string {
+	if _, isOS := fsys.(osFS); isOS {
+		return name
+	}
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return "."
+	}
+	return name[1:]
+}
+
+func (env *Zlisp) openFile(name string) (fs.File, error) {
+	return env.FS().Open(env.fsName(name))
+}
+
+func (env *Zlisp) createFile(name string) (io.WriteCloser, error) {
+	wfs, ok := env.FS().(WritableFS)
+	if !ok {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: ErrReadOnlyFS}
+	}
+	return wfs.Create(env.fsName(name))
+}
+
+// fileExists is FileExists, but on env.FS().
+func (env *Zlisp) fileExists(name string) bool {
+	fi, err := fs.Stat(env.FS(), env.fsName(name))
+	return err == nil && !fi.IsDir()
+}
@@ -0,0 +1,97 @@
+package zcore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+// memFS is a writable fstest.MapFS, that can rename.
+type memFS struct {
+	fstest.MapFS
+}
+
+func (m memFS) Create(name string) (io.WriteCloser, error) {
+	return &memFile{fsys: m.MapFS, name: name}, nil
+}
+
+func (m memFS) Rename(oldname, newname string) error {
+	f, ok := m.MapFS[oldname]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrNotExist}
+	}
+	m.MapFS[newname] = f
+	delete(m.MapFS, oldname)
+	return nil
+}
+
+func (m memFS) Remove(name string) error {
+	delete(m.MapFS, name)
+	return nil
+}
+
+type memFile struct {
+	bytes.Buffer
+	fsys fstest.MapFS
+	name string
+}
+
+func (f *memFile) Close() error {
+	f.fsys[f.name] = &fstest.MapFile{Data: f.Bytes()}
+	return nil
+}
+
+func Test500FileBuiltinsUseTheEnvsFS(t *testing.T) {
+
+	cv.Convey(`Given an env whose filesystem is in memory, source, include, import and slurpf should read from it, writef should write to it if it is writable and fail if not, and nothing should touch the disk`, t, func() {
+
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		files := fstest.MapFS{
+			"lib/util.zy": {Data: []byte(`(defn twice [x] (* 2 x))`)},
+			"lib/kit.zy":  {Data: []byte(`(package "kit" (def Name "cat"))`)},
+			"data.txt":    {Data: []byte("a\nb\n")},
+		}
+		env.SetFS(files)
+
+		res, err := env.EvalString(`(source "lib/util.zy") (twice 4)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `8`)
+
+		res, err = env.EvalString(`(include "/lib/util.zy") (twice 5)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `10`)
+
+		res, err = env.EvalString(`(import "./lib/kit.zy") (concat kit.Name "")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `"cat"`)
+
+		res, err = env.EvalString(`(slurpf "data.txt")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `["a" "b"]`)
+
+		_, err = env.EvalString(`(slurpf "nope.txt")`)
+		cv.So(err, cv.ShouldNotBeNil)
+
+		env.Clear()
+		_, err = env.EvalString(`(writef "hi" "out.txt")`)
+		cv.So(errors.Is(err, ErrReadOnlyFS), cv.ShouldBeTrue)
+
+		env.Clear()
+		env.SetFS(memFS{files})
+		res, err = env.EvalString(`(writef "hi" "out.txt") (slurpf "out.txt")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `["hi"]`)
+		cv.So(string(files["out.txt"].Data), cv.ShouldEqual, "hi\n")
+
+		_, err = env.Duplicate().EvalString(`(slurpf "out.txt")`)
+		cv.So(err, cv.ShouldBeNil)
+	})
+}
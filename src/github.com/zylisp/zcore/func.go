@@ -154,7 +154,8 @@ func FuncBuilder(env *Zlisp, name string,
 	gen.funcname = funcName
 
 	afsHelper := &AddFuncScopeHelper{}
-	gen.AddInstruction(AddFuncScopeInstr{Name: "runtime " + gen.funcname, Helper: afsHelper})
+	gen.AddInstruction(AddFuncScopeInstr{Name: "runtime " + gen.funcname, Helper: afsHelper,
+		layout: gen.openScope(true, nil)})
 
 	argsyms := make([]*SexpSymbol, len(funcargs))
 
@@ -176,7 +177,7 @@ func FuncBuilder(env *Zlisp, name string,
 	VPrintf("\n in buildSexpFun(): DumpFunction just before %v args go onto stack\n",
 		len(argsyms))
 	if Working {
-		DumpFunction(ZlispFunction(gen.instructions), -1)
+		FdumpFunction(gen.env.Stdout, ZlispFunction(gen.instructions), -1)
 	}
 	for i := len(argsyms) - 1; i >= 0; i-- {
 		gen.AddInstruction(PopStackPutEnvInstr{argsyms[i]})
@@ -196,10 +197,9 @@ func FuncBuilder(env *Zlisp, name string,
 
 	gen.AddInstruction(RemoveScopeInstr{})
 	gen.AddInstruction(ReturnInstr{nil}) // nil is the error returned
+	gen.closeScope()
 
-	newfunc := ZlispFunction(gen.instructions)
-	sfun := gen.env.MakeFunction(gen.funcname, nargs,
-		varargs, newfunc, orig)
+	sfun := gen.makeFunction(gen.funcname, nargs, varargs, orig)
 	sfun.inputTypes = inHash
 	sfun.returnTypes = retHash
 
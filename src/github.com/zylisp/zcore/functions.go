@@ -18,6 +18,7 @@ func AllBuiltinFunctions() map[string]ZlispUserFunction {
 		SystemFunctions(),     // system.go
 		RandomFunctions(),     // random.go
 		ReflectionFunctions(), // reflection.go
+		TestFunctions(),       // deftest.go
 	)
 }
 
@@ -27,6 +28,7 @@ func SandboxSafeFunctions() map[string]ZlispUserFunction {
 		CoreFunctions(),       // core.go
 		StringFunctions(),     // string.go
 		EncodingFunctions(),   // encoding.go
+		TestFunctions(),       // deftest.go
 	)
 }
 
@@ -75,8 +77,6 @@ func LenFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	case *SexpPair:
 		n, err := ListLen(t)
 		return &SexpInt{Val: int64(n)}, err
-	default:
-		P("in LenFunction with args[0] of type %T", t)
 	}
 	return &SexpInt{}, fmt.Errorf("argument must be string, list, hash, or array")
 }
@@ -90,10 +90,16 @@ func AppendFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	case *SexpArray:
 		switch name {
 		case "append":
+			if err := env.chargeAlloc(len(t.Val) + 1); err != nil {
+				return SexpNull, err
+			}
 			return &SexpArray{Val: append(t.Val, args[1]), Env: env, Typ: t.Typ}, nil
 		case "appendslice":
 			switch sl := args[1].(type) {
 			case *SexpArray:
+				if err := env.chargeAlloc(len(t.Val) + len(sl.Val)); err != nil {
+					return SexpNull, err
+				}
 				return &SexpArray{Val: append(t.Val, sl.Val...), Env: env, Typ: t.Typ}, nil
 			default:
 				return SexpNull, fmt.Errorf("Second argument of appendslice must be slice")
@@ -102,7 +108,11 @@ func AppendFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 			return SexpNull, fmt.Errorf("unrecognized append variant: '%s'", name)
 		}
 	case *SexpStr:
-		return AppendStr(t, args[1])
+		res, err := AppendStr(t, args[1])
+		if err == nil {
+			err = env.chargeAlloc(len(res.S))
+		}
+		return res, err
 	}
 
 	return SexpNull, fmt.Errorf("First argument of append must be array or string")
@@ -112,7 +122,6 @@ func OldEvalFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	if len(args) != 1 {
 		return SexpNull, WrongNargs
 	}
-	P("EvalFunction() called, name = '%s'; args = %#v", name, args)
 	newenv := env.Duplicate()
 	err := newenv.LoadExpressions(args)
 	if err != nil {
@@ -143,9 +152,8 @@ func EvalFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 		return SexpNull, err
 	}
 
-	newfunc := ZlispFunction(gen.instructions)
 	orig := &SexpArray{Val: args}
-	sfun := env.MakeFunction("evalGeneratedFunction", 0, false, newfunc, orig)
+	sfun := gen.makeFunction("evalGeneratedFunction", 0, false, orig)
 
 	err = env.CallFunction(sfun, 0)
 	if err != nil {
@@ -172,7 +180,7 @@ func EvalFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 		env.datastack.TruncateToSize(startingDataStackSize)
 	}
 	if env.datastack.Size() < startingDataStackSize {
-		P("about panic, since env.datastack.Size() < startingDataStackSize, here is env dump:")
+		fmt.Fprintln(env.stderr(), "about panic, since env.datastack.Size() < startingDataStackSize, here is env dump:")
 		env.DumpEnvironment()
 		panic(fmt.Sprintf("we've shrunk the datastack during eval, don't be sloppy, fix it now! env.datastack.Size()=%v. startingDataStackSize=%v", env.datastack.Size(), startingDataStackSize))
 	}
@@ -190,6 +198,7 @@ func (env *Zlisp) MakeFunction(name string, nargs int, varargs bool,
 	sfun.nargs = nargs
 	sfun.varargs = varargs
 	sfun.fun = fun
+	sfun.code = assemble(name, fun)
 	sfun.orig = orig
 	sfun.SetClosing(NewClosing(name, env)) // snapshot the create env as of now.
 	return &sfun
@@ -12,6 +12,22 @@ type Generator struct {
 	Tail         bool
 	scopes       int
 	instructions []Instruction
+
+	// lex is the scope that the code is generated in, when the
+	// generator knows it; see lexical.go.
+	lex *lexScope
+
+	// positions[i] is where in the source instructions[i] came
+	// from; pos is the position of the form being generated.
+	positions []*SrcPos
+	pos       *SrcPos
+}
+
+// genCode is a run of generated instructions along with their
+// source positions, so it can be moved between generators.
+type genCode struct {
+	instr []Instruction
+	pos   []*SrcPos
 }
 
 type Loop struct {
@@ -21,6 +37,7 @@ type Loop struct {
 	loopLen        int
 	breakOffset    int // i.e. relative to loopStart
 	continueOffset int // i.e. relative to loopStart
+	depth          int // how many loops enclose this one
 }
 
 func (loop *Loop) IsStackElem() {}
@@ -38,10 +55,54 @@ func NewGenerator(env *Zlisp) *Generator {
 
 func (gen *Generator) AddInstructions(instr []Instruction) {
 	gen.instructions = append(gen.instructions, instr...)
+	for range instr {
+		gen.positions = append(gen.positions, gen.pos)
+	}
 }
 
 func (gen *Generator) AddInstruction(instr Instruction) {
+	switch b := instr.(type) {
+	case PopStackPutEnvInstr:
+		gen.bind(b.sym)
+	case BindlistInstr:
+		for _, sym := range b.syms {
+			gen.bind(sym)
+		}
+	case IncrInstr:
+		if b.def {
+			gen.bind(b.sym)
+		}
+	}
 	gen.instructions = append(gen.instructions, instr)
+	gen.positions = append(gen.positions, gen.pos)
+}
+
+func (gen *Generator) code() genCode {
+	return genCode{instr: gen.instructions, pos: gen.positions}
+}
+
+// addCode appends code, which was generated by a sub-generator.
+// Instructions without a position take ours.
+func (gen *Generator) addCode(code genCode) {
+	gen.instructions = append(gen.instructions, code.instr...)
+	for _, p := range code.pos {
+		if p == nil {
+			p = gen.pos
+		}
+		gen.positions = append(gen.positions, p)
+	}
+}
+
+// makeFunction turns the generated code into a function, with
+// its pc to source position map.
+func (gen *Generator) makeFunction(name string, nargs int, varargs bool, orig Sexp) *SexpFunction {
+	code, positions := gen.env.optimize(gen.instructions, gen.positions)
+	sfun := gen.env.MakeFunction(name, nargs, varargs, ZlispFunction(code), orig)
+	sfun.srcmap = positions
+	if gen.env.coverage != nil {
+		gen.env.coverage.add(sfun.srcmap)
+	}
+	return sfun
 }
 
 func (gen *Generator) GenerateBegin(expressions []Sexp) error {
@@ -71,12 +132,15 @@ func (gen *Generator) GenerateBegin(expressions []Sexp) error {
 	return gen.Generate(expressions[size-1])
 }
 
+// buildSexpFun compiles a function. captured is the scope that
+// it is made in, if known.
 func buildSexpFun(
 	env *Zlisp,
 	name string,
 	funcargs *SexpArray,
 	funcbody []Sexp,
-	orig Sexp) (*SexpFunction, error) {
+	orig Sexp,
+	captured *lexScope) (*SexpFunction, error) {
 
 	defer func() { VPrintf("exiting buildSexpFun()\n") }()
 
@@ -90,7 +154,8 @@ func buildSexpFun(
 	}
 
 	afsHelper := &AddFuncScopeHelper{}
-	gen.AddInstruction(AddFuncScopeInstr{Name: "runtime " + gen.funcname, Helper: afsHelper})
+	gen.AddInstruction(AddFuncScopeInstr{Name: "runtime " + gen.funcname, Helper: afsHelper,
+		layout: gen.openScope(true, captured)})
 
 	argsyms := make([]*SexpSymbol, len(funcargs.Val))
 
@@ -117,7 +182,7 @@ func buildSexpFun(
 	VPrintf("\n in buildSexpFun(): DumpFunction just before %v args go onto stack\n",
 		len(argsyms))
 	if Working {
-		DumpFunction(ZlispFunction(gen.instructions), -1)
+		FdumpFunction(gen.env.Stdout, ZlispFunction(gen.instructions), -1)
 	}
 	for i := len(argsyms) - 1; i >= 0; i-- {
 		gen.AddInstruction(PopStackPutEnvInstr{argsyms[i]})
@@ -129,10 +194,9 @@ func buildSexpFun(
 
 	gen.AddInstruction(RemoveScopeInstr{})
 	gen.AddInstruction(ReturnInstr{nil})
+	gen.closeScope()
 
-	newfunc := ZlispFunction(gen.instructions)
-	sfun := gen.env.MakeFunction(gen.funcname, nargs,
-		varargs, newfunc, orig)
+	sfun := gen.makeFunction(gen.funcname, nargs, varargs, orig)
 
 	// tell the function scope where their function is, to
 	// provide access to the captured-closure scopes at runtime.
@@ -157,14 +221,14 @@ func (gen *Generator) GenerateFn(args []Sexp, orig Sexp) error {
 
 	VPrintf("GenerateFn() about to call buildSexpFun\n")
 	funcbody := args[1:]
-	sfun, err := buildSexpFun(gen.env, "", funcargs, funcbody, orig)
+	sfun, err := buildSexpFun(gen.env, "", funcargs, funcbody, orig, gen.lex)
 	if err != nil {
 		return err
 	}
 
 	VPrintf("in GenerateFn(): gen of sfun:\n")
 	if Working {
-		DumpFunction(sfun.fun, -1)
+		FdumpFunction(gen.env.Stdout, sfun.fun, -1)
 	}
 
 	gen.AddInstruction(CreateClosureInstr{sfun})
@@ -192,12 +256,18 @@ func (gen *Generator) GenerateDef(args []Sexp, opname string) error {
 		if err != nil {
 			return err
 		}
+		if done, err := gen.generateIncr(lhs, args[1], opname == "def"); done || err != nil {
+			return err
+		}
 		switch opname {
 		case "def":
 			instr = PopStackPutEnvInstr{lhs}
 		case "set":
 			Q("GenerateDef is doing set with UpdateInstr: lhs = '%s'", lhs.SexpString(nil))
 			instr = UpdateInstr{lhs}
+			if gen.lexical(lhs) {
+				instr = LexUpdateInstr{sym: lhs, addr: gen.lex.ref(lhs)}
+			}
 		default:
 			panic(fmt.Errorf("unknown opname '%s'", opname))
 		}
@@ -218,6 +288,48 @@ func (gen *Generator) GenerateDef(args []Sexp, opname string) error {
 	return nil
 }
 
+// generateIncr generates (set x (+ x n)) or (def x (+ x n)), and
+// the same with -, for n a number or a symbol, as an IncrInstr;
+// this is what ++, --, += and -= expand to. It reports false, and
+// generates nothing, for any other rhs.
+func (gen *Generator) generateIncr(lhs *SexpSymbol, rhs Sexp, def bool) (bool, error) {
+	if lhs.isDot || lhs.isSigil || lhs.colonTail {
+		return false, nil
+	}
+	call, isList := rhs.(*SexpPair)
+	if !isList {
+		return false, nil
+	}
+	arr, err := ListToArray(call)
+	if err != nil || len(arr) != 3 {
+		return false, nil
+	}
+	op, isSym := arr[0].(*SexpSymbol)
+	if !isSym || (op.name != "+" && op.name != "-") || !gen.env.isNumericBuiltin(op) ||
+		gen.env.HasMacro(op) {
+		return false, nil
+	}
+	if x, isSym := arr[1].(*SexpSymbol); !isSym || x.number != lhs.number {
+		return false, nil
+	}
+	switch arr[2].(type) {
+	case *SexpInt, *SexpFloat, *SexpSymbol:
+	default:
+		return false, nil
+	}
+
+	gen.Tail = false
+	if err := gen.Generate(arr[2]); err != nil {
+		return true, err
+	}
+	incr := IncrInstr{sym: lhs, op: op, def: def}
+	if gen.lexical(lhs) {
+		incr.addr = gen.lex.ref(lhs)
+	}
+	gen.AddInstruction(incr)
+	return true, nil
+}
+
 func (gen *Generator) GenerateDefn(args []Sexp, orig Sexp) error {
 	if len(args) < 3 {
 		return WrongNargs
@@ -251,14 +363,14 @@ func (gen *Generator) GenerateDefn(args []Sexp, orig Sexp) error {
 
 	VPrintf("GenerateDefn() about to call buildSexpFun\n")
 
-	sfun, err := buildSexpFun(gen.env, sym.name, funcargs, args[2:], orig)
+	sfun, err := buildSexpFun(gen.env, sym.name, funcargs, args[2:], orig, gen.lex)
 	if err != nil {
 		return err
 	}
 
 	VPrintf("in GenerateDefn(): gen of sfun:\n")
 	if Working {
-		DumpFunction(sfun.fun, -1)
+		FdumpFunction(gen.env.Stdout, sfun.fun, -1)
 	}
 
 	gen.AddInstruction(CreateClosureInstr{sfun})
@@ -300,18 +412,20 @@ func (gen *Generator) GenerateDefmac(args []Sexp, orig Sexp) error {
 			sym.name, xpr.SexpString(nil))
 	}
 
-	sfun, err := buildSexpFun(gen.env, sym.name, funcargs, args[2:], orig)
+	sfun, err := buildSexpFun(gen.env, sym.name, funcargs, args[2:], orig, nil)
 	if err != nil {
 		return err
 	}
 
-	gen.env.macros[sym.number] = sfun
+	gen.env.macros.set(sym.number, sfun)
+	gen.env.genDeps++
 	gen.AddInstruction(PushInstr{SexpNull})
 
 	return nil
 }
 
 func (gen *Generator) GenerateMacexpand(args []Sexp) error {
+	gen.env.genDeps++
 	if len(args) != 1 {
 		return WrongNargs
 	}
@@ -334,7 +448,7 @@ func (gen *Generator) GenerateMacexpand(args []Sexp) error {
 	if islist {
 		switch t := list.Head.(type) {
 		case *SexpSymbol:
-			macro, ismacrocall = gen.env.macros[t.number]
+			macro, ismacrocall = gen.env.macros.get(t.number)
 		default:
 			ismacrocall = false
 		}
@@ -371,18 +485,21 @@ func (gen *Generator) GenerateShortCircuit(or bool, args []Sexp) error {
 	subgen.scopes = gen.scopes
 	subgen.Tail = gen.Tail
 	subgen.funcname = gen.funcname
+	subgen.lex = gen.lex
 	subgen.Generate(args[size-1])
-	instructions := subgen.instructions
+	code := subgen.code()
 
 	for i := size - 2; i >= 0; i-- {
 		subgen = NewGenerator(gen.env)
+		subgen.lex = gen.lex
 		subgen.Generate(args[i])
 		subgen.AddInstruction(DupInstr(0))
-		subgen.AddInstruction(BranchInstr{or, len(instructions) + 2})
+		subgen.AddInstruction(BranchInstr{or, len(code.instr) + 2})
 		subgen.AddInstruction(PopInstr(0))
-		instructions = append(subgen.instructions, instructions...)
+		subgen.addCode(code)
+		code = subgen.code()
 	}
-	gen.AddInstructions(instructions)
+	gen.addCode(code)
 
 	return nil
 }
@@ -396,11 +513,12 @@ func (gen *Generator) GenerateCond(args []Sexp) error {
 	subgen.Tail = gen.Tail
 	subgen.scopes = gen.scopes
 	subgen.funcname = gen.funcname
+	subgen.lex = gen.lex
 	err := subgen.Generate(args[len(args)-1])
 	if err != nil {
 		return err
 	}
-	instructions := subgen.instructions
+	code := subgen.code()
 
 	// we generate the cond bottom up, so i counts down.
 	for i := len(args)/2 - 1; i >= 0; i-- {
@@ -409,7 +527,7 @@ func (gen *Generator) GenerateCond(args []Sexp) error {
 		if err != nil {
 			return err
 		}
-		pred_code := subgen.instructions
+		pred_code := subgen.code()
 
 		subgen.Reset()
 		subgen.Tail = gen.Tail
@@ -419,19 +537,19 @@ func (gen *Generator) GenerateCond(args []Sexp) error {
 		if err != nil {
 			return err
 		}
-		body_code := subgen.instructions
+		body_code := subgen.code()
 
 		subgen.Reset()
-		subgen.AddInstructions(pred_code)
-		subgen.AddInstruction(BranchInstr{false, len(body_code) + 2})
-		subgen.AddInstructions(body_code)
-		subgen.AddInstruction(JumpInstr{addpc: len(instructions) + 1})
-		subgen.AddInstructions(instructions)
+		subgen.addCode(pred_code)
+		subgen.AddInstruction(BranchInstr{false, len(body_code.instr) + 2})
+		subgen.addCode(body_code)
+		subgen.AddInstruction(JumpInstr{addpc: len(code.instr) + 1})
+		subgen.addCode(code)
 
-		instructions = subgen.instructions
+		code = subgen.code()
 	}
 
-	gen.AddInstructions(instructions)
+	gen.addCode(code)
 	return nil
 }
 
@@ -472,7 +590,7 @@ func (gen *Generator) GenerateLet(name string, args []Sexp) error {
 		rstatements = append(rstatements, bindings[2*i+1])
 	}
 
-	gen.AddInstruction(AddScopeInstr{Name: "runtime " + name})
+	gen.AddInstruction(AddScopeInstr{Name: "runtime " + name, layout: gen.openScope(false, nil)})
 	gen.scopes++
 
 	if name == "letseq" {
@@ -499,6 +617,7 @@ func (gen *Generator) GenerateLet(name string, args []Sexp) error {
 		return err
 	}
 	gen.AddInstruction(RemoveScopeInstr{})
+	gen.closeScope()
 	gen.scopes--
 
 	return nil
@@ -506,6 +625,9 @@ func (gen *Generator) GenerateLet(name string, args []Sexp) error {
 
 func (gen *Generator) GenerateAssert(args []Sexp) error {
 	if len(args) != 1 {
+		if name := splitAssertion(args); name != "" {
+			return fmt.Errorf("assert takes one argument; for the deftest assertion use %s", name)
+		}
 		return WrongNargs
 	}
 	err := gen.Generate(args[0])
@@ -521,7 +643,37 @@ func (gen *Generator) GenerateAssert(args []Sexp) error {
 	return nil
 }
 
+// splitAssertion names the deftest assertion that args, the
+// arguments of an assert, look to have been meant as. The lexer
+// reads assert= as (assert = ...) and assert-error as
+// (assert - error ...), which is why the assertions are named
+// assertEqual, assertError and assertMatch.
+func splitAssertion(args []Sexp) string {
+	if len(args) < 2 {
+		return ""
+	}
+	op, ok := args[0].(*SexpSymbol)
+	if !ok {
+		return ""
+	}
+	switch op.name {
+	case "=":
+		return "assertEqual"
+	case "-":
+		if word, ok := args[1].(*SexpSymbol); ok {
+			switch word.name {
+			case "error":
+				return "assertError"
+			case "match":
+				return "assertMatch"
+			}
+		}
+	}
+	return ""
+}
+
 func (gen *Generator) GenerateInclude(args []Sexp) error {
+	gen.env.genDeps++
 	if len(args) < 1 {
 		return WrongNargs
 	}
@@ -549,6 +701,9 @@ func (gen *Generator) GenerateInclude(args []Sexp) error {
 				expr = list.Tail
 			}
 		case *SexpStr:
+			if err := gen.env.checkRead("include", t.S); err != nil {
+				return err
+			}
 			exps, err = gen.env.ParseFile(t.S)
 			if err != nil {
 				return err
@@ -602,6 +757,10 @@ func (gen *Generator) GenerateCallBySymbol(sym *SexpSymbol, args []Sexp, orig Se
 		return gen.GenerateLet("letseq", args)
 	case "assert":
 		return gen.GenerateAssert(args)
+	case "deftest":
+		return gen.GenerateDeftest(args, orig)
+	case "assertError":
+		return gen.GenerateAssertError(args)
 	case "defmac":
 		return gen.GenerateDefmac(args, orig)
 	case "macexpand":
@@ -624,13 +783,18 @@ func (gen *Generator) GenerateCallBySymbol(sym *SexpSymbol, args []Sexp, orig Se
 		return gen.GeneratePackage(args)
 	case "return":
 		return gen.GenerateReturn(args)
+	case "try":
+		return gen.GenerateTry(args)
+	case "throw":
+		return gen.GenerateThrow(args)
 	case "_ls":
 		return gen.GenerateDebug("showScopes")
 	}
 
 	// this is where macros are run
-	macro, found := gen.env.macros[sym.number]
+	macro, found := gen.env.macros.get(sym.number)
 	if found {
+		gen.env.genDeps++
 		// calling Apply on the current environment will screw up
 		// the stack, creating a duplicate environment is safer
 		env := gen.env.Duplicate()
@@ -745,8 +909,17 @@ func (gen *Generator) Generate(expr Sexp) error {
 	if _, isComment := expr.(*SexpComment); isComment {
 		return nil
 	}
+	if pos := PosOf(expr); pos != nil {
+		outer := gen.pos
+		gen.pos = pos
+		defer func() { gen.pos = outer }()
+	}
 	switch e := expr.(type) {
 	case *SexpSymbol:
+		if gen.lexical(e) {
+			gen.AddInstruction(LexToStackInstr{sym: e, addr: gen.lex.ref(e)})
+			return nil
+		}
 		gen.AddInstruction(EnvToStackInstr{e})
 		return nil
 	case *SexpPair:
@@ -762,14 +935,14 @@ func (gen *Generator) Generate(expr Sexp) error {
 			if isAssign && pos > 0 && legalLeftHandSide {
 				err := gen.GenerateAssignment(e, pos)
 				if err != nil {
-					return fmt.Errorf("Error generating %s:\n%v",
+					return fmt.Errorf("Error generating %s:\n%w",
 						expr.SexpString(nil), err)
 				}
 				return nil
 			}
 			err := gen.GenerateCall(e)
 			if err != nil {
-				return fmt.Errorf("Error generating %s:\n%v",
+				return fmt.Errorf("Error generating %s:\n%w",
 					expr.SexpString(nil), err)
 			}
 			return nil
@@ -797,6 +970,7 @@ func (gen *Generator) GenerateAll(expressions []Sexp) error {
 
 func (gen *Generator) Reset() {
 	gen.instructions = make([]Instruction, 0)
+	gen.positions = nil
 	gen.Tail = false
 	gen.scopes = 0
 }
@@ -869,6 +1043,7 @@ func (gen *Generator) GenerateForLoop(args []Sexp) error {
 		}
 	}
 
+	loop.depth = gen.env.loopstack.Size()
 	gen.env.loopstack.Push(loop)
 	defer gen.env.loopstack.Pop()
 
@@ -882,7 +1057,8 @@ func (gen *Generator) GenerateForLoop(args []Sexp) error {
 	// loops use repeat the use variable i in an index and then
 	// end up clobering the parents loop index
 	// inadvertently.
-	gen.AddInstruction(AddScopeInstr{Name: "runtime " + loop.stmtname.name})
+	gen.AddInstruction(AddScopeInstr{Name: "runtime " + loop.stmtname.name,
+		layout: gen.openScope(false, nil)})
 	gen.AddInstruction(PushStackmarkInstr{sym: loop.stmtname})
 
 	// generate the body of the loop
@@ -890,6 +1066,7 @@ func (gen *Generator) GenerateForLoop(args []Sexp) error {
 	subgenBody.Tail = gen.Tail
 	subgenBody.scopes = gen.scopes
 	subgenBody.funcname = gen.funcname
+	subgenBody.lex = gen.lex
 	err = subgenBody.GenerateBegin(args[startgen:])
 	if err != nil {
 		return err
@@ -903,19 +1080,21 @@ func (gen *Generator) GenerateForLoop(args []Sexp) error {
 	subgenInit.Tail = gen.Tail
 	subgenInit.scopes = gen.scopes
 	subgenInit.funcname = gen.funcname
+	subgenInit.lex = gen.lex
 	err = subgenInit.Generate(controlargs.Val[0])
 	if err != nil {
 		return err
 	}
 	// insert pop so the stack remains clean
 	subgenInit.AddInstruction(PopUntilStackmarkInstr{sym: loop.stmtname})
-	init_code := subgenInit.instructions
+	init_code := subgenInit.code()
 
 	// generate the test
 	subgenT := NewGenerator(gen.env)
 	subgenT.Tail = gen.Tail
 	subgenT.scopes = gen.scopes
 	subgenT.funcname = gen.funcname
+	subgenT.lex = gen.lex
 
 	err = subgenT.Generate(controlargs.Val[1])
 	if err != nil {
@@ -923,33 +1102,34 @@ func (gen *Generator) GenerateForLoop(args []Sexp) error {
 	}
 	// need to leave value on stack to branch on
 	// so do not popuntil stackmark here!
-	test_code := subgenT.instructions
+	test_code := subgenT.code()
 
 	// generate the increment code
 	subgenIncr := NewGenerator(gen.env)
 	subgenIncr.Tail = gen.Tail
 	subgenIncr.scopes = gen.scopes
 	subgenIncr.funcname = gen.funcname
+	subgenIncr.lex = gen.lex
 
 	err = subgenIncr.Generate(controlargs.Val[2])
 	if err != nil {
 		return err
 	}
 	subgenIncr.AddInstruction(PopUntilStackmarkInstr{sym: loop.stmtname})
-	incr_code := subgenIncr.instructions
+	incr_code := subgenIncr.code()
 
 	exit_loop := len_body_code + 3
-	jump_to_test := len(incr_code) + 2
+	jump_to_test := len(incr_code.instr) + 2
 
 	gen.AddInstruction(LabelInstr{label: "start of init for " + loop.stmtname.name})
-	gen.AddInstructions(init_code)
+	gen.addCode(init_code)
 	gen.AddInstruction(JumpInstr{addpc: jump_to_test, where: "to-test"})
 	// top of loop starts with test_code: (continue) target.
 	continuePos := len(gen.instructions)
 	gen.AddInstruction(LabelInstr{label: "start of increment for " + loop.stmtname.name})
-	gen.AddInstructions(incr_code)
+	gen.addCode(incr_code)
 	gen.AddInstruction(LabelInstr{label: "start of test for " + loop.stmtname.name})
-	gen.AddInstructions(test_code)
+	gen.addCode(test_code)
 	gen.AddInstruction(BranchInstr{false, exit_loop})
 	bodyPos := len(gen.instructions)
 
@@ -961,7 +1141,7 @@ func (gen *Generator) GenerateForLoop(args []Sexp) error {
 	// the additional (negative) distance to startPos.
 
 	gen.AddInstruction(LabelInstr{label: "start of body for " + loop.stmtname.name})
-	gen.AddInstructions(subgenBody.instructions)
+	gen.addCode(subgenBody.code())
 	gen.AddInstruction(JumpInstr{addpc: continuePos - len(gen.instructions),
 		where: "to-continue-position-aka-increment"})
 	gen.AddInstruction(LabelInstr{label: "end of body for " + loop.stmtname.name})
@@ -971,6 +1151,7 @@ func (gen *Generator) GenerateForLoop(args []Sexp) error {
 	// cleanup
 	gen.AddInstruction(ClearStackmarkInstr{sym: loop.stmtname})
 	gen.AddInstruction(RemoveScopeInstr{})
+	gen.closeScope()
 	gen.AddInstruction(PushInstr{SexpNull}) // for is a statement; leave null on the stack.
 
 	loop.loopStart = startPos - bodyPos // offset; should be negative.
@@ -1291,6 +1472,9 @@ scanUpTheLoops:
 			labelsym.name, labelsym.name)
 	}
 
+	if err := gen.exitTries(loop); err != nil {
+		return err
+	}
 	myPos := len(gen.instructions)
 	VPrintf("\n debug GenerateContinue() : myPos =%d  loop=%#v\n", myPos, loop)
 	gen.AddInstruction(&ContinueInstr{loop: loop})
@@ -1361,6 +1545,9 @@ scanUpTheLoops:
 	}
 
 	VPrintf("\n debug GenerateBreak() : loop=%#v\n", loop)
+	if err := gen.exitTries(loop); err != nil {
+		return err
+	}
 	gen.AddInstruction(&BreakInstr{loop: loop})
 
 	return nil
@@ -1376,7 +1563,7 @@ func (gen *Generator) GenerateNewScope(expressions []Sexp) error {
 		//return NoExpressionsFound
 	}
 
-	gen.AddInstruction(AddScopeInstr{Name: "newScope"})
+	gen.AddInstruction(AddScopeInstr{Name: "newScope", layout: gen.openScope(false, nil)})
 	for _, expr := range expressions[:size-1] {
 		err := gen.Generate(expr)
 		if err != nil {
@@ -1392,6 +1579,7 @@ func (gen *Generator) GenerateNewScope(expressions []Sexp) error {
 		return err
 	}
 	gen.AddInstruction(RemoveScopeInstr{})
+	gen.closeScope()
 	return nil
 }
 
@@ -1419,9 +1607,15 @@ func (gen *Generator) GeneratePackage(expressions []Sexp) error {
 	oldtail := gen.Tail
 	gen.Tail = false
 
-	gen.AddInstruction(AddScopeInstr{Name: pkgName})
+	gen.AddInstruction(AddScopeInstr{Name: pkgName, Package: true})
 	gen.AddInstruction(PushStackmarkInstr{sym: symPkgName})
 
+	// a package's scope outlives its code, and is looked in by
+	// name; so is all that it encloses.
+	lex := gen.lex
+	gen.lex = nil
+	defer func() { gen.lex = lex }()
+
 	if size > 1 {
 		for _, expr := range expressions[1 : size-1] {
 			err := gen.Generate(expr)
@@ -0,0 +1,583 @@
+package zcore
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// call Go functions from zygo, converting arguments and results by reflection.
+
+var sexpType = reflect.TypeOf((*Sexp)(nil)).Elem()
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+var timeType = reflect.TypeOf(time.Time{})
+
+// basicTypes are the types FromGoValue converts values of
+// each basic kind to, for GoToSexp.
+var basicTypes = map[reflect.Kind]reflect.Type{
+	reflect.Int:     reflect.TypeOf(int(0)),
+	reflect.Int8:    reflect.TypeOf(int8(0)),
+	reflect.Int16:   reflect.TypeOf(int16(0)),
+	reflect.Int32:   reflect.TypeOf(int32(0)),
+	reflect.Int64:   reflect.TypeOf(int64(0)),
+	reflect.Uint:    reflect.TypeOf(uint(0)),
+	reflect.Uint8:   reflect.TypeOf(uint8(0)),
+	reflect.Uint16:  reflect.TypeOf(uint16(0)),
+	reflect.Uint32:  reflect.TypeOf(uint32(0)),
+	reflect.Uint64:  reflect.TypeOf(uint64(0)),
+	reflect.Uintptr: reflect.TypeOf(uintptr(0)),
+	reflect.Float32: reflect.TypeOf(float32(0)),
+	reflect.Float64: reflect.TypeOf(float64(0)),
+	reflect.String:  reflect.TypeOf(""),
+	reflect.Bool:    reflect.TypeOf(false),
+}
+
+// RegisterGoFunc makes the Go function fn callable from scripts
+// as name. Arguments are converted from Sexp to fn's parameter
+// types (see ToGoValue), and results back to Sexp (see
+// FromGoValue). If fn's last result is an error, a non-nil
+// error becomes a script error. Several other results are
+// returned as an array.
+func (env *Zlisp) RegisterGoFunc(name string, fn interface{}) error {
+	userfun, err := WrapGoFunc(fn)
+	if err != nil {
+		return fmt.Errorf("RegisterGoFunc '%s': %s", name, err)
+	}
+	env.AddFunction(name, userfun)
+	return nil
+}
+
+// WrapGoFunc returns a ZlispUserFunction that calls fn by reflection.
+// RegisterGoFunc is the usual way to use it.
+func WrapGoFunc(fn interface{}) (ZlispUserFunction, error) {
+	fnVa := reflect.ValueOf(fn)
+	if fnVa.Kind() != reflect.Func || fnVa.IsNil() {
+		return nil, fmt.Errorf("expected a func, got %T", fn)
+	}
+	fnTyp := fnVa.Type()
+	nin := fnTyp.NumIn()
+	variadic := fnTyp.IsVariadic()
+	nout := fnTyp.NumOut()
+	hasErr := nout > 0 && fnTyp.Out(nout-1) == errorType
+
+	return func(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+		if variadic {
+			if len(args) < nin-1 {
+				return SexpNull, WrongNargs
+			}
+		} else if len(args) != nin {
+			return SexpNull, WrongNargs
+		}
+
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			var typ reflect.Type
+			if variadic && i >= nin-1 {
+				typ = fnTyp.In(nin - 1).Elem()
+			} else {
+				typ = fnTyp.In(i)
+			}
+			va, err := env.ToGoValue(arg, typ)
+			if err != nil {
+				return SexpNull, fmt.Errorf("argument %d of %s: %s", i, name, err)
+			}
+			in[i] = va
+		}
+
+		out := fnVa.Call(in)
+
+		if hasErr {
+			if e := out[nout-1]; !e.IsNil() {
+				return SexpNull, e.Interface().(error)
+			}
+			out = out[:nout-1]
+		}
+		switch len(out) {
+		case 0:
+			return SexpNull, nil
+		case 1:
+			return env.FromGoValue(out[0])
+		}
+		res := make([]Sexp, len(out))
+		for i := range out {
+			sx, err := env.FromGoValue(out[i])
+			if err != nil {
+				return SexpNull, err
+			}
+			res[i] = sx
+		}
+		return env.NewSexpArray(res), nil
+	}, nil
+}
+
+// copyAtom returns a copy of sx if it is an atom, else sx.
+func copyAtom(sx Sexp) Sexp {
+	switch x := sx.(type) {
+	case *SexpInt:
+		cp := *x
+		return &cp
+	case *SexpUint64:
+		cp := *x
+		return &cp
+	case *SexpFloat:
+		cp := *x
+		return &cp
+	case *SexpChar:
+		cp := *x
+		return &cp
+	case *SexpStr:
+		cp := *x
+		return &cp
+	case *SexpBool:
+		cp := *x
+		return &cp
+	}
+	return sx
+}
+
+// ToGoValue converts sx to a Go value of type typ. Ints and uints
+// of all widths, floats, strings and bools are converted by
+// SexpToGo, then checked to fit typ. Also handled are []byte,
+// slices and arrays, maps, registered structs (and pointers to
+// them) via SexpToGoStructs, script functions via MakeGoFunc,
+// Sexp itself, and interface{} via SexpToGo.
+//
+// A Sexp passed as itself is passed by reference, as scripts pass
+// it, so a function may change an array or hash it is given, as
+// may one given the Go value in a *SexpReflect. Atoms (numbers,
+// chars, strings and bools) are copied first, as they may be
+// shared: by MakeInt, or as constants in compiled code.
+func (env *Zlisp) ToGoValue(sx Sexp, typ reflect.Type) (va reflect.Value, err error) {
+	// SexpToGo and SexpToGoStructs report problems by panicking.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("cannot convert %s to %s: %v", sx.SexpString(nil), typ, r)
+		}
+	}()
+
+	if r, ok := sx.(*SexpReflect); ok && r.Val.Type().AssignableTo(typ) {
+		return r.Val, nil
+	}
+	// functions and other values without a Go counterpart
+	// may be passed through as themselves.
+	if typ.Kind() != reflect.Interface || typ.NumMethod() != 0 {
+		if reflect.TypeOf(sx).AssignableTo(typ) {
+			return reflect.ValueOf(copyAtom(sx)), nil
+		}
+	}
+	mismatch := func() (reflect.Value, error) {
+		return reflect.Value{}, fmt.Errorf("cannot convert %T (%s) to %s",
+			sx, sx.SexpString(nil), typ)
+	}
+	if sx == SexpNull {
+		switch typ.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map, reflect.Func:
+			return reflect.Zero(typ), nil
+		}
+	}
+
+	va = reflect.New(typ).Elem()
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		switch x := SexpToGo(sx, env, nil).(type) {
+		case int64:
+			n = x
+		case rune:
+			n = int64(x)
+		case uint64:
+			if x > math.MaxInt64 {
+				return reflect.Value{}, fmt.Errorf("%d overflows %s", x, typ)
+			}
+			n = int64(x)
+		default:
+			return mismatch()
+		}
+		if va.OverflowInt(n) {
+			return reflect.Value{}, fmt.Errorf("%d overflows %s", n, typ)
+		}
+		va.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var n uint64
+		switch x := SexpToGo(sx, env, nil).(type) {
+		case int64:
+			if x < 0 {
+				return reflect.Value{}, fmt.Errorf("%d is negative, cannot be %s", x, typ)
+			}
+			n = uint64(x)
+		case uint64:
+			n = x
+		case rune:
+			n = uint64(x)
+		default:
+			return mismatch()
+		}
+		if va.OverflowUint(n) {
+			return reflect.Value{}, fmt.Errorf("%d overflows %s", n, typ)
+		}
+		va.SetUint(n)
+
+	case reflect.Float32, reflect.Float64:
+		switch x := SexpToGo(sx, env, nil).(type) {
+		case float64:
+			va.SetFloat(x)
+		case int64:
+			va.SetFloat(float64(x))
+		case uint64:
+			va.SetFloat(float64(x))
+		default:
+			return mismatch()
+		}
+
+	case reflect.String:
+		switch x := SexpToGo(sx, env, nil).(type) {
+		case string:
+			va.SetString(x)
+		case []byte:
+			va.SetString(string(x))
+		default:
+			return mismatch()
+		}
+
+	case reflect.Bool:
+		x, ok := SexpToGo(sx, env, nil).(bool)
+		if !ok {
+			return mismatch()
+		}
+		va.SetBool(x)
+
+	case reflect.Slice, reflect.Array:
+		var elems []Sexp
+		switch x := sx.(type) {
+		case *SexpRaw:
+			if typ.Elem().Kind() != reflect.Uint8 {
+				return mismatch()
+			}
+			elems = make([]Sexp, len(x.Val))
+			for i, b := range x.Val {
+				elems[i] = &SexpInt{Val: int64(b)}
+			}
+		case *SexpStr:
+			if typ.Elem().Kind() != reflect.Uint8 {
+				return mismatch()
+			}
+			elems = make([]Sexp, len(x.S))
+			for i := 0; i < len(x.S); i++ {
+				elems[i] = &SexpInt{Val: int64(x.S[i])}
+			}
+		case *SexpArray:
+			elems = x.Val
+		case *SexpPair:
+			elems, err = ListToArray(x)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+		default:
+			return mismatch()
+		}
+		if typ.Kind() == reflect.Array {
+			if len(elems) != typ.Len() {
+				return reflect.Value{}, fmt.Errorf("need %d elements for %s, have %d",
+					typ.Len(), typ, len(elems))
+			}
+		} else {
+			va = reflect.MakeSlice(typ, len(elems), len(elems))
+		}
+		for i, ele := range elems {
+			ev, err := env.ToGoValue(ele, typ.Elem())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			va.Index(i).Set(ev)
+		}
+
+	case reflect.Map:
+		h, ok := sx.(*SexpHash)
+		if !ok {
+			return mismatch()
+		}
+		va = reflect.MakeMap(typ)
+		for _, k := range h.KeyOrder {
+			v, err := h.HashGet(env, k)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			kv, err := env.ToGoValue(k, typ.Key())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			vv, err := env.ToGoValue(v, typ.Elem())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			va.SetMapIndex(kv, vv)
+		}
+
+	case reflect.Struct, reflect.Ptr:
+		if typ == timeType {
+			tm, ok := SexpToGo(sx, env, nil).(time.Time)
+			if !ok {
+				return mismatch()
+			}
+			return reflect.ValueOf(tm), nil
+		}
+		h, ok := sx.(*SexpHash)
+		if !ok {
+			return mismatch()
+		}
+		if h.TypeName == "hash" {
+			return mismatch()
+		}
+		target := reflect.New(typ)
+		_, err := SexpToGoStructs(h, target.Interface(), env, nil)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		va = target.Elem()
+
+	case reflect.Interface:
+		if typ.NumMethod() != 0 {
+			// e.g. a record whose Go struct implements the interface.
+			h, ok := sx.(*SexpHash)
+			if !ok {
+				return mismatch()
+			}
+			target := reflect.New(typ)
+			_, err := SexpToGoStructs(h, target.Interface(), env, nil)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			return target.Elem(), nil
+		}
+		iface := SexpToGo(sx, env, nil)
+		if iface == nil {
+			return reflect.Zero(typ), nil
+		}
+		va = reflect.ValueOf(iface)
+
+	case reflect.Func:
+		f, ok := sx.(*SexpFunction)
+		if !ok {
+			return mismatch()
+		}
+		return makeGoFunc(env, f, typ), nil
+
+	default:
+		return mismatch()
+	}
+	return va, nil
+}
+
+// FromGoValue converts a Go value to a Sexp, the reverse of
+// ToGoValue. Values of the basic kinds, and times, are converted
+// by GoToSexp. Registered structs become records; values of
+// unregistered types are wrapped in a *SexpReflect.
+func (env *Zlisp) FromGoValue(va reflect.Value) (Sexp, error) {
+	if !va.IsValid() {
+		return SexpNull, nil
+	}
+	if va.Type().Implements(sexpType) {
+		if va.IsNil() {
+			return SexpNull, nil
+		}
+		return va.Interface().(Sexp), nil
+	}
+	if va.Type().Implements(errorType) && va.Kind() != reflect.Struct {
+		if va.IsNil() {
+			return SexpNull, nil
+		}
+		return &SexpError{va.Interface().(error)}, nil
+	}
+
+	switch va.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.String, reflect.Bool:
+		// as its basic type, so that named types convert too.
+		return GoToSexp(va.Convert(basicTypes[va.Kind()]).Interface(), env)
+
+	case reflect.Slice, reflect.Array:
+		if va.Kind() == reflect.Slice && va.IsNil() {
+			return SexpNull, nil
+		}
+		if va.Type().Elem().Kind() == reflect.Uint8 {
+			by := make([]byte, va.Len())
+			reflect.Copy(reflect.ValueOf(by), va)
+			return &SexpRaw{Val: by}, nil
+		}
+		if err := env.chargeAlloc(va.Len()); err != nil {
+			return SexpNull, err
+		}
+		arr := make([]Sexp, va.Len())
+		for i := range arr {
+			sx, err := env.FromGoValue(va.Index(i))
+			if err != nil {
+				return SexpNull, err
+			}
+			arr[i] = sx
+		}
+		return env.NewSexpArray(arr), nil
+
+	case reflect.Map:
+		if va.IsNil() {
+			return SexpNull, nil
+		}
+		if m, ok := va.Interface().(map[string]interface{}); ok {
+			return GoToSexp(m, env)
+		}
+		pairs := make([]Sexp, 0, 2*va.Len())
+		iter := va.MapRange()
+		for iter.Next() {
+			var k Sexp
+			if iter.Key().Kind() == reflect.String {
+				k = env.MakeSymbol(iter.Key().String())
+			} else {
+				var err error
+				k, err = env.FromGoValue(iter.Key())
+				if err != nil {
+					return SexpNull, err
+				}
+			}
+			v, err := env.FromGoValue(iter.Value())
+			if err != nil {
+				return SexpNull, err
+			}
+			pairs = append(pairs, k, v)
+		}
+		return MakeHash(pairs, "hash", env)
+
+	case reflect.Interface:
+		if va.IsNil() {
+			return SexpNull, nil
+		}
+		return env.FromGoValue(va.Elem())
+
+	case reflect.Struct:
+		if va.Type() == timeType {
+			return GoToSexp(va.Interface(), env)
+		}
+		// registered types are made by their factories as *T.
+		ptr := reflect.New(va.Type())
+		ptr.Elem().Set(va)
+		if rt := registeredTypeFor(ptr.Type()); rt != nil {
+			return goStructToRecord(env, rt, ptr.Interface())
+		}
+
+	case reflect.Ptr:
+		if va.IsNil() {
+			return SexpNull, nil
+		}
+		if rt := registeredTypeFor(va.Type()); rt != nil {
+			return goStructToRecord(env, rt, va.Interface())
+		}
+	}
+	return &SexpReflect{Val: va}, nil
+}
+
+// registeredTypeFor finds the GoStructRegistry entry whose
+// factory makes values of type typ, if any.
+func registeredTypeFor(typ reflect.Type) *RegisteredType {
+	for _, rt := range GoStructRegistry.Snapshot(GoStructRegistry.Registry) {
+		if rt.hasShadowStruct && rt.TypeCache == typ {
+			return rt
+		}
+	}
+	return nil
+}
+
+func goStructToRecord(env *Zlisp, rt *RegisteredType, ptr interface{}) (Sexp, error) {
+	h, err := MakeHash([]Sexp{}, rt.RegisteredName, env)
+	if err != nil {
+		return SexpNull, err
+	}
+	err = h.FillHashFromShadow(env, ptr)
+	if err != nil {
+		return SexpNull, err
+	}
+	return h, nil
+}
+
+// MakeGoFunc wraps the script function fun in a Go func of type
+// typ, for handing to Go APIs that take callbacks. Arguments are
+// converted with FromGoValue and results with ToGoValue; a script
+// returning several results should return them as an array.
+//
+// Each call runs on its own Duplicate of env, so the func may be
+// called from any goroutine. Closures still see the variables
+// they captured. If typ's last result is an error, script errors
+// are returned there; otherwise the func panics with them.
+func MakeGoFunc(env *Zlisp, fun *SexpFunction, typ reflect.Type) (interface{}, error) {
+	if typ.Kind() != reflect.Func {
+		return nil, fmt.Errorf("MakeGoFunc needs a func type, got %s", typ)
+	}
+	return makeGoFunc(env, fun, typ).Interface(), nil
+}
+
+// MakeGoFuncAs is MakeGoFunc for a func type F known at compile
+// time, e.g. MakeGoFuncAs[func(a, b int) bool](env, less).
+func MakeGoFuncAs[F any](env *Zlisp, fun *SexpFunction) (F, error) {
+	var f F
+	gf, err := MakeGoFunc(env, fun, reflect.TypeOf(&f).Elem())
+	if err != nil {
+		return f, err
+	}
+	return gf.(F), nil
+}
+
+func makeGoFunc(env *Zlisp, fun *SexpFunction, typ reflect.Type) reflect.Value {
+	nout := typ.NumOut()
+	hasErr := nout > 0 && typ.Out(nout-1) == errorType
+	nres := nout
+	if hasErr {
+		nres--
+	}
+
+	return reflect.MakeFunc(typ, func(in []reflect.Value) []reflect.Value {
+		out := make([]reflect.Value, nout)
+		for i := range out {
+			out[i] = reflect.Zero(typ.Out(i))
+		}
+		fail := func(err error) []reflect.Value {
+			if !hasErr {
+				panic(err)
+			}
+			out[nout-1] = reflect.ValueOf(&err).Elem()
+			return out
+		}
+
+		callenv := env.Duplicate()
+		args := make([]Sexp, len(in))
+		for i, va := range in {
+			sx, err := callenv.FromGoValue(va)
+			if err != nil {
+				return fail(fmt.Errorf("argument %d of %s: %s", i, fun.name, err))
+			}
+			args[i] = sx
+		}
+		res, err := callenv.Apply(fun, args)
+		if err != nil {
+			return fail(err)
+		}
+
+		results := []Sexp{res}
+		if nres > 1 {
+			arr, ok := res.(*SexpArray)
+			if !ok || len(arr.Val) != nres {
+				return fail(fmt.Errorf("%s should return an array of %d results, got %s",
+					fun.name, nres, res.SexpString(nil)))
+			}
+			results = arr.Val
+		}
+		for i := 0; i < nres; i++ {
+			va, err := callenv.ToGoValue(results[i], typ.Out(i))
+			if err != nil {
+				return fail(fmt.Errorf("result %d of %s: %s", i, fun.name, err))
+			}
+			// MakeFunc insists on exact types, e.g. Sexp rather than *SexpInt.
+			out[i] = va.Convert(typ.Out(i))
+		}
+		return out
+	})
+}
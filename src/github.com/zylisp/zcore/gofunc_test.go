@@ -0,0 +1,211 @@
+package zcore
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+type celsius float64
+
+func Test450RegisterGoFuncConvertsArgsAndResults(t *testing.T) {
+
+	cv.Convey(`Given plain Go functions registered with RegisterGoFunc, scripts should be able to call them with arguments and results converted automatically, and a trailing non-nil error should become a script error`, t, func() {
+
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		PanicOn(env.RegisterGoFunc("addSmall", func(a int8, b uint16) int64 {
+			return int64(a) + int64(b)
+		}))
+		PanicOn(env.RegisterGoFunc("half", func(x float32) float64 {
+			return float64(x) / 2
+		}))
+		PanicOn(env.RegisterGoFunc("shout", func(s string, loud bool) string {
+			if loud {
+				return strings.ToUpper(s)
+			}
+			return s
+		}))
+		PanicOn(env.RegisterGoFunc("total", func(xs []int) int {
+			t := 0
+			for _, x := range xs {
+				t += x
+			}
+			return t
+		}))
+		PanicOn(env.RegisterGoFunc("sumVals", func(m map[string]int) int {
+			t := 0
+			for _, v := range m {
+				t += v
+			}
+			return t
+		}))
+		PanicOn(env.RegisterGoFunc("sumAll", func(base int, more ...int) int {
+			for _, x := range more {
+				base += x
+			}
+			return base
+		}))
+		PanicOn(env.RegisterGoFunc("nick", func(h *Hornet) string {
+			return h.Nickname
+		}))
+		PanicOn(env.RegisterGoFunc("mkHornet", func(name string) *Hornet {
+			return &Hornet{Nickname: name, Mass: 1.5}
+		}))
+		PanicOn(env.RegisterGoFunc("evens", func(n int) []int {
+			var r []int
+			for i := 0; i < n; i++ {
+				r = append(r, 2*i)
+			}
+			return r
+		}))
+		PanicOn(env.RegisterGoFunc("divide", func(a, b int) (int, error) {
+			if b == 0 {
+				return 0, fmt.Errorf("divide by zero")
+			}
+			return a / b, nil
+		}))
+		PanicOn(env.RegisterGoFunc("maxUint", func() uint {
+			return ^uint(0)
+		}))
+		PanicOn(env.RegisterGoFunc("isMaxUint", func(u uint64) bool {
+			return u == math.MaxUint64
+		}))
+		PanicOn(env.RegisterGoFunc("freezing", func() celsius {
+			return 0.5
+		}))
+		PanicOn(env.RegisterGoFunc("hourLater", func(t time.Time) time.Time {
+			return t.Add(time.Hour)
+		}))
+		PanicOn(env.RegisterGoFunc("clobber", func(x *SexpInt, y Sexp) Sexp {
+			x.Val = 99
+			y.(*SexpInt).Val = 99
+			return x
+		}))
+		PanicOn(env.RegisterGoFunc("clobberStr", func(s *SexpStr) string {
+			was := s.S
+			s.S = "gone"
+			return was
+		}))
+		PanicOn(env.RegisterGoFunc("pushOne", func(arr *SexpArray) {
+			arr.Val = append(arr.Val, MakeInt(1))
+		}))
+
+		check := func(script string, expect string) {
+			env.Clear()
+			res, err := env.EvalString(script)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(res.SexpString(nil), cv.ShouldEqual, expect)
+		}
+		fails := func(script string, msg string) {
+			env.Clear()
+			_, err := env.EvalString(script)
+			cv.So(err, cv.ShouldNotBeNil)
+			cv.So(err.Error(), cv.ShouldContainSubstring, msg)
+		}
+
+		check(`(addSmall -3 300)`, `297`)
+		check(`(half 3.0)`, `1.5`)
+		check(`(shout "hi" true)`, `"HI"`)
+		check(`(total [1 2 3])`, `6`)
+		check(`(sumVals (hash a:1 b:2))`, `3`)
+		check(`(sumAll 1)`, `1`)
+		check(`(sumAll 1 2 3 4)`, `10`)
+		check(`(nick (hornet Nickname:"buzz"))`, `"buzz"`)
+		check(`(:Nickname (mkHornet "zip"))`, `"zip"`)
+		check(`(evens 3)`, `[0 2 4]`)
+		check(`(divide 7 2)`, `3`)
+		check(`(isMaxUint (maxUint))`, `true`)
+		check(`(freezing)`, `0.5`)
+		check(`(type? (hourLater (hourLater (now))))`, `"time.Time"`)
+		// the shared small ints are not the function's to change.
+		check(`(def k (+ 1 2)) [(clobber k k) k (+ 1 2)]`, `[99 3 3]`)
+		cv.So(MakeInt(3).Val, cv.ShouldEqual, 3)
+		// nor are the constants of compiled code.
+		check(`(defn lit [] (clobberStr "kept")) [(lit) (lit)]`, `["kept" "kept"]`)
+		check(`(defn lit2 [] (def s "kept") (clobberStr s) s) (lit2)`, `"kept"`)
+		// while arrays and hashes are shared, as in scripts.
+		check(`(def arr [0]) (pushOne arr) (len arr)`, `2`)
+
+		fails(`(divide 1 0)`, "divide by zero")
+		fails(`(addSmall 200 1)`, "overflows")
+		fails(`(addSmall 1 -1)`, "negative")
+		fails(`(shout "hi")`, "wrong number of arguments")
+		fails(`(total "nope")`, "cannot convert")
+		fails(`(addSmall (maxUint) 1)`, "overflows")
+	})
+}
+
+func Test452ScriptClosuresAsGoFuncs(t *testing.T) {
+
+	cv.Convey(`Given script closures, MakeGoFunc and MakeGoFuncAs should give real Go funcs that convert arguments and results, keep closure captures, report script errors, and may be called from many goroutines at once`, t, func() {
+
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		PanicOn(env.RegisterGoFunc("sortInts", func(xs []int, less func(a, b int) bool) []int {
+			sort.Slice(xs, func(i, j int) bool { return less(xs[i], xs[j]) })
+			return xs
+		}))
+		res, err := env.EvalString(`(sortInts [3 1 2] (fn [a b] (> a b)))`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `[3 2 1]`)
+
+		_, err = env.EvalString(`
+(defn adder [k] (fn [x] (+ x k)))
+(def add10 (adder 10))
+(defn lenBang [s] [(len s) (concat s "!")])
+(defn nope [x] (error "nope"))
+`)
+		cv.So(err, cv.ShouldBeNil)
+		lookup := func(name string) *SexpFunction {
+			f, err := env.LookupFunction(name)
+			PanicOn(err)
+			return f
+		}
+
+		add10, err := MakeGoFuncAs[func(int) int](env, lookup("add10"))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(add10(5), cv.ShouldEqual, 15)
+
+		split, err := MakeGoFuncAs[func(string) (int, string)](env, lookup("lenBang"))
+		cv.So(err, cv.ShouldBeNil)
+		n, s := split("abc")
+		cv.So(n, cv.ShouldEqual, 3)
+		cv.So(s, cv.ShouldEqual, "abc!")
+
+		withErr, err := MakeGoFuncAs[func(int) (int, error)](env, lookup("nope"))
+		cv.So(err, cv.ShouldBeNil)
+		_, err = withErr(1)
+		cv.So(err, cv.ShouldNotBeNil)
+
+		_, err = MakeGoFunc(env, lookup("add10"), reflect.TypeOf(0))
+		cv.So(err, cv.ShouldNotBeNil)
+
+		var wg sync.WaitGroup
+		sums := make([]int, 20)
+		for g := range sums {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					sums[g] += add10(i)
+				}
+			}(g)
+		}
+		wg.Wait()
+		for _, sum := range sums {
+			cv.So(sum, cv.ShouldEqual, 50*10+49*50/2)
+		}
+	})
+}
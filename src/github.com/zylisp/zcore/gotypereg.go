@@ -3,6 +3,7 @@ package zcore
 import (
 	"fmt"
 	"reflect"
+	"sync"
 	"time"
 )
 
@@ -38,6 +39,11 @@ type GoStructRegistryType struct {
 
 	// later, user-defined types
 	Userdef map[string]*RegisteredType
+
+	// mu guards the three maps above and ListRegisteredTypes, since
+	// scripts running in (go ...) blocks may register new types.
+	// Prefer Lookup and Snapshot to touching the maps directly.
+	mu sync.RWMutex
 }
 
 // consistently ordered list of all registered types (created at init time).
@@ -65,6 +71,8 @@ func (r *GoStructRegistryType) register(name string, e *RegisteredType, isUser b
 	if !e.initDone {
 		e.Init()
 	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	e.RegisteredName = name
 	e.Aliases[name] = true
 	e.Aliases[e.ReflectName] = true
@@ -137,9 +145,24 @@ func (r *GoStructRegistryType) RegisterUserdef(
 }
 
 func (r *GoStructRegistryType) Lookup(name string) *RegisteredType {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.Registry[name]
 }
 
+// Snapshot returns a copy of m (one of Registry, Builtin or
+// Userdef) that is safe to range over while other goroutines
+// register types.
+func (r *GoStructRegistryType) Snapshot(m map[string]*RegisteredType) map[string]*RegisteredType {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cp := make(map[string]*RegisteredType, len(m))
+	for k, v := range m {
+		cp[k] = v
+	}
+	return cp
+}
+
 // the type of all maker functions
 
 type MakeGoStructFunc func(env *Zlisp, h *SexpHash) (interface{}, error)
@@ -367,7 +390,9 @@ func TypeListFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	if narg != 0 {
 		return SexpNull, WrongNargs
 	}
+	GoStructRegistry.mu.RLock()
 	r := ListRegisteredTypes
+	GoStructRegistry.mu.RUnlock()
 	s := make([]Sexp, len(r))
 	for i := range r {
 		s[i] = &SexpStr{S: r[i]}
@@ -376,11 +401,11 @@ func TypeListFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 }
 
 func (env *Zlisp) ImportBaseTypes() {
-	for _, e := range GoStructRegistry.Builtin {
+	for _, e := range GoStructRegistry.Snapshot(GoStructRegistry.Builtin) {
 		env.AddGlobal(e.RegisteredName, e)
 	}
 
-	for _, e := range GoStructRegistry.Userdef {
+	for _, e := range GoStructRegistry.Snapshot(GoStructRegistry.Userdef) {
 		env.AddGlobal(e.RegisteredName, e)
 	}
 }
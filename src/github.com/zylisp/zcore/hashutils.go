@@ -140,8 +140,9 @@ func MakeHash(args []Sexp, typename string, env *Zlisp) (*SexpHash, error) {
 		k++
 	}
 
-	//Q("doing factory, foundRecordType := GoStructRegistry.Registry[typename]")
-	factoryShad, foundRecordType := GoStructRegistry.Registry[typename]
+	//Q("doing factoryShad := GoStructRegistry.Lookup(typename)")
+	factoryShad := GoStructRegistry.Lookup(typename)
+	foundRecordType := factoryShad != nil
 	if foundRecordType {
 		//Q("factoryShad = '%#v' for typename='%s'\n", factoryShad, typename)
 		if factoryShad.hasShadowStruct {
@@ -363,6 +364,9 @@ func (hash *SexpHash) HashSet(key Sexp, val Sexp) error {
 	arr, ok := hash.Map[hashval]
 
 	if !ok {
+		if err := hash.Env.chargeAlloc(1); err != nil {
+			return err
+		}
 		hash.Map[hashval] = []*SexpPair{Cons(key, val)}
 		hash.KeyOrder = append(hash.KeyOrder, key)
 		hash.NumKeys++
@@ -651,7 +655,11 @@ func (h *SexpHash) FillHashFromShadow(env *Zlisp, src interface{}) error {
 
 	for i, det := range h.DetOrder {
 		Q("\n looking at det for %s; %v-th entry in h.DetOrder\n", det.FieldJsonTag, i)
-		goField := vaSrc.Field(det.FieldNum)
+		// drill down through any embedded structs to the field.
+		goField := vaSrc
+		for _, p := range det.EmbedPath {
+			goField = goField.Field(p.ChildFieldNum)
+		}
 		val, err := fillHashHelper(goField.Interface(), 0, env, false)
 		if err != nil {
 			Q("got err='%s' back from fillHashhelper", err)
@@ -672,11 +680,15 @@ func (h *SexpHash) FillHashFromShadow(env *Zlisp, src interface{}) error {
 // for all Go structs
 func fillHashHelper(r interface{}, depth int, env *Zlisp, preferSym bool) (Sexp, error) {
 	Q("fillHashHelper() at depth %d, decoded type is %T\n", depth, r)
+	if r == nil {
+		// e.g. a nil interface field
+		return SexpNull, nil
+	}
 
 	// check for one of our registered structs
 
 	// go through the type registry upfront
-	for hashName, factory := range GoStructRegistry.Registry {
+	for hashName, factory := range GoStructRegistry.Snapshot(GoStructRegistry.Registry) {
 		//P("fillHashHelper is trying hashName='%s'", hashName)
 		st, err := factory.Factory(env, nil)
 		if err != nil {
@@ -892,7 +904,7 @@ func (hash *SexpHash) SexpString(ps *PrintState) string {
 }
 
 func (r *SexpHash) Type() *RegisteredType {
-	return GoStructRegistry.Registry[r.TypeName]
+	return GoStructRegistry.Lookup(r.TypeName)
 }
 
 func compareHash(a *SexpHash, bs Sexp) (int, error) {
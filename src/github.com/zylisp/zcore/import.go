@@ -5,6 +5,9 @@ import (
 )
 
 // ImportPackageBuilder: import a package, analagous to Golang.
+// The path may be a file, or a logical name such as "util/strings"
+// to find under the module path (see SetModulePath). Each package
+// is sourced once; importing it again gives the same package.
 func ImportPackageBuilder(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	//P("starting ImportPackageBuilder")
 	n := len(args)
@@ -37,20 +40,19 @@ func ImportPackageBuilder(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	default:
 		return SexpNull, fmt.Errorf("import error: path argument must be string")
 	}
-	if !FileExists(pth) {
-		return SexpNull, fmt.Errorf("import error: path '%s' does not exist", pth)
-	}
-
-	pkg, err := SourceFileFunction(env, "source", []Sexp{path})
+	file, err := env.resolveModule(pth)
 	if err != nil {
-		return SexpNull, fmt.Errorf("import error: attempt to import path '%s' resulted in: '%s'", pth, err)
+		return SexpNull, fmt.Errorf("import error: %s", err)
+	}
+	if err := env.checkRead(name, file); err != nil {
+		return SexpNull, err
 	}
-	//P("pkg = '%#v'", pkg)
 
-	asPkg, isPkg := pkg.(*Stack)
-	if !isPkg || !asPkg.IsPackage {
-		return SexpNull, fmt.Errorf("import error: attempt to import path '%s' resulted value that was not a package, but rather '%T'", pth, pkg)
+	asPkg, err := env.importModule(file)
+	if err != nil {
+		return SexpNull, fmt.Errorf("import error: attempt to import path '%s' resulted in: %w", pth, err)
 	}
+	//P("pkg = '%#v'", asPkg)
 
 	if n == 1 {
 		alias = asPkg.PackageName
@@ -63,5 +65,5 @@ func ImportPackageBuilder(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 		return SexpNull, err
 	}
 
-	return pkg, nil
+	return asPkg, nil
 }
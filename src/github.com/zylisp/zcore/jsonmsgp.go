@@ -277,6 +277,12 @@ func decodeGoToSexpHelper(r interface{}, depth int, env *Zlisp, preferSym bool)
 		VPrintf("depth %d found int case: val = %#v\n", depth, val)
 		return &SexpInt{Val: int64(val)}
 
+	case int8:
+		return &SexpInt{Val: int64(val)}
+
+	case int16:
+		return &SexpInt{Val: int64(val)}
+
 	case int32:
 		VPrintf("depth %d found int32 case: val = %#v\n", depth, val)
 		return &SexpInt{Val: int64(val)}
@@ -285,6 +291,28 @@ func decodeGoToSexpHelper(r interface{}, depth int, env *Zlisp, preferSym bool)
 		VPrintf("depth %d found int64 case: val = %#v\n", depth, val)
 		return &SexpInt{Val: val}
 
+	case uint8:
+		return &SexpInt{Val: int64(val)}
+
+	case uint16:
+		return &SexpInt{Val: int64(val)}
+
+	case uint32:
+		return &SexpInt{Val: int64(val)}
+
+	// these may not fit in an int64.
+	case uint:
+		return &SexpUint64{Val: uint64(val)}
+
+	case uint64:
+		return &SexpUint64{Val: val}
+
+	case uintptr:
+		return &SexpUint64{Val: uint64(val)}
+
+	case float32:
+		return &SexpFloat{Val: float64(val)}
+
 	case float64:
 		VPrintf("depth %d found float64 case: val = %#v\n", depth, val)
 		return &SexpFloat{Val: val}
@@ -357,9 +385,9 @@ func decodeGoToSexpHelper(r interface{}, depth int, env *Zlisp, preferSym bool)
 		nm := fmt.Sprintf("%T", val)
 		rt := GoStructRegistry.Lookup(nm)
 		if rt == nil {
-			fmt.Printf("unknown type '%s' in type switch, val = %#v.  type = %T.\n", nm, val, val)
+			fmt.Fprintf(env.stderr(), "unknown type '%s' in type switch, val = %#v.  type = %T.\n", nm, val, val)
 		} else {
-			fmt.Printf("TODO: known struct '%s' in GoToSexp(), val = %#v.  type = %T. TODO: make a record for it.\n", nm, val, val)
+			fmt.Fprintf(env.stderr(), "TODO: known struct '%s' in GoToSexp(), val = %#v.  type = %T. TODO: make a record for it.\n", nm, val, val)
 		}
 		return SexpNull
 	}
@@ -449,6 +477,8 @@ func SexpToGo(sexp Sexp, env *Zlisp, dedup map[*SexpHash]interface{}) (result in
 		// ugorji msgpack will give us int64 not int,
 		// so match that to make the decodings comparable.
 		return int64(e.Val)
+	case *SexpUint64:
+		return e.Val
 	case *SexpStr:
 		return e.S
 	case *SexpChar:
@@ -497,8 +527,12 @@ func SexpToGo(sexp Sexp, env *Zlisp, dedup map[*SexpHash]interface{}) (result in
 		return e
 	case *SexpBool:
 		return e.Val
+	case *SexpReflect:
+		return e.Val.Interface()
+	case *SexpTime:
+		return e.Tm
 	default:
-		fmt.Printf("\n error: unknown type: %T in '%#v'\n", e, e)
+		fmt.Fprintf(env.stderr(), "\n error: unknown type: %T in '%#v'\n", e, e)
 	}
 	return nil
 }
@@ -528,8 +562,8 @@ func ToGoFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 		} else {
 			//P("ToGo: tn '%s' does not have GoShadowStruct set, making a new one", tn)
 
-			factory, hasMaker := GoStructRegistry.Registry[tn]
-			if !hasMaker {
+			factory := GoStructRegistry.Lookup(tn)
+			if factory == nil {
 				return SexpNull, fmt.Errorf("type '%s' not registered in GoStructRegistry", tn)
 			}
 			newStruct, err = factory.Factory(env, asHash)
@@ -587,8 +621,8 @@ func GoonDumpFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	if len(args) != 1 {
 		return SexpNull, WrongNargs
 	}
-	fmt.Printf("\n")
-	goon.Dump(args[0])
+	fmt.Fprintf(env.Stdout, "\n")
+	goon.Fdump(env.Stdout, args[0])
 	return SexpNull, nil
 }
 
@@ -799,8 +833,8 @@ func SexpToGoStructs(
 		}
 
 		// use targVa, but check against the type in the registry for sanity/type checking.
-		factory, hasMaker := GoStructRegistry.Registry[tn]
-		if !hasMaker {
+		factory := GoStructRegistry.Lookup(tn)
+		if factory == nil {
 			panic(fmt.Errorf("type '%s' not registered in GoStructRegistry", tn))
 			//return nil, fmt.Errorf("type '%s' not registered in GoStructRegistry", tn)
 		}
@@ -862,7 +896,7 @@ func SexpToGoStructs(
 				case *SexpSymbol:
 					recordKey = k.name
 				default:
-					fmt.Printf(" skipping field '%#v' which we don't know how to lookup.", pair.Head)
+					fmt.Fprintf(env.stderr(), " skipping field '%#v' which we don't know how to lookup.", pair.Head)
 					panic(fmt.Sprintf("unknown fields disallowed: we didn't recognize '%#v'", pair.Head))
 					continue
 				}
@@ -879,7 +913,7 @@ func SexpToGoStructs(
 					upperKey := strings.ToUpper(recordKey[:1]) + recordKey[1:]
 					det, found = src.JsonTagMap[upperKey]
 					if !found {
-						fmt.Printf(" skipping field '%s' in this hash/which we could not find in the JsonTagMap", recordKey)
+						fmt.Fprintf(env.stderr(), " skipping field '%s' in this hash/which we could not find in the JsonTagMap", recordKey)
 						panic(fmt.Sprintf("unkown field '%s' not allowed; could not find in the JsonTagMap. Fieldnames are case sensitive.", recordKey))
 						continue
 					}
@@ -937,7 +971,7 @@ func SexpToGoStructs(
 	case *SexpBool:
 		targVa.Elem().Set(reflect.ValueOf(src.Val))
 	default:
-		fmt.Printf("\n error: unknown type: %T in '%#v'\n", src, src)
+		fmt.Fprintf(env.stderr(), "\n error: unknown type: %T in '%#v'\n", src, src)
 	}
 	return target, nil
 }
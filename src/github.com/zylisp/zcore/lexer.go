@@ -7,6 +7,7 @@ import (
 	"io"
 	"regexp"
 	"strconv"
+	"strings"
 	"unicode/utf8"
 )
 
@@ -56,6 +57,7 @@ const (
 type Token struct {
 	typ TokenType
 	str string
+	pos *SrcPos
 }
 
 var EndTk = Token{typ: TokenEnd}
@@ -135,7 +137,18 @@ type Lexer struct {
 	prevPrevToken Token
 	stream        io.RuneScanner
 	next          []io.RuneScanner
-	linenum       int
+
+	// where we are: the current rune, and the
+	// start of the token being lexed.
+	file      string
+	line      int
+	col       int
+	atNewline bool
+	curLine   *srcLine
+	lineText  strings.Builder
+	startLine int
+	startCol  int
+	startSrc  *srcLine
 
 	priori    int
 	priorRune [20]rune
@@ -145,6 +158,8 @@ func (lexer *Lexer) AppendToken(tok Token) {
 	lexer.tokens = append(lexer.tokens, tok)
 	lexer.prevPrevToken = lexer.prevToken
 	lexer.prevToken = tok
+	// any further token from this rune starts here.
+	lexer.markStart()
 }
 
 func (lexer *Lexer) PrependToken(tok Token) {
@@ -167,20 +182,60 @@ func NewLexer(p *Parser) *Lexer {
 		tokens:  make([]Token, 0, 10),
 		buffer:  new(bytes.Buffer),
 		state:   LexerNormal,
-		linenum: 1,
+		line:    1,
+		curLine: &srcLine{},
 	}
 }
 
 func (lexer *Lexer) Linenum() int {
-	return lexer.linenum
+	return lexer.line
+}
+
+// Position returns the position of the rune last read.
+func (lexer *Lexer) Position() *SrcPos {
+	return &SrcPos{File: lexer.file, Line: lexer.line, Col: lexer.col, src: lexer.curLine}
 }
 
 func (lex *Lexer) Reset() {
 	lex.stream = nil
 	lex.tokens = lex.tokens[:0]
 	lex.state = LexerNormal
-	lex.linenum = 1
 	lex.buffer.Reset()
+	lex.file = ""
+	lex.startFile()
+}
+
+// startFile restarts position tracking at line 1.
+func (lex *Lexer) startFile() {
+	lex.line = 1
+	lex.col = 0
+	lex.atNewline = false
+	lex.curLine = &srcLine{}
+	lex.lineText.Reset()
+}
+
+// advance tracks the position of r, and the text of its line.
+func (lex *Lexer) advance(r rune) {
+	if lex.atNewline {
+		lex.line++
+		lex.col = 0
+		lex.atNewline = false
+		lex.curLine = &srcLine{}
+		lex.lineText.Reset()
+	}
+	lex.col++
+	if r == '\n' {
+		lex.curLine.text = strings.TrimSuffix(lex.lineText.String(), "\r")
+		lex.atNewline = true
+		return
+	}
+	lex.lineText.WriteRune(r)
+}
+
+func (lex *Lexer) markStart() {
+	lex.startLine = lex.line
+	lex.startCol = lex.col
+	lex.startSrc = lex.curLine
 }
 
 func (lex *Lexer) EmptyToken() Token {
@@ -191,6 +246,12 @@ func (lex *Lexer) Token(typ TokenType, str string) Token {
 	t := Token{
 		typ: typ,
 		str: str,
+		pos: &SrcPos{
+			File: lex.file,
+			Line: lex.startLine,
+			Col:  lex.startCol,
+			src:  lex.startSrc,
+		},
 	}
 	return t
 }
@@ -612,6 +673,9 @@ top:
 		goto top // still have to parse r in normal
 
 	case LexerNormal:
+		if lexer.buffer.Len() == 0 {
+			lexer.markStart()
+		}
 		switch r {
 		case '+':
 			fallthrough
@@ -750,7 +814,6 @@ top:
 			lexer.AppendToken(lexer.DecodeBrace(r))
 			return nil
 		case '\n':
-			lexer.linenum++
 			fallthrough
 		case ' ':
 			fallthrough
@@ -791,6 +854,8 @@ func (lexer *Lexer) PeekNextToken() (tok Token, err error) {
 	for len(lexer.tokens) == 0 {
 		r, _, err := lexer.stream.ReadRune()
 		if err != nil {
+			// the last line may lack a newline.
+			lexer.curLine.text = lexer.lineText.String()
 			if lexer.PromoteNextStream() {
 				continue
 			} else {
@@ -798,6 +863,7 @@ func (lexer *Lexer) PeekNextToken() (tok Token, err error) {
 			}
 		}
 
+		lexer.advance(r)
 		err = lexer.LexNextRune(r)
 		if err != nil {
 			return EndTk, err
@@ -837,6 +903,10 @@ func (lex *Lexer) PromoteNextStream() (ok bool) {
 	//Q("Promoting next stream!\n")
 	lex.stream = lex.next[0]
 	lex.next = lex.next[1:]
+	if named, ok := lex.stream.(*NamedInput); ok {
+		lex.file = named.Name
+		lex.startFile()
+	}
 	return true
 }
 
@@ -0,0 +1,250 @@
+package zcore
+
+import (
+	"fmt"
+)
+
+// Lexical addressing. As it goes, the generator keeps track of
+// the scopes that the code it generates will push, and of the
+// symbols that code binds in each: the scope's layout, which gives
+// each of them a slot in the Scope's slots, in place of an entry
+// in its Map. A reference to a variable bound in one of the scopes
+// of its own function, or in one of those that the function was
+// made in, is resolved to the layouts of the scopes that a lookup
+// by name would look through, and the slot it would find the
+// variable in. When it runs, the reference checks that the scopes
+// it is given are the ones it expects, and that nothing has been
+// bound since in those it passes; if not, or if the variable is
+// not yet bound, it is looked up by name as before. Globals,
+// packages, and code compiled as it runs, keep the lookup by name.
+
+// scopeLayout lists the symbols that generated code binds in a
+// scope, in slot order.
+type scopeLayout struct {
+	syms []*SexpSymbol
+}
+
+// slot returns the slot of the symbol numbered num, or -1.
+func (l *scopeLayout) slot(num int) int {
+	for i, sym := range l.syms {
+		if sym.number == num {
+			return i
+		}
+	}
+	return -1
+}
+
+// lexScope is a scope that generated code will push, as the
+// generator sees it.
+type lexScope struct {
+	layout   *scopeLayout
+	parent   *lexScope // the scope it is in, in the same function
+	function bool      // a function's own scope
+	captured *lexScope // for a function's scope, where it is made
+	unit     *lexUnit
+}
+
+// lexUnit is a nest of lexScopes, with the references made in
+// them. The references are resolved when the outermost is closed,
+// so that each scope is known to hold all it ever will.
+type lexUnit struct {
+	refs []lexRef
+}
+
+type lexRef struct {
+	sym  *SexpSymbol
+	in   *lexScope
+	addr *lexAddr
+}
+
+// lexAddr is where a reference expects its variable: past the
+// scopes at the top of linearstack with the layouts in local,
+// innermost first, then past those at the top of the captured
+// stack of the running closure with the layouts in captured, in
+// the slot of the last of all. local is nil until it is resolved,
+// and stays nil if it cannot be.
+type lexAddr struct {
+	local    []*scopeLayout
+	captured []*scopeLayout
+	slot     int
+}
+
+func (a *lexAddr) String() string {
+	switch {
+	case a.local == nil:
+		return ""
+	case a.captured == nil:
+		return fmt.Sprintf(" at %d:%d", len(a.local)-1, a.slot)
+	}
+	return fmt.Sprintf(" at closure %d:%d", len(a.captured)-1, a.slot)
+}
+
+func (u *lexUnit) resolve() {
+	for _, r := range u.refs {
+		r.addr.resolve(r.sym, r.in)
+	}
+	u.refs = nil
+}
+
+// resolve looks for sym from in as a lookup by name does: out
+// through the scopes of the function to its own, then through the
+// scopes that the function was made in, out to those of the
+// function that made it.
+func (a *lexAddr) resolve(sym *SexpSymbol, in *lexScope) {
+	var local, captured []*scopeLayout
+	path := &local
+	for s := in; s != nil; {
+		*path = append(*path, s.layout)
+		if slot := s.layout.slot(sym.number); slot >= 0 {
+			a.local, a.captured, a.slot = local, captured, slot
+			return
+		}
+		if !s.function {
+			s = s.parent
+			continue
+		}
+		if path == &captured {
+			return
+		}
+		path = &captured
+		s = s.captured
+	}
+}
+
+// find returns the scope that holds a's variable, as the code
+// runs, or nil if it must be looked up by name.
+func (a *lexAddr) find(env *Zlisp) *Scope {
+	if a.local == nil {
+		return nil
+	}
+	var sc *Scope
+	if a.captured == nil {
+		sc = matchScopes(env.linearstack, a.local, len(a.local)-1)
+	} else if matchScopes(env.linearstack, a.local, len(a.local)) != nil &&
+		env.curfunc.closingOverScopes != nil {
+		sc = matchScopes(env.curfunc.closingOverScopes.Stack, a.captured, len(a.captured)-1)
+	}
+	if sc == nil || a.slot >= len(sc.slots) || sc.slots[a.slot] == nil {
+		return nil
+	}
+	return sc
+}
+
+// matchScopes returns the last of the scopes at the top of stack,
+// if they have the layouts in path and the first bare of them have
+// nothing in their Map.
+func matchScopes(stack *Stack, path []*scopeLayout, bare int) *Scope {
+	if stack.tos+1 < len(path) {
+		return nil
+	}
+	var sc *Scope
+	for i, layout := range path {
+		s, ok := stack.elements[stack.tos-i].(*Scope)
+		if !ok || s.layout != layout || (i < bare && len(s.Map) > 0) {
+			return nil
+		}
+		sc = s
+	}
+	return sc
+}
+
+// openScope has gen generate into a new lexScope, inside gen.lex
+// or, for the scope of a function, inside captured, where the
+// function is made. It returns the layout for the instruction
+// that adds the scope.
+func (gen *Generator) openScope(function bool, captured *lexScope) *scopeLayout {
+	s := &lexScope{layout: &scopeLayout{}, function: function}
+	if function {
+		s.captured = captured
+	} else {
+		s.parent = gen.lex
+	}
+	switch {
+	case s.parent != nil:
+		s.unit = s.parent.unit
+	case s.captured != nil:
+		s.unit = s.captured.unit
+	default:
+		s.unit = &lexUnit{}
+	}
+	gen.lex = s
+	return s.layout
+}
+
+// closeScope ends gen.lex; ending the outermost resolves the
+// references made in its unit.
+func (gen *Generator) closeScope() {
+	s := gen.lex
+	gen.lex = s.parent
+	if s.parent == nil && s.captured == nil {
+		s.unit.resolve()
+	}
+}
+
+// bind gives sym a slot in gen.lex, where the code being
+// generated binds it.
+func (gen *Generator) bind(sym *SexpSymbol) {
+	if gen.lex != nil && gen.lex.layout.slot(sym.number) < 0 {
+		gen.lex.layout.syms = append(gen.lex.layout.syms, sym)
+	}
+}
+
+// lexical says if a reference to sym can be resolved to a slot.
+func (gen *Generator) lexical(sym *SexpSymbol) bool {
+	return gen.lex != nil && !sym.isDot && !sym.isSigil && !sym.colonTail &&
+		!gen.env.HasMacro(sym)
+}
+
+// ref returns the lexAddr that a reference to sym, from s, is
+// resolved to.
+func (s *lexScope) ref(sym *SexpSymbol) *lexAddr {
+	a := &lexAddr{}
+	s.unit.refs = append(s.unit.refs, lexRef{sym: sym, in: s, addr: a})
+	return a
+}
+
+// LexToStackInstr pushes the value of a variable that the
+// generator found in an enclosing scope.
+type LexToStackInstr struct {
+	sym  *SexpSymbol
+	addr *lexAddr
+}
+
+func (g LexToStackInstr) InstrString() string {
+	return "lexToStack " + g.sym.name + g.addr.String()
+}
+
+func (g LexToStackInstr) Execute(env *Zlisp) error {
+	sc := g.addr.find(env)
+	if sc == nil {
+		return EnvToStackInstr{g.sym}.Execute(env)
+	}
+	env.datastack.PushExpr(sc.slots[g.addr.slot])
+	env.pc++
+	return nil
+}
+
+// LexUpdateInstr is UpdateInstr, for a variable that the
+// generator found in an enclosing scope.
+type LexUpdateInstr struct {
+	sym  *SexpSymbol
+	addr *lexAddr
+}
+
+func (p LexUpdateInstr) InstrString() string {
+	return "putup " + p.sym.name + p.addr.String()
+}
+
+func (p LexUpdateInstr) Execute(env *Zlisp) error {
+	sc := p.addr.find(env)
+	if sc == nil {
+		return UpdateInstr{p.sym}.Execute(env)
+	}
+	expr, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+	env.pc++
+	sc.slots[p.addr.slot] = expr
+	return nil
+}
@@ -0,0 +1,79 @@
+package zcore
+
+import (
+	"bytes"
+	"testing"
+	"testing/fstest"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test600LocalsAreResolvedToScopeSlots(t *testing.T) {
+
+	cv.Convey(`Given functions with locals, loops, catches and closures, references should be resolved to slots when compiled and found there when run, also from a .zyc cache, while shadowing defs, eval and globals should see what a lookup by name would`, t, func() {
+
+		files := fstest.MapFS{
+			"p.zy": {Data: []byte("(defn p [a] (let [b (+ a 1)] [(probe) (+ a b)]))\n")},
+		}
+		newEnv := func() *Zlisp {
+			env := NewZlisp()
+			env.StandardSetup()
+			env.SetFS(memFS{files})
+			env.CacheBytecode = true
+
+			// probe counts the references of its caller that are
+			// found in their slots, as it is called.
+			env.AddFunction("probe", func(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+				self := env.curfunc
+				defer func() { env.curfunc = self }()
+				env.curfunc = env.addrstack.elements[env.addrstack.tos].(Address).function
+				n := 0
+				for _, in := range env.curfunc.fun {
+					if l, ok := in.(LexToStackInstr); ok && l.addr.find(env) != nil {
+						n++
+					}
+				}
+				return &SexpInt{Val: int64(n)}, nil
+			})
+			return env
+		}
+
+		env := newEnv()
+		defer env.Stop()
+		_, err := env.EvalString(`
+(source "p.zy")
+(defn g [x] (let [z 2] (fn [y] [(probe) (+ x y z w)])))
+(def w 1)`)
+		cv.So(err, cv.ShouldBeNil)
+
+		var buf bytes.Buffer
+		x, _ := env.FindObject("p")
+		p := x.(*SexpFunction)
+		FdumpFunction(&buf, p.fun, -1)
+		cv.So(buf.String(), cv.ShouldContainSubstring, "lexToStack a at 1:0")
+		cv.So(buf.String(), cv.ShouldContainSubstring, "lexToStack b at 0:0")
+
+		res, err := env.EvalString(`[(p 2) ((g 3) 4)]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "[[3 5] [3 10]]")
+
+		res, err = env.EvalString(`
+(defn f [] (def x 1) (def r []) (for [(def i 0) (< i 2) (++ i)] (set r (append r x)) (def x 10)) r)
+(defn k [a] (let [b 1] (eval (quote (def a 5))) [a b]))
+(defn mk [] (def n 0) (fn [] (set n (+ n 1)) n))
+(def c (mk))
+(c)
+[(f) (k 2) (c) (try (throw 7) (catch e (let [v (:value e)] v)))]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "[[1 10] [5 1] 2 7]")
+
+		// a fresh env runs p from the .zyc cache, with the layouts
+		// still shared by the scopes and the references in them.
+		cached := newEnv()
+		defer cached.Stop()
+		res, err = cached.EvalString(`(source "p.zy") (p 2)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(cached.zycLoads, cv.ShouldEqual, 1)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "[3 5]")
+	})
+}
@@ -0,0 +1,185 @@
+package zcore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ModulePathEnvVar names the environment variable that NewZlisp
+// reads the module search roots from, separated as in PATH.
+const ModulePathEnvVar = "ZYLISP_PATH"
+
+// moduleCache holds the packages loaded by import, by path, so
+// that each is sourced once. Clones and Duplicates share it.
+type moduleCache struct {
+	mu    sync.Mutex
+	roots []string
+	pkgs  map[string]*Stack
+}
+
+func newModuleCache() *moduleCache {
+	return &moduleCache{
+		roots: filepath.SplitList(os.Getenv(ModulePathEnvVar)),
+		pkgs:  make(map[string]*Stack),
+	}
+}
+
+// ImportCycleError reports packages that import each other.
+type ImportCycleError struct {
+	Chain []string // the paths being imported, the first repeated last
+}
+
+func (e *ImportCycleError) Error() string {
+	return "import cycle: " + strings.Join(e.Chain, " -> ")
+}
+
+// SetModulePath sets the roots that import searches for modules
+// given by logical name, replacing those from ZYLISP_PATH.
+func (env *Zlisp) SetModulePath(roots ...string) {
+	env.modules.mu.Lock()
+	env.modules.roots = append([]string{}, roots...)
+	env.modules.mu.Unlock()
+}
+
+// ModulePath returns the roots that import searches.
+func (env *Zlisp) ModulePath() []string {
+	env.modules.mu.Lock()
+	defer env.modules.mu.Unlock()
+	return append([]string{}, env.modules.roots...)
+}
+
+// resolveModule finds the file for (import name). name may be a
+// path, as before, or a logical name such as "util/strings" to
+// look for under each root of the module path. Either way, the
+// .zy extension may be left off.
+func (env *Zlisp) resolveModule(name string) (string, error) {
+	candidates := []string{name}
+	if !filepath.IsAbs(name) {
+		for _, root := range env.ModulePath() {
+			candidates = append(candidates, filepath.Join(root, name))
+		}
+	}
+	for _, c := range candidates {
+		for _, f := range []string{c, c + ".zy"} {
+			if env.fileExists(f) {
+				return env.moduleKey(f), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("module '%s' not found; tried %s",
+		name, strings.Join(candidates, ", "))
+}
+
+// moduleKey gives one name for each file, whichever way it was found.
+func (env *Zlisp) moduleKey(file string) string {
+	if _, isOS := env.FS().(osFS); isOS {
+		if abs, err := filepath.Abs(file); err == nil {
+			return abs
+		}
+		return filepath.Clean(file)
+	}
+	return env.fsName(file)
+}
+
+// importModule returns the package at path, sourcing it
+// unless it has been already.
+func (env *Zlisp) importModule(path string) (*Stack, error) {
+	env.modules.mu.Lock()
+	pkg := env.modules.pkgs[path]
+	env.modules.mu.Unlock()
+	if pkg != nil {
+		return pkg, nil
+	}
+	return env.loadModule(path)
+}
+
+// loadModule sources the package at path, and caches it.
+func (env *Zlisp) loadModule(path string) (*Stack, error) {
+	for i, p := range env.importing {
+		if p == path {
+			chain := append(append([]string{}, env.importing[i:]...), path)
+			return nil, &ImportCycleError{Chain: chain}
+		}
+	}
+	env.importing = append(env.importing, path)
+	defer func() {
+		env.importing = env.importing[:len(env.importing)-1]
+	}()
+
+	pkg, err := SourceFileFunction(env, "source", []Sexp{&SexpStr{S: path}})
+	if err != nil {
+		return nil, err
+	}
+	asPkg, isPkg := pkg.(*Stack)
+	if !isPkg || !asPkg.IsPackage {
+		return nil, fmt.Errorf("'%s' gave a %T, not a package", path, pkg)
+	}
+
+	env.modules.mu.Lock()
+	env.modules.pkgs[path] = asPkg
+	env.modules.mu.Unlock()
+	return asPkg, nil
+}
+
+// ReloadFunction: (reload pkg) sources a package again, given
+// the package itself or the name it was imported by, and
+// updates it in place, so that every alias for it sees the new
+// definitions.
+func ReloadFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 1 {
+		return SexpNull, WrongNargs
+	}
+
+	var path string
+	var old *Stack
+	switch x := args[0].(type) {
+	case *Stack:
+		if !x.IsPackage {
+			return SexpNull, fmt.Errorf("reload: argument is not a package")
+		}
+		old = x
+		env.modules.mu.Lock()
+		for p, pkg := range env.modules.pkgs {
+			if pkg == x {
+				path = p
+			}
+		}
+		env.modules.mu.Unlock()
+		if path == "" {
+			return SexpNull, fmt.Errorf("reload: package '%s' was not imported", x.PackageName)
+		}
+	case *SexpStr:
+		var err error
+		if path, err = env.resolveModule(x.S); err != nil {
+			return SexpNull, fmt.Errorf("reload: %s", err)
+		}
+		env.modules.mu.Lock()
+		old = env.modules.pkgs[path]
+		env.modules.mu.Unlock()
+	default:
+		return SexpNull, fmt.Errorf("reload: argument must be a package, or the string it was imported by")
+	}
+	if err := env.checkRead(name, path); err != nil {
+		return SexpNull, err
+	}
+
+	pkg, err := env.loadModule(path)
+	if err != nil {
+		return SexpNull, fmt.Errorf("reload: %w", err)
+	}
+	if old == nil {
+		return pkg, nil
+	}
+	// a copy: stacks pop and truncate in place, so two sharing
+	// their elements would change each other.
+	fresh := pkg.Clone()
+	old.elements, old.tos = fresh.elements, fresh.tos
+	old.PackageName = pkg.PackageName
+	env.modules.mu.Lock()
+	env.modules.pkgs[path] = old
+	env.modules.mu.Unlock()
+	return old, nil
+}
@@ -0,0 +1,58 @@
+package zcore
+
+import (
+	"errors"
+	"testing"
+	"testing/fstest"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test510ImportFindsAndCachesModules(t *testing.T) {
+
+	cv.Convey(`Given a module path, import should find packages by logical name, source each only once, report an import cycle with its chain, and reload should update a package in place`, t, func() {
+
+		env := NewZlisp()
+		defer env.Stop()
+		cv.So(env.StandardSetup(), cv.ShouldBeNil)
+
+		files := fstest.MapFS{
+			"lib/util/strings.zy": {Data: []byte(`(package "strs" (def Greeting "hi"))`)},
+			"lib/a.zy":            {Data: []byte(`(import "b") (package "a" (def X 1))`)},
+			"lib/b.zy":            {Data: []byte(`(import "a") (package "b" (def Y 2))`)},
+		}
+		env.SetFS(files)
+		env.SetModulePath("lib")
+		cv.So(env.ModulePath(), cv.ShouldResemble, []string{"lib"})
+
+		res, err := env.EvalString(`(import "util/strings") (concat strs.Greeting "")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `"hi"`)
+
+		first, err := env.EvalString(`(import s1 "util/strings")`)
+		cv.So(err, cv.ShouldBeNil)
+		second, err := env.EvalString(`(import s2 "lib/util/strings.zy")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(first == second, cv.ShouldBeTrue)
+
+		env.Clear()
+		_, err = env.EvalString(`(import "a")`)
+		var cyc *ImportCycleError
+		cv.So(errors.As(err, &cyc), cv.ShouldBeTrue)
+		cv.So(cyc.Error(), cv.ShouldEqual, "import cycle: lib/a.zy -> lib/b.zy -> lib/a.zy")
+
+		env.Clear()
+		_, err = env.EvalString(`(import "nope")`)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "module 'nope' not found")
+
+		env.Clear()
+		files["lib/util/strings.zy"] = &fstest.MapFile{Data: []byte(`(package "strs" (def Greeting "hello"))`)}
+		res, err = env.EvalString(`(reload s1) (concat s2.Greeting "")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `"hello"`)
+
+		res, err = env.EvalString(`(reload "util/strings")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res == first, cv.ShouldBeTrue)
+	})
+}
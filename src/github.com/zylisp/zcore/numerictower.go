@@ -19,6 +19,93 @@ const (
 
 var WrongType error = errors.New("operands have invalid type")
 
+// The ints from smallIntMin to smallIntMax are made once, and
+// shared by all that makes them through MakeInt.
+const (
+	smallIntMin = -128
+	smallIntMax = 1023
+)
+
+var smallInts = func() (ints [smallIntMax - smallIntMin + 1]SexpInt) {
+	for i := range ints {
+		ints[i].Val = int64(i + smallIntMin)
+	}
+	return
+}()
+
+// smallIntElems are smallInts boxed for the datastack, so pushing
+// them does not allocate either.
+var smallIntElems = func() (elems [len(smallInts)]StackElem) {
+	for i := range elems {
+		elems[i] = DataStackElem{&smallInts[i]}
+	}
+	return
+}()
+
+// MakeInt returns v as an *SexpInt, without allocating when v is
+// small. The result may be shared, so it must not be changed.
+func MakeInt(v int64) *SexpInt {
+	if v >= smallIntMin && v <= smallIntMax {
+		return &smallInts[v-smallIntMin]
+	}
+	return &SexpInt{Val: v}
+}
+
+// sharedIntElem returns the datastack box of x, if x is one of the
+// ints that MakeInt shares.
+func sharedIntElem(x *SexpInt) (StackElem, bool) {
+	if x.Val < smallIntMin || x.Val > smallIntMax || x != &smallInts[x.Val-smallIntMin] {
+		return nil, false
+	}
+	return smallIntElems[x.Val-smallIntMin], true
+}
+
+// numericAccum does op across args when they are all ints or all
+// floats, and op does not change their type, boxing only the
+// result; ok is false otherwise.
+func numericAccum(op NumericOp, args []Sexp) (res Sexp, ok bool) {
+	if op != Add && op != Sub && op != Mult {
+		return nil, false
+	}
+	switch first := args[0].(type) {
+	case *SexpInt:
+		acc := first.Val
+		for _, arg := range args[1:] {
+			x, isInt := arg.(*SexpInt)
+			if !isInt {
+				return nil, false
+			}
+			switch op {
+			case Add:
+				acc += x.Val
+			case Sub:
+				acc -= x.Val
+			case Mult:
+				acc *= x.Val
+			}
+		}
+		return MakeInt(acc), true
+	case *SexpFloat:
+		acc := first.Val
+		for _, arg := range args[1:] {
+			x, isFloat := arg.(*SexpFloat)
+			if !isFloat {
+				return nil, false
+			}
+			switch op {
+			case Add:
+				acc += x.Val
+			case Sub:
+				acc -= x.Val
+			case Mult:
+				acc *= x.Val
+			}
+		}
+		return &SexpFloat{Val: acc}, true
+	}
+	return nil, false
+}
+
 func IntegerDo(op IntegerOp, a, b Sexp) (Sexp, error) {
 	var ia *SexpInt
 	var ib *SexpInt
@@ -47,19 +134,19 @@ func IntegerDo(op IntegerOp, a, b Sexp) (Sexp, error) {
 
 	switch op {
 	case ShiftLeft:
-		return &SexpInt{Val: ia.Val << uint(ib.Val)}, nil
+		return MakeInt(ia.Val << uint(ib.Val)), nil
 	case ShiftRightArith:
-		return &SexpInt{Val: ia.Val >> uint(ib.Val)}, nil
+		return MakeInt(ia.Val >> uint(ib.Val)), nil
 	case ShiftRightLog:
-		return &SexpInt{Val: int64(uint(ia.Val) >> uint(ib.Val))}, nil
+		return MakeInt(int64(uint(ia.Val) >> uint(ib.Val))), nil
 	case Modulo:
-		return &SexpInt{Val: ia.Val % ib.Val}, nil
+		return MakeInt(ia.Val % ib.Val), nil
 	case BitAnd:
-		return &SexpInt{Val: ia.Val & ib.Val}, nil
+		return MakeInt(ia.Val & ib.Val), nil
 	case BitOr:
-		return &SexpInt{Val: ia.Val | ib.Val}, nil
+		return MakeInt(ia.Val | ib.Val), nil
 	case BitXor:
-		return &SexpInt{Val: ia.Val ^ ib.Val}, nil
+		return MakeInt(ia.Val ^ ib.Val), nil
 	}
 	return SexpNull, errors.New("unrecognized shift operation")
 }
@@ -126,19 +213,19 @@ func NumericFloatDo(op NumericOp, a, b *SexpFloat) Sexp {
 func NumericIntDo(op NumericOp, a, b *SexpInt) Sexp {
 	switch op {
 	case Add:
-		return &SexpInt{Val: a.Val + b.Val}
+		return MakeInt(a.Val + b.Val)
 	case Sub:
-		return &SexpInt{Val: a.Val - b.Val}
+		return MakeInt(a.Val - b.Val)
 	case Mult:
-		return &SexpInt{Val: a.Val * b.Val}
+		return MakeInt(a.Val * b.Val)
 	case Div:
 		if a.Val%b.Val == 0 {
-			return &SexpInt{Val: a.Val / b.Val}
+			return MakeInt(a.Val / b.Val)
 		} else {
 			return &SexpFloat{Val: float64(a.Val) / float64(b.Val)}
 		}
 	case Pow:
-		return &SexpInt{Val: int64(math.Pow(float64(a.Val), float64(b.Val)))}
+		return MakeInt(int64(math.Pow(float64(a.Val), float64(b.Val))))
 	}
 	return SexpNull
 }
@@ -232,6 +319,18 @@ func NumericMatchChar(op NumericOp, a *SexpChar, b Sexp) (Sexp, error) {
 }
 
 func NumericDo(op NumericOp, a, b Sexp) (Sexp, error) {
+	// most arithmetic is of two ints, or of two floats.
+	switch ta := a.(type) {
+	case *SexpInt:
+		if tb, ok := b.(*SexpInt); ok {
+			return NumericIntDo(op, ta, tb), nil
+		}
+	case *SexpFloat:
+		if tb, ok := b.(*SexpFloat); ok {
+			return NumericFloatDo(op, ta, tb), nil
+		}
+	}
+
 	switch ta := a.(type) {
 	case *SexpFloat:
 		return NumericMatchFloat(op, ta, b)
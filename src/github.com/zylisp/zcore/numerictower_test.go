@@ -0,0 +1,88 @@
+package zcore
+
+import (
+	"bytes"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test620ArithmeticOnSmallIntsDoesNotAllocate(t *testing.T) {
+
+	cv.Convey(`Given int and float arithmetic, small int results should be shared, n-ary sums boxed once, and ++, --, += and -= compiled to incr instructions that give what the call to + or - would, with its hooks, its errors and its allocations when they apply, and none of their own for small ints`, t, func() {
+
+		cv.So(MakeInt(7), cv.ShouldEqual, MakeInt(7))
+		cv.So(MakeInt(7).Val, cv.ShouldEqual, 7)
+		cv.So(MakeInt(-200), cv.ShouldNotEqual, MakeInt(-200))
+		res, err := NumericDo(Add, MakeInt(3), MakeInt(4))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res, cv.ShouldEqual, MakeInt(7))
+
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		res, err = env.EvalString(`[(+ 1 2 3) (- 10 1 2) (* 2 3 4) (+ 1.5 2.5) (+ 1 2.5) (/ 6 4) (- 5)]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "[6 7 24 4 3.5 1.5 5]")
+
+		_, err = env.EvalString(`
+(defn f [n]
+  (def s 0.5)
+  (def c 'a')
+  (for [(def i 0) (< i n) (++ i)]
+    (+= s i)
+    (-= s 0.25)
+    (++ c))
+  [s c])
+(def g 1)
+(++ g)
+(-= g 3)
+(def h "x")`)
+		cv.So(err, cv.ShouldBeNil)
+		var buf bytes.Buffer
+		x, _ := env.FindObject("f")
+		FdumpFunction(&buf, x.(*SexpFunction).fun, -1)
+		cv.So(buf.String(), cv.ShouldContainSubstring, "incr i at 0:0")
+		cv.So(buf.String(), cv.ShouldContainSubstring, "decr s at 1:1")
+
+		res, err = env.EvalString(`[(f 4) g]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `[[5.5 'e'] -1]`)
+
+		_, err = env.EvalString(`(set h (+ 1 h))`)
+		want := err.Error()
+		env.Clear()
+		_, err = env.EvalString(`(++ h)`)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldEqual, want)
+		env.Clear()
+
+		calls := 0
+		env.AddPreHook(func(env *Zlisp, name string, args []Sexp) {
+			if name == "+" {
+				calls++
+			}
+		})
+		res, err = env.EvalString(`(++ g) g`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "0")
+		cv.So(calls, cv.ShouldEqual, 1)
+
+		// while s stays small, (+= s 1) pushes only boxes made once,
+		// and its result is shared, so it allocates nothing.
+		allocs := func(body string) float64 {
+			loop := NewZlisp()
+			defer loop.Stop()
+			loop.StandardSetup()
+			_, err := loop.EvalString(`(defn loop [n] (def s 0) (for [(def i 0) (< i n) (++ i)] ` + body + `) s)`)
+			cv.So(err, cv.ShouldBeNil)
+			fn, _ := loop.FindObject("loop")
+			return testing.AllocsPerRun(5, func() {
+				_, err := loop.Apply(fn.(*SexpFunction), []Sexp{MakeInt(500)})
+				cv.So(err, cv.ShouldBeNil)
+			})
+		}
+		cv.So(allocs(`(+= s 1) (+= s 1)`)-allocs(`(+= s 1)`), cv.ShouldBeLessThan, 50)
+	})
+}
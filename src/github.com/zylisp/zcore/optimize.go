@@ -0,0 +1,398 @@
+package zcore
+
+import (
+	"reflect"
+	"sync"
+)
+
+// PureFunctions returns the builtins whose result depends only
+// on their arguments, so that a call with constant arguments can
+// be made once, as the code is generated, instead of each time
+// it runs. A builtin is only folded if it is still the function
+// named here; an env that replaces "+" with one of its own gets
+// calls to that.
+func PureFunctions() map[string]ZlispUserFunction {
+	return map[string]ZlispUserFunction{
+		"+":      NumericFunction,
+		"-":      NumericFunction,
+		"*":      PointerOrNumericFunction,
+		"/":      NumericFunction,
+		"**":     NumericFunction,
+		"mod":    BinaryIntFunction,
+		"sll":    BinaryIntFunction,
+		"sra":    BinaryIntFunction,
+		"srl":    BinaryIntFunction,
+		"bitAnd": BitwiseFunction,
+		"bitOr":  BitwiseFunction,
+		"bitXor": BitwiseFunction,
+		"bitNot": ComplementFunction,
+		"<":      CompareFunction,
+		"<=":     CompareFunction,
+		">":      CompareFunction,
+		">=":     CompareFunction,
+		"==":     CompareFunction,
+		"!=":     CompareFunction,
+		"not":    NotFunction,
+		"concat": ConcatFunction,
+		"len":    LenFunction,
+		"chomp":  StringUtilFunction,
+		"trim":   StringUtilFunction,
+	}
+}
+
+var (
+	pureOnce sync.Once
+	pureFuns map[string]uintptr
+)
+
+// isPure says if f is the pure builtin called name.
+func isPure(name string, f ZlispUserFunction) bool {
+	pureOnce.Do(func() {
+		pureFuns = make(map[string]uintptr)
+		for name, f := range PureFunctions() {
+			pureFuns[name] = reflect.ValueOf(f).Pointer()
+		}
+	})
+	p, ok := pureFuns[name]
+	return ok && f != nil && reflect.ValueOf(f).Pointer() == p
+}
+
+// maxOptimizeRounds bounds the times the passes are repeated, as
+// one pass can make work for another.
+const maxOptimizeRounds = 8
+
+// optimizer rewrites a function's instructions to do the same in
+// fewer steps, keeping the source map in step with them.
+type optimizer struct {
+	env   *Zlisp
+	code  []Instruction
+	pos   []*SrcPos
+	loops map[*Loop]int // where each loop starts
+}
+
+// optimize returns fun, and its source map srcmap, with constant
+// calls to pure builtins folded, pushes that are popped straight
+// away dropped, jumps to jumps threaded, and code that cannot be
+// reached removed. It returns them as they are if
+// env.NoOptimize is set, or if it cannot follow where fun jumps
+// to.
+func (env *Zlisp) optimize(fun []Instruction, srcmap []*SrcPos) ([]Instruction, []*SrcPos) {
+	if env.NoOptimize || len(fun) == 0 || len(srcmap) != len(fun) {
+		return fun, srcmap
+	}
+	o := &optimizer{env: env, code: fun, pos: srcmap}
+	if o.targets() == nil {
+		return fun, srcmap
+	}
+	// the passes edit in place, and fun may be shared.
+	o.code = append([]Instruction(nil), o.code...)
+	o.pos = append([]*SrcPos(nil), o.pos...)
+
+	for round := 0; round < maxOptimizeRounds; round++ {
+		changed := o.fold()
+		changed = o.dropPushPops() || changed
+		changed = o.threadJumps() || changed
+		changed = o.removeDeadCode() || changed
+		if !changed {
+			break
+		}
+	}
+	return o.code, o.pos
+}
+
+// target returns where the instruction at i jumps to, if it can.
+func (o *optimizer) target(i int) (int, bool) {
+	switch in := o.code[i].(type) {
+	case JumpInstr:
+		return i + in.addpc, true
+	case BranchInstr:
+		return i + in.location, true
+	case GotoInstr:
+		return in.location, true
+	case TryStartInstr:
+		return i + in.catch, true
+	}
+	return 0, false
+}
+
+// retarget returns in, an instruction at from, jumping to to.
+func retarget(in Instruction, from, to int) Instruction {
+	switch j := in.(type) {
+	case JumpInstr:
+		j.addpc = to - from
+		return j
+	case BranchInstr:
+		j.location = to - from
+		return j
+	case GotoInstr:
+		j.location = to
+		return j
+	case TryStartInstr:
+		j.catch = to - from
+		return j
+	}
+	return in
+}
+
+// targets marks the instructions that are jumped to, with one
+// past the end for jumps out. It finds the loops as it goes, and
+// returns nil if a jump or loop leads outside the function.
+func (o *optimizer) targets() []bool {
+	n := len(o.code)
+	is := make([]bool, n+1)
+	o.loops = make(map[*Loop]int)
+	mark := func(t int) bool {
+		if t < 0 || t > n {
+			return false
+		}
+		is[t] = true
+		return true
+	}
+	for i, in := range o.code {
+		if t, ok := o.target(i); ok && !mark(t) {
+			return nil
+		}
+		if ls, ok := in.(LoopStartInstr); ok {
+			o.loops[ls.loop] = i
+			if !mark(i+ls.loop.breakOffset) || !mark(i+ls.loop.continueOffset) {
+				return nil
+			}
+		}
+	}
+	return is
+}
+
+// compact removes the instructions not kept, and moves the
+// jumps and loop offsets to match. A jump to a removed
+// instruction goes to the next one kept.
+func (o *optimizer) compact(keep []bool) {
+	n := len(o.code)
+	at := make([]int, n+1)
+	k := 0
+	for i := 0; i < n; i++ {
+		at[i] = k
+		if keep[i] {
+			k++
+		}
+	}
+	at[n] = k
+
+	code := make([]Instruction, 0, k)
+	pos := make([]*SrcPos, 0, k)
+	for i := 0; i < n; i++ {
+		if !keep[i] {
+			continue
+		}
+		in := o.code[i]
+		if t, ok := o.target(i); ok {
+			in = retarget(in, at[i], at[t])
+		}
+		if ls, ok := in.(LoopStartInstr); ok {
+			ls.loop.breakOffset = at[i+ls.loop.breakOffset] - at[i]
+			ls.loop.continueOffset = at[i+ls.loop.continueOffset] - at[i]
+		}
+		code = append(code, in)
+		pos = append(pos, o.pos[i])
+	}
+	o.code, o.pos = code, pos
+}
+
+func allKept(n int) []bool {
+	keep := make([]bool, n)
+	for i := range keep {
+		keep[i] = true
+	}
+	return keep
+}
+
+// fold replaces a call to a pure builtin, whose arguments are
+// all pushed constants, with a push of its result.
+func (o *optimizer) fold() bool {
+	is := o.targets()
+	keep := allKept(len(o.code))
+	changed := false
+	for i, in := range o.code {
+		c, ok := in.(CallInstr)
+		if !ok || c.nargs < 1 || c.nargs > i {
+			continue
+		}
+		first := i - c.nargs
+		args := make([]Sexp, 0, c.nargs)
+		for j := first; j < i; j++ {
+			p, isPush := o.code[j].(PushInstr)
+			if !isPush || !isConstantAtom(p.expr) || !keep[j] || (j > first && is[j]) {
+				args = nil
+				break
+			}
+			args = append(args, p.expr)
+		}
+		if args == nil || is[i] {
+			continue
+		}
+		res, ok := o.callPure(c, args)
+		if !ok {
+			continue
+		}
+		o.code[first] = PushInstr{res}
+		o.pos[first] = o.pos[i]
+		for j := first + 1; j <= i; j++ {
+			keep[j] = false
+		}
+		changed = true
+	}
+	if changed {
+		o.compact(keep)
+	}
+	return changed
+}
+
+// callPure calls the builtin that c calls, if it is pure, and
+// says if it gave a constant. Calls that fail, or panic, are
+// left to fail when they run.
+func (o *optimizer) callPure(c CallInstr, args []Sexp) (res Sexp, folded bool) {
+	f, ok := o.env.builtins[c.sym.number]
+	if !ok || !isPure(c.sym.name, f.userfun) {
+		return nil, false
+	}
+	defer func() {
+		if recover() != nil {
+			res, folded = nil, false
+		}
+	}()
+	res, err := f.userfun(o.env, c.sym.name, args)
+	if err != nil || !isConstantAtom(res) {
+		return nil, false
+	}
+	return res, true
+}
+
+// isConstantAtom says if x is a value that a push can share
+// between runs.
+func isConstantAtom(x Sexp) bool {
+	switch x.(type) {
+	case *SexpInt, *SexpUint64, *SexpFloat, *SexpBool, *SexpChar, *SexpStr:
+		return true
+	}
+	return false
+}
+
+// dropPushPops removes a push, or dup, that is popped by the
+// next instruction.
+func (o *optimizer) dropPushPops() bool {
+	is := o.targets()
+	keep := allKept(len(o.code))
+	changed := false
+	for i := 0; i+1 < len(o.code); i++ {
+		switch o.code[i].(type) {
+		case PushInstr, DupInstr:
+		default:
+			continue
+		}
+		if _, isPop := o.code[i+1].(PopInstr); !isPop || is[i+1] {
+			continue
+		}
+		keep[i], keep[i+1] = false, false
+		changed = true
+		i++
+	}
+	if changed {
+		o.compact(keep)
+	}
+	return changed
+}
+
+// threadJumps points a jump or branch that lands on a jump to
+// where that jump goes, drops jumps to the next instruction, and
+// has a branch to the next instruction just pop what it tests.
+func (o *optimizer) threadJumps() bool {
+	keep := allKept(len(o.code))
+	changed := false
+	for i, in := range o.code {
+		switch in.(type) {
+		case JumpInstr, BranchInstr, GotoInstr:
+		default:
+			continue
+		}
+		t, _ := o.target(i)
+		for hops := 0; hops < len(o.code) && t < len(o.code) && t != i; hops++ {
+			switch o.code[t].(type) {
+			case JumpInstr, GotoInstr:
+				t, _ = o.target(t)
+				continue
+			}
+			break
+		}
+		if old, _ := o.target(i); old != t {
+			o.code[i] = retarget(in, i, t)
+			changed = true
+		}
+		if t == i+1 {
+			switch in.(type) {
+			case BranchInstr:
+				o.code[i] = PopInstr(0)
+			default:
+				keep[i] = false
+			}
+			changed = true
+		}
+	}
+	if changed {
+		o.compact(keep)
+	}
+	return changed
+}
+
+// removeDeadCode removes the instructions that nothing reaches:
+// those after a return, throw, break, continue or jump, that no
+// jump lands on.
+func (o *optimizer) removeDeadCode() bool {
+	if o.targets() == nil {
+		return false
+	}
+	n := len(o.code)
+	reached := make([]bool, n)
+	work := []int{0}
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		if i >= n || reached[i] {
+			continue
+		}
+		reached[i] = true
+		next := []int{i + 1}
+		switch in := o.code[i].(type) {
+		case JumpInstr, GotoInstr:
+			t, _ := o.target(i)
+			next = []int{t}
+		case BranchInstr, TryStartInstr:
+			t, _ := o.target(i)
+			next = append(next, t)
+		case ReturnInstr, ThrowInstr:
+			next = nil
+		case *BreakInstr:
+			s, ok := o.loops[in.loop]
+			if !ok {
+				// a loop outside the function; give up.
+				return false
+			}
+			next = []int{s + in.loop.breakOffset}
+		case *ContinueInstr:
+			s, ok := o.loops[in.loop]
+			if !ok {
+				return false
+			}
+			next = []int{s + in.loop.continueOffset}
+		}
+		work = append(work, next...)
+	}
+	changed := false
+	for i := range reached {
+		if !reached[i] {
+			changed = true
+		}
+	}
+	if changed {
+		o.compact(reached)
+	}
+	return changed
+}
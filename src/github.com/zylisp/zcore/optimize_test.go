@@ -0,0 +1,159 @@
+package zcore
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test580OptimizerFoldsThreadsAndPrunes(t *testing.T) {
+
+	cv.Convey(`Given functions with constant arithmetic, nested conds and a break, the optimizer should fold the constants, leave no jump landing on a jump and no code after the break, keep the source map in step, and do none of it with NoOptimize`, t, func() {
+
+		src := `(defn f [x] (cond (> x 1) (+ 1 2 x) (* 2 (+ 1 2))))
+(defn g [n] (for [(def i 0) (< i n) (++ i)] (cond (== i 2) (break) (println i))) (concat "a" "b"))
+(defn h [a b] (cond a (cond b 1 2) 3))
+(defn k [] (/ 1 0))`
+		dump := func(env *Zlisp, name string) (*SexpFunction, string) {
+			x, found := env.FindObject(name)
+			cv.So(found, cv.ShouldBeTrue)
+			fun := x.(*SexpFunction)
+			var b bytes.Buffer
+			FdumpFunction(&b, fun.fun, -1)
+			return fun, b.String()
+		}
+		run := func(noopt bool) *Zlisp {
+			env := NewZlisp()
+			env.StandardSetup()
+			env.NoOptimize = noopt
+			var out bytes.Buffer
+			env.Stdout = &out
+			_, err := env.EvalString(src)
+			cv.So(err, cv.ShouldBeNil)
+
+			res, err := env.EvalString(`[(f 0) (f 5) (g 10) (h true true) (h true false) (h false true)]`)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(res.SexpString(nil), cv.ShouldEqual, `[6 8 "ab" 1 2 3]`)
+			cv.So(out.String(), cv.ShouldEqual, "0\n1\n")
+			_, err = env.EvalString(`(k)`)
+			cv.So(err, cv.ShouldNotBeNil)
+			return env
+		}
+
+		env := run(false)
+		defer env.Stop()
+		fun, f := dump(env, "f")
+		cv.So(f, cv.ShouldContainSubstring, "push 6\n")
+		cv.So(f, cv.ShouldNotContainSubstring, "call *")
+		cv.So(len(fun.srcmap), cv.ShouldEqual, len(fun.fun))
+
+		_, g := dump(env, "g")
+		cv.So(g, cv.ShouldContainSubstring, `push "ab"`)
+		cv.So(g, cv.ShouldNotContainSubstring, "call concat")
+		fun, _ = dump(env, "g")
+		for i, in := range fun.fun {
+			if _, isBreak := in.(*BreakInstr); isBreak {
+				_, isJump := fun.fun[i+1].(JumpInstr)
+				cv.So(isJump, cv.ShouldBeFalse)
+			}
+		}
+
+		fun, _ = dump(env, "h")
+		for i, in := range fun.fun {
+			if j, isJump := in.(JumpInstr); isJump {
+				_, toJump := fun.fun[i+j.addpc].(JumpInstr)
+				cv.So(toJump, cv.ShouldBeFalse)
+			}
+		}
+
+		// a call that fails is left to fail when run.
+		_, k := dump(env, "k")
+		cv.So(k, cv.ShouldContainSubstring, "call / 2")
+
+		plain := run(true)
+		defer plain.Stop()
+		_, f = dump(plain, "f")
+		cv.So(f, cv.ShouldContainSubstring, "call * 2")
+		_, g = dump(plain, "g")
+		cv.So(g, cv.ShouldContainSubstring, "call concat 2")
+	})
+}
+
+// scriptEnvVar has the test binary, run again by Test581, run
+// just the script it names and print what happened, so that each
+// run of a script starts from a fresh process: some scripts
+// register types that a second run in the same one trips over.
+const scriptEnvVar = "ZYLISP_OPTIMIZE_TEST_SCRIPT"
+
+func Test581ScriptsRunTheSameOptimizedOrNot(t *testing.T) {
+	if script := os.Getenv(scriptEnvVar); script != "" {
+		runScriptForTest581(script)
+		return
+	}
+	if testing.Short() {
+		t.Skip("runs every script twice, each in a process of its own")
+	}
+
+	cv.Convey(`Given each of the tests/*.zy scripts, running it with the optimizer and with NoOptimize should give the same output and the same error, if any`, t, func() {
+
+		wd, err := os.Getwd()
+		cv.So(err, cv.ShouldBeNil)
+		here, err := filepath.EvalSymlinks(wd)
+		cv.So(err, cv.ShouldBeNil)
+		root := filepath.Join(here, "../../../..")
+		scripts, err := filepath.Glob(filepath.Join(root, "tests", "*.zy"))
+		cv.So(err, cv.ShouldBeNil)
+		if len(scripts) == 0 {
+			t.Skip("no tests/*.zy to run")
+		}
+
+		// some print pointers, which differ from run to run.
+		addr := regexp.MustCompile(`0x[0-9a-f]+`)
+		run := func(script string, noopt bool) string {
+			cmd := exec.Command(os.Args[0], "-test.run=^Test581")
+			// the scripts name their files from the top of the repo.
+			cmd.Dir = root
+			cmd.Env = append(os.Environ(), scriptEnvVar+"="+script)
+			if noopt {
+				cmd.Env = append(cmd.Env, "ZYLISP_NOOPT=1")
+			}
+			out, _ := cmd.CombinedOutput()
+			return addr.ReplaceAllString(string(out), "0x")
+		}
+
+		for _, script := range scripts {
+			name, err := filepath.Rel(root, script)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(name+":\n"+run(name, false), cv.ShouldEqual, name+":\n"+run(name, true))
+		}
+	})
+}
+
+// runScriptForTest581 runs script as zylisp -demo does, printing
+// its output and any error.
+func runScriptForTest581(script string) {
+	RegisterDemoStructs()
+	env := NewZlisp()
+	defer env.Stop()
+	env.NoOptimize = os.Getenv("ZYLISP_NOOPT") != ""
+	err := env.StandardSetup()
+	if err == nil {
+		env.ImportDemoData()
+		var f *os.File
+		if f, err = os.Open(script); err == nil {
+			defer f.Close()
+			if err = env.LoadFile(f); err == nil {
+				_, err = env.Run()
+			}
+		}
+	}
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+	}
+}
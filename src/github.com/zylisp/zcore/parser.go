@@ -318,6 +318,12 @@ func (parser *Parser) ParseExpression(depth int) (res Sexp, err error) {
 	if err != nil {
 		return SexpEnd, err
 	}
+	// remember where lists, arrays and symbols came from.
+	defer func() {
+		if tok.pos != nil {
+			setPos(res, tok.pos)
+		}
+	}()
 
 	switch tok.typ {
 	case TokenLParen:
@@ -0,0 +1,175 @@
+package zcore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SandboxPolicy grants a sandboxed env specific capabilities,
+// rather than the all-or-nothing choice between NewZlisp and
+// NewZlispSandbox. The zero SandboxPolicy denies everything.
+type SandboxPolicy struct {
+	// ReadRoots: directories (and everything beneath them)
+	// that slurpf, source, import and bload may read from.
+	ReadRoots []string
+
+	// WriteRoots: directories that writef, owritef, save
+	// and bsave may write into.
+	WriteRoots []string
+
+	// EnvVars: names of environment variables that may be
+	// read with getenv or changed with setenv.
+	EnvVars []string
+
+	// Commands: programs that system and sys may run. Under a
+	// policy the command is run directly rather than through
+	// ShellCmd, so the first word must match an entry exactly,
+	// and shell syntax such as pipes is not interpreted.
+	Commands []string
+
+	// AllowExit: may the script call exit/quit and so
+	// terminate the host process.
+	AllowExit bool
+}
+
+// PermissionError is returned when a SandboxPolicy denies
+// a script access to a file, env var, command, or exit.
+type PermissionError struct {
+	Func string // the builtin called, e.g. "slurpf"
+	What string // the path, variable, or command refused
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("permission denied: sandbox policy does not allow "+
+		"'%s' on '%s'", e.Func, e.What)
+}
+
+// Unwrap lets errors.Is(err, os.ErrPermission) succeed.
+func (e *PermissionError) Unwrap() error {
+	return os.ErrPermission
+}
+
+// NewZlispWithPolicy returns a sandboxed *Zlisp that may touch the
+// outside world only as granted by policy. The system functions
+// are present, but check the policy on each call.
+func NewZlispWithPolicy(policy SandboxPolicy) *Zlisp {
+	funcs := SandboxSafeFunctions()
+	for k, v := range SystemFunctions() {
+		funcs[k] = v
+	}
+	env := NewZlispWithFuncs(funcs)
+	env.policy = &policy
+	return env
+}
+
+// Policy returns the env's SandboxPolicy, or nil if the env
+// is not governed by one.
+func (env *Zlisp) Policy() *SandboxPolicy {
+	return env.policy
+}
+
+// checkRead returns a *PermissionError unless the policy (if any)
+// allows reading path.
+func (env *Zlisp) checkRead(fn string, path string) error {
+	if env.policy == nil {
+		return nil
+	}
+	if !underRoots(path, env.policy.ReadRoots) {
+		return &PermissionError{Func: fn, What: path}
+	}
+	return nil
+}
+
+// checkWrite: as checkRead, but against the WriteRoots.
+func (env *Zlisp) checkWrite(fn string, path string) error {
+	if env.policy == nil {
+		return nil
+	}
+	if !underRoots(path, env.policy.WriteRoots) {
+		return &PermissionError{Func: fn, What: path}
+	}
+	return nil
+}
+
+func (env *Zlisp) checkEnvVar(fn string, name string) error {
+	if env.policy == nil {
+		return nil
+	}
+	for _, v := range env.policy.EnvVars {
+		if v == name {
+			return nil
+		}
+	}
+	return &PermissionError{Func: fn, What: name}
+}
+
+func (env *Zlisp) checkCommand(fn string, cmd string) error {
+	if env.policy == nil {
+		return nil
+	}
+	for _, c := range env.policy.Commands {
+		if c == cmd {
+			return nil
+		}
+	}
+	return &PermissionError{Func: fn, What: cmd}
+}
+
+func (env *Zlisp) checkExit(fn string) error {
+	if env.policy == nil || env.policy.AllowExit {
+		return nil
+	}
+	return &PermissionError{Func: fn, What: "the host process"}
+}
+
+// underRoots reports whether path lies at or beneath one of
+// roots, after resolving symlinks so they cannot be used to
+// escape a root.
+func underRoots(path string, roots []string) bool {
+	p, err := resolvePath(path)
+	if err != nil {
+		return false
+	}
+	for _, root := range roots {
+		r, err := resolvePath(root)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(r, p)
+		if err != nil {
+			continue
+		}
+		if rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePath returns an absolute, symlink-free version of path.
+// A path that does not exist yet (as when writing a new file) is
+// resolved via its nearest existing parent directory.
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(abs)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(abs)
+		if parent == abs {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(abs), rest)
+		abs = parent
+	}
+}
@@ -0,0 +1,86 @@
+package zcore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test430SandboxPolicyGrantsOnlyWhatItSays(t *testing.T) {
+
+	cv.Convey(`Given an env made with NewZlispWithPolicy, the filesystem, env var, command and exit builtins should work only where the policy allows, and otherwise return a *PermissionError`, t, func() {
+
+		dir, err := ioutil.TempDir("", "zypolicy")
+		PanicOn(err)
+		defer os.RemoveAll(dir)
+		readDir := filepath.Join(dir, "ro")
+		writeDir := filepath.Join(dir, "rw")
+		PanicOn(os.Mkdir(readDir, 0755))
+		PanicOn(os.Mkdir(writeDir, 0755))
+		cfg := filepath.Join(readDir, "cfg.txt")
+		PanicOn(ioutil.WriteFile(cfg, []byte("hello\n"), 0644))
+		lib := filepath.Join(readDir, "lib.zy")
+		PanicOn(ioutil.WriteFile(lib, []byte("(def fromLib 42)\n"), 0644))
+		secret := filepath.Join(dir, "secret.txt")
+		PanicOn(ioutil.WriteFile(secret, []byte("shh\n"), 0644))
+		PanicOn(os.Symlink(secret, filepath.Join(readDir, "sneaky")))
+		os.Setenv("ZYPOLICY_OK", "yes")
+
+		env := NewZlispWithPolicy(SandboxPolicy{
+			ReadRoots:  []string{readDir},
+			WriteRoots: []string{writeDir},
+			EnvVars:    []string{"ZYPOLICY_OK"},
+			Commands:   []string{"echo"},
+		})
+		defer env.Stop()
+		env.StandardSetup()
+
+		denied := func(script string) {
+			env.Clear()
+			_, err := env.EvalString(script)
+			var pe *PermissionError
+			cv.So(errors.As(err, &pe), cv.ShouldBeTrue)
+			cv.So(errors.Is(err, os.ErrPermission), cv.ShouldBeTrue)
+		}
+		allowed := func(script string) Sexp {
+			env.Clear()
+			res, err := env.EvalString(script)
+			cv.So(err, cv.ShouldBeNil)
+			return res
+		}
+
+		res := allowed(fmt.Sprintf(`(slurpf %q)`, cfg))
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `["hello"]`)
+		denied(fmt.Sprintf(`(slurpf %q)`, secret))
+		denied(fmt.Sprintf(`(slurpf %q)`, filepath.Join(readDir, "sneaky")))
+		denied(fmt.Sprintf(`(slurpf %q)`, filepath.Join(readDir, "..", "secret.txt")))
+		denied(fmt.Sprintf(`(source %q)`, secret))
+		denied(fmt.Sprintf(`(import %q)`, secret))
+		denied(fmt.Sprintf(`(bload %q)`, secret))
+		res = allowed(fmt.Sprintf(`(include %q) fromLib`, lib))
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `42`)
+		denied(fmt.Sprintf(`(include %q)`, secret))
+		denied(fmt.Sprintf(`(include [%q %q])`, lib, secret))
+
+		allowed(fmt.Sprintf(`(writef "hi" %q)`, filepath.Join(writeDir, "out.txt")))
+		denied(fmt.Sprintf(`(writef "hi" %q)`, filepath.Join(readDir, "out.txt")))
+		denied(fmt.Sprintf(`(owritef "hi" %q)`, cfg))
+
+		res = allowed(`(getenv "ZYPOLICY_OK")`)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `"yes"`)
+		denied(`(getenv "HOME")`)
+		denied(`(setenv "PATH" "/tmp")`)
+
+		res = allowed(`(system "echo" "hi;" "ls")`)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `"hi; ls"`)
+		denied(`(system "ls")`)
+		denied(`(sys ls)`)
+
+		denied(`(exit 3)`)
+	})
+}
@@ -0,0 +1,279 @@
+package zcore
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultProfilePeriod is how often StartScriptProfile samples.
+const DefaultProfilePeriod = 10 * time.Millisecond
+
+// scriptProfiler samples the script's own call stack: the VM
+// checks the clock as it goes, and when a period or more has gone
+// by, records where it is, weighted by the periods. Unlike
+// -cpuprofile's, its stacks are of script functions and lines.
+type scriptProfiler struct {
+	w      io.Writer
+	period time.Duration
+	start  time.Time
+	next   int64 // when the next sample is due, in UnixNano
+
+	mu      sync.Mutex
+	samples map[string]*profSample
+}
+
+// profFrame is a function, and the line in it, on a sampled stack.
+type profFrame struct {
+	fun  *SexpFunction
+	line int
+}
+
+type profSample struct {
+	stack []profFrame // innermost first
+	count int64
+}
+
+// StartScriptProfile starts sampling the running script every
+// period (DefaultProfilePeriod if zero), by function and source
+// line, Go builtins included. StopScriptProfile writes what it
+// found to w in the gzipped profile.proto format, for go tool
+// pprof. Clones and Duplicates made meanwhile are sampled too.
+func (env *Zlisp) StartScriptProfile(w io.Writer, period time.Duration) error {
+	if env.profiler != nil {
+		return errors.New("script profile already started")
+	}
+	if period <= 0 {
+		period = DefaultProfilePeriod
+	}
+	start := time.Now()
+	env.profiler = &scriptProfiler{
+		w:       w,
+		period:  period,
+		start:   start,
+		next:    start.Add(period).UnixNano(),
+		samples: make(map[string]*profSample),
+	}
+	return nil
+}
+
+// StopScriptProfile stops the profile StartScriptProfile started,
+// and writes it.
+func (env *Zlisp) StopScriptProfile() error {
+	p := env.profiler
+	if p == nil {
+		return errors.New("no script profile started")
+	}
+	env.profiler = nil
+
+	zw := gzip.NewWriter(p.w)
+	if _, err := zw.Write(p.encode(time.Since(p.start))); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// sample records the stack, if a sample is due. The VM calls it
+// before each instruction, and after each Go builtin returns, so
+// that time in a builtin goes to the builtin.
+func (p *scriptProfiler) sample(env *Zlisp) {
+	now := time.Now().UnixNano()
+	next := atomic.LoadInt64(&p.next)
+	if now < next {
+		return
+	}
+	periods := 1 + (now-next)/int64(p.period)
+	if !atomic.CompareAndSwapInt64(&p.next, next, next+periods*int64(p.period)) {
+		// a Duplicate on another goroutine took it.
+		return
+	}
+
+	n := env.addrstack.Size()
+	stack := make([]profFrame, 0, n+1)
+	key := make([]byte, 0, 16*(n+1))
+	fun, pc := env.curfunc, env.pc
+	for i := n - 1; ; i-- {
+		f := profFrame{fun: fun}
+		if pos := fun.SrcPos(pc); pos != nil {
+			f.line = pos.Line
+		}
+		stack = append(stack, f)
+		key = append(key, fun.name...)
+		key = append(key, byte(f.line), byte(f.line>>8), byte(f.line>>16), 0)
+		if i < 0 {
+			break
+		}
+		// return addresses are just past the call.
+		caller := env.addrstack.elements[i].(Address)
+		fun, pc = caller.function, caller.position-1
+	}
+
+	p.mu.Lock()
+	s := p.samples[string(key)]
+	if s == nil {
+		s = &profSample{stack: stack}
+		p.samples[string(key)] = s
+	}
+	s.count += periods
+	p.mu.Unlock()
+}
+
+// encode renders the profile as a profile.proto message. See
+// https://github.com/google/pprof/blob/main/proto/profile.proto
+// for the field numbers.
+func (p *scriptProfiler) encode(duration time.Duration) []byte {
+	var b protobuf
+	strs := map[string]int64{"": 0}
+	strtab := []string{""}
+	str := func(s string) int64 {
+		i, ok := strs[s]
+		if !ok {
+			i = int64(len(strtab))
+			strs[s] = i
+			strtab = append(strtab, s)
+		}
+		return i
+	}
+	valueType := func(field int, typ, unit string) {
+		var vt protobuf
+		vt.int64(1, str(typ))
+		vt.int64(2, str(unit))
+		b.bytes(field, vt.buf)
+	}
+
+	valueType(1, "samples", "count")
+	valueType(1, "cpu", "nanoseconds")
+
+	type funKey struct {
+		name, file string
+	}
+	funIDs := map[funKey]uint64{}
+	locIDs := map[funKey]map[int]uint64{}
+	var funcs, locs protobuf
+	var nlocs uint64
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range p.samples {
+		ids := make([]uint64, len(s.stack))
+		for i, f := range s.stack {
+			k := funKey{name: f.fun.name}
+			if pkg := f.fun.packageName(); pkg != "" {
+				k.name = pkg + "." + k.name
+			}
+			var startLine int64
+			for _, pos := range f.fun.srcmap {
+				if pos != nil {
+					k.file, startLine = pos.File, int64(pos.Line)
+					break
+				}
+			}
+			fid, ok := funIDs[k]
+			if !ok {
+				fid = uint64(len(funIDs) + 1)
+				funIDs[k] = fid
+				locIDs[k] = map[int]uint64{}
+				var fn protobuf
+				fn.uint64(1, fid)
+				fn.int64(2, str(k.name))
+				sys := k.name
+				if f.fun.user {
+					sys = "builtin " + sys
+				}
+				fn.int64(3, str(sys))
+				fn.int64(4, str(k.file))
+				fn.int64(5, startLine)
+				funcs.bytes(5, fn.buf)
+			}
+			lid, ok := locIDs[k][f.line]
+			if !ok {
+				nlocs++
+				lid = nlocs
+				locIDs[k][f.line] = lid
+				var line, loc protobuf
+				line.uint64(1, fid)
+				line.int64(2, int64(f.line))
+				loc.uint64(1, lid)
+				loc.bytes(4, line.buf)
+				locs.bytes(4, loc.buf)
+			}
+			ids[i] = lid
+		}
+		var sample protobuf
+		sample.packedUint64(1, ids)
+		sample.packedInt64(2, []int64{s.count, s.count * int64(p.period)})
+		b.bytes(2, sample.buf)
+	}
+	b.buf = append(b.buf, locs.buf...)
+	b.buf = append(b.buf, funcs.buf...)
+
+	// the tail adds to the string table, so goes before it is written.
+	var tail protobuf
+	tail.int64(9, p.start.UnixNano())
+	tail.int64(10, int64(duration))
+	var pt protobuf
+	pt.int64(1, str("cpu"))
+	pt.int64(2, str("nanoseconds"))
+	tail.bytes(11, pt.buf)
+	tail.int64(12, int64(p.period))
+	for _, s := range strtab {
+		b.string(6, s)
+	}
+	b.buf = append(b.buf, tail.buf...)
+	return b.buf
+}
+
+// protobuf builds a protocol buffer message, as much of the
+// wire format as profile.proto needs.
+type protobuf struct {
+	buf []byte
+}
+
+func (b *protobuf) varint(x uint64) {
+	for x >= 0x80 {
+		b.buf = append(b.buf, byte(x)|0x80)
+		x >>= 7
+	}
+	b.buf = append(b.buf, byte(x))
+}
+
+func (b *protobuf) uint64(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.varint(uint64(field) << 3)
+	b.varint(x)
+}
+
+func (b *protobuf) int64(field int, x int64) {
+	b.uint64(field, uint64(x))
+}
+
+func (b *protobuf) bytes(field int, x []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(x)))
+	b.buf = append(b.buf, x...)
+}
+
+func (b *protobuf) string(field int, s string) {
+	b.bytes(field, []byte(s))
+}
+
+func (b *protobuf) packedUint64(field int, xs []uint64) {
+	var p protobuf
+	for _, x := range xs {
+		p.varint(x)
+	}
+	b.bytes(field, p.buf)
+}
+
+func (b *protobuf) packedInt64(field int, xs []int64) {
+	var p protobuf
+	for _, x := range xs {
+		p.varint(uint64(x))
+	}
+	b.bytes(field, p.buf)
+}
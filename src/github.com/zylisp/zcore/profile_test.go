@@ -0,0 +1,45 @@
+package zcore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test540ScriptProfileIsByScriptFunction(t *testing.T) {
+
+	cv.Convey(`Given a script profile, the samples should be of script functions and builtins, with their files, in gzipped profile.proto`, t, func() {
+
+		env := NewZlisp()
+		defer env.Stop()
+		cv.So(env.StandardSetup(), cv.ShouldBeNil)
+		cv.So(env.StopScriptProfile(), cv.ShouldNotBeNil)
+
+		var out bytes.Buffer
+		cv.So(env.StartScriptProfile(&out, time.Millisecond), cv.ShouldBeNil)
+		cv.So(env.StartScriptProfile(&out, 0), cv.ShouldNotBeNil)
+
+		err := env.LoadString("(defn fib [n]\n  (cond (< n 2) n\n    (+ (fib (- n 1)) (fib (- n 2)))))\n(fib 18)")
+		cv.So(err, cv.ShouldBeNil)
+		_, err = env.Run()
+		cv.So(err, cv.ShouldBeNil)
+		for start := time.Now(); time.Since(start) < 200*time.Millisecond; {
+			_, err = env.EvalString(`(fib 15)`)
+			cv.So(err, cv.ShouldBeNil)
+		}
+		cv.So(env.StopScriptProfile(), cv.ShouldBeNil)
+
+		zr, err := gzip.NewReader(&out)
+		cv.So(err, cv.ShouldBeNil)
+		pb, err := io.ReadAll(zr)
+		cv.So(err, cv.ShouldBeNil)
+		t.Logf("%q", pb)
+		for _, want := range []string{"fib", "builtin ", "samples", "nanoseconds"} {
+			cv.So(bytes.Contains(pb, []byte(want)), cv.ShouldBeTrue)
+		}
+	})
+}
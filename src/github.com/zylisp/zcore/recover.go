@@ -0,0 +1,55 @@
+package zcore
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// PanicError is what a Go panic, in a builtin or in the VM
+// itself, becomes. Set RePanic on the Zlisp to let panics
+// through instead, for debugging.
+type PanicError struct {
+	Value    interface{} // what was passed to panic
+	Function string      // the function running at the time
+	Pos      *SrcPos     // the script position, if known
+	Stack    []byte      // the Go stack at the panic
+}
+
+func (e *PanicError) Error() string {
+	if e.Pos != nil {
+		return fmt.Sprintf("panic in '%s' at %s: %v", e.Function, e.Pos, e.Value)
+	}
+	return fmt.Sprintf("panic in '%s': %v", e.Function, e.Value)
+}
+
+// Unwrap gives the value panicked with, if it was an error.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// panicError makes a PanicError for recovered, which must be
+// called from the deferred function that recovered it, so that
+// the stack is that of the panic.
+func (env *Zlisp) panicError(recovered interface{}) *PanicError {
+	return &PanicError{
+		Value:    recovered,
+		Function: env.curfunc.name,
+		Pos:      env.Position(),
+		Stack:    debug.Stack(),
+	}
+}
+
+// callGuarded calls the Go function behind fun, turning a
+// panic into a PanicError unless env.RePanic is set.
+func (env *Zlisp) callGuarded(fun *SexpFunction, name string, args []Sexp) (res Sexp, err error) {
+	defer func() {
+		if env.RePanic {
+			return
+		}
+		if r := recover(); r != nil {
+			res, err = SexpNull, env.panicError(r)
+		}
+	}()
+	return fun.userfun(env, name, args)
+}
@@ -0,0 +1,69 @@
+package zcore
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test480PanicsBecomeScriptErrors(t *testing.T) {
+
+	cv.Convey(`Given a builtin that panics, the panic should become a *PanicError carrying the Go stack and the script position, try should be able to catch it, the environment should remain usable, also when called from Go, and with RePanic set the panic should go through`, t, func() {
+
+		env := NewZlisp()
+		defer env.Stop()
+		cv.So(env.StandardSetup(), cv.ShouldBeNil)
+
+		env.AddFunction("boom", func(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+			var m map[string]int
+			m["x"] = 1
+			return SexpNull, nil
+		})
+
+		_, err := env.EvalString("(def x 1)\n  (boom)")
+		cv.So(err, cv.ShouldNotBeNil)
+		var pe *PanicError
+		cv.So(errors.As(err, &pe), cv.ShouldBeTrue)
+		cv.So(pe.Function, cv.ShouldEqual, "boom")
+		cv.So(pe.Pos.String(), cv.ShouldEqual, "2:3")
+		cv.So(pe.Error(), cv.ShouldContainSubstring, "assignment to entry in nil map")
+		cv.So(string(pe.Stack), cv.ShouldContainSubstring, "recover_test.go")
+		cv.So(env.GetStackTrace(err), cv.ShouldContainSubstring, "Go stack at the panic:")
+
+		env.Clear()
+		res, err := env.EvalString(`(try (boom) (catch e (:msg e)))`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldContainSubstring, "panic in 'boom' at 1:6")
+		res, err = env.EvalString(`(+ x 1)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `2`)
+
+		// as should calls from Go, through Call, Apply and MakeGoFunc.
+		cv.So(env.RegisterGoFunc("goboom", func(k string) int {
+			var m map[string]int
+			m[k] = 1
+			return 0
+		}), cv.ShouldBeNil)
+		_, err = env.Call("goboom", "x")
+		cv.So(errors.As(err, &pe), cv.ShouldBeTrue)
+		cv.So(pe.Error(), cv.ShouldContainSubstring, "assignment to entry in nil map")
+		x, _ := env.FindObject("boom")
+		_, err = env.Apply(x.(*SexpFunction), nil)
+		cv.So(errors.As(err, &pe), cv.ShouldBeTrue)
+		x, _ = env.FindObject("goboom")
+		_, err = env.ApplyContext(context.Background(), x.(*SexpFunction), []Sexp{&SexpStr{S: "x"}})
+		cv.So(errors.As(err, &pe), cv.ShouldBeTrue)
+		f, err := MakeGoFuncAs[func(string) (int, error)](env, x.(*SexpFunction))
+		cv.So(err, cv.ShouldBeNil)
+		_, err = f("x")
+		cv.So(errors.As(err, &pe), cv.ShouldBeTrue)
+		res, err = env.EvalString(`(+ x 1)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `2`)
+
+		env.RePanic = true
+		cv.So(func() { env.EvalString(`(boom)`) }, cv.ShouldPanic)
+	})
+}
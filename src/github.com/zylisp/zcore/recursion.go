@@ -0,0 +1,86 @@
+package zcore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DefaultMaxRecursionDepth is how deeply calls may nest in an env
+// whose MaxRecursionDepth is zero.
+const DefaultMaxRecursionDepth = 10000
+
+// ErrMaxRecursionDepth is what a *RecursionDepthError is, for
+// errors.Is.
+var ErrMaxRecursionDepth = errors.New("maximum recursion depth exceeded")
+
+// RecursionDepthError is returned when a call would nest deeper
+// than the env's MaxRecursionDepth. It can be caught by try, as
+// the stacks are unwound to the handler.
+type RecursionDepthError struct {
+	Max int
+
+	// Functions are the names of the functions that recur on
+	// the call stack, innermost first, and Calls how many frames
+	// each has there. If none recur, all the frames are listed.
+	Functions []string
+	Calls     []int
+}
+
+func (e *RecursionDepthError) Error() string {
+	var in []string
+	for i, name := range e.Functions {
+		in = append(in, fmt.Sprintf("%s (%d frames)", name, e.Calls[i]))
+	}
+	return fmt.Sprintf("%v: depth %d, in %s", ErrMaxRecursionDepth, e.Max, strings.Join(in, ", "))
+}
+
+func (e *RecursionDepthError) Is(target error) bool {
+	return target == ErrMaxRecursionDepth
+}
+
+// maxRecursionDepth gives the limit in force, or 0 for none.
+func (env *Zlisp) maxRecursionDepth() int {
+	switch {
+	case env.MaxRecursionDepth == 0:
+		return DefaultMaxRecursionDepth
+	case env.MaxRecursionDepth < 0:
+		return 0
+	}
+	return env.MaxRecursionDepth
+}
+
+// pushCall notes the return address of a call about to be made
+// from env.pc, with its args, unless the calls would then nest
+// too deeply.
+func (env *Zlisp) pushCall(args []Sexp) error {
+	if max := env.maxRecursionDepth(); max > 0 && env.addrstack.Size() >= max {
+		return env.recursionDepthError(max)
+	}
+	env.addrstack.pushCall(env.curfunc, env.pc+1, args)
+	return nil
+}
+
+func (env *Zlisp) recursionDepthError(max int) *RecursionDepthError {
+	var names []string
+	count := map[string]int{}
+	for _, f := range env.Frames() {
+		if count[f.Function] == 0 {
+			names = append(names, f.Function)
+		}
+		count[f.Function]++
+	}
+	e := &RecursionDepthError{Max: max}
+	for _, recur := range []bool{true, false} {
+		for _, name := range names {
+			if !recur || count[name] > 1 {
+				e.Functions = append(e.Functions, name)
+				e.Calls = append(e.Calls, count[name])
+			}
+		}
+		if len(e.Functions) > 0 {
+			break
+		}
+	}
+	return e
+}
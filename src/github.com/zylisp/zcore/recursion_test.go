@@ -0,0 +1,53 @@
+package zcore
+
+import (
+	"errors"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test610RecursionGoesAsDeepAsMaxRecursionDepth(t *testing.T) {
+
+	cv.Convey(`Given non-tail recursion, calls should nest up to MaxRecursionDepth and past it fail with an ErrMaxRecursionDepth naming the recursive functions, which try can catch, leaving the env usable`, t, func() {
+
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		_, err := env.EvalString(`
+(defn sum [n] (cond (== n 0) 0 (+ n (sum (- n 1)))))
+(defn ping [n] (+ 1 (pong n)))
+(defn pong [n] (+ 1 (ping n)))`)
+		cv.So(err, cv.ShouldBeNil)
+
+		res, err := env.EvalString(`(sum 9000)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "40504500")
+
+		_, err = env.EvalString(`(sum 20000)`)
+		cv.So(errors.Is(err, ErrMaxRecursionDepth), cv.ShouldBeTrue)
+		var rde *RecursionDepthError
+		cv.So(errors.As(err, &rde), cv.ShouldBeTrue)
+		cv.So(rde.Max, cv.ShouldEqual, DefaultMaxRecursionDepth)
+		cv.So(rde.Functions, cv.ShouldResemble, []string{"sum"})
+		env.Clear()
+
+		env.MaxRecursionDepth = 50
+		_, err = env.EvalString(`(ping 1)`)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldEqual,
+			"maximum recursion depth exceeded: depth 50, in pong (25 frames), ping (25 frames)")
+		env.Clear()
+
+		res, err = env.EvalString(`[(try (sum 100) (catch e (:type e))) (sum 40)]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `["*zcore.RecursionDepthError" 820]`)
+		cv.So(env.addrstack.Size(), cv.ShouldEqual, 0)
+
+		env.MaxRecursionDepth = -1
+		res, err = env.EvalString(`(sum 30000)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "450015000")
+	})
+}
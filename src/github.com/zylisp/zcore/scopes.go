@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"sync"
 )
 
 // Scopes map names to values. Scope nesting avoids variable name collisions and
@@ -21,6 +22,96 @@ type Scope struct {
 	MyFunction  *SexpFunction // so we can query captured closure scopes.
 	IsPackage   bool
 	env         *Zlisp
+
+	// mu is set only on scopes that goroutines may share: the
+	// global scope and package scopes. Access Map through
+	// lookup, store and remove to respect it.
+	mu *sync.RWMutex
+
+	// layout, on scopes that generated code pushes, gives the
+	// symbols that the code binds a slot each in slots, in
+	// place of an entry in Map; see lexical.go. An empty slot
+	// is an unbound symbol.
+	layout *scopeLayout
+	slots  []Sexp
+}
+
+// setLayout gives s the slots of layout.
+func (s *Scope) setLayout(layout *scopeLayout) {
+	if layout != nil {
+		s.layout = layout
+		s.slots = make([]Sexp, len(layout.syms))
+	}
+}
+
+func (s *Scope) lookup(num int) (Sexp, bool) {
+	if s.layout != nil {
+		if i := s.layout.slot(num); i >= 0 {
+			return s.slots[i], s.slots[i] != nil
+		}
+	}
+	if s.mu != nil {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+	}
+	val, ok := s.Map[num]
+	return val, ok
+}
+
+func (s *Scope) store(num int, val Sexp) {
+	if s.layout != nil {
+		if i := s.layout.slot(num); i >= 0 {
+			s.slots[i] = val
+			return
+		}
+	}
+	if s.mu != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	s.Map[num] = val
+}
+
+func (s *Scope) remove(num int) {
+	if s.layout != nil {
+		if i := s.layout.slot(num); i >= 0 {
+			s.slots[i] = nil
+			return
+		}
+	}
+	if s.mu != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	delete(s.Map, num)
+}
+
+// each calls f on each symbol bound in s, in its slots and in
+// its Map.
+func (s *Scope) each(f func(num int, val Sexp)) {
+	for i, val := range s.slots {
+		if val != nil {
+			f(s.layout.syms[i].number, val)
+		}
+	}
+	s.rlock()
+	defer s.runlock()
+	for num, val := range s.Map {
+		f(num, val)
+	}
+}
+
+// rlock and runlock bracket iteration over Map.
+func (s *Scope) rlock() {
+	if s.mu != nil {
+		s.mu.RLock()
+	}
+}
+
+func (s *Scope) runlock() {
+	if s.mu != nil {
+		s.mu.RUnlock()
+	}
 }
 
 // SexpString satisfies the Sexp interface, producing a string presentation of the value.
@@ -66,9 +157,9 @@ func (env *Zlisp) NewNamedScope(name string) *Scope {
 
 func (s *Scope) CloneScope() *Scope {
 	n := s.env.NewScope()
-	for k, v := range s.Map {
+	s.each(func(k int, v Sexp) {
 		n.Map[k] = v
-	}
+	})
 	return n
 }
 
@@ -87,6 +178,26 @@ func (stack *Stack) PopScope() error {
 	return err
 }
 
+// pushScope and popScope are for the VM's own scopes, which
+// a Tracer is told of.
+func (env *Zlisp) pushScope(sc *Scope) {
+	env.linearstack.Push(sc)
+	if env.tracer != nil {
+		env.tracer.ScopePush(env, sc)
+	}
+}
+
+func (env *Zlisp) popScope() error {
+	if env.tracer != nil {
+		if top, err := env.linearstack.Get(0); err == nil {
+			if sc, ok := top.(*Scope); ok {
+				env.tracer.ScopePop(env, sc)
+			}
+		}
+	}
+	return env.linearstack.PopScope()
+}
+
 // dynamic scoping lookup. See env.LexicalLookupSymbol() for the lexically
 // scoped equivalent.
 // If setVal is not nil, and if we find the symbol, we set it in the scope
@@ -103,11 +214,11 @@ func (stack *Stack) lookupSymbol(sym *SexpSymbol, minFrame int, setVal *Sexp) (S
 			}
 			switch scope := elem.(type) {
 			case (*Scope):
-				expr, ok := scope.Map[sym.number]
+				expr, ok := scope.lookup(sym.number)
 				if ok {
 					//P("lookupSymbol at stack scope# i=%v, we found sym '%s' with value '%s'", i, sym.name, expr.SexpString(0))
 					if setVal != nil {
-						scope.Map[sym.number] = *setVal
+						scope.store(sym.number, *setVal)
 					}
 					return expr, nil, scope
 				}
@@ -148,7 +259,7 @@ func (stack *Stack) LookupSymbolUntilFunction(sym *SexpSymbol, setVal *Sexp, max
 			switch scope := elem.(type) {
 			case (*Scope):
 				VPrintf("   ...looking up in scope '%s'\n", scope.Name)
-				expr, ok := scope.Map[sym.number]
+				expr, ok := scope.lookup(sym.number)
 				if ok {
 					if setVal != nil {
 						scope.UpdateSymbolInScope(sym, *setVal)
@@ -180,7 +291,7 @@ func (stack *Stack) LookupSymbolUntilFunction(sym *SexpSymbol, setVal *Sexp, max
 	}
 
 	if stack != nil && stack.env != nil && stack.env.debugSymbolNotFound {
-		fmt.Printf("debugSymbolNotFound is true, here are scopes:\n")
+		fmt.Fprintf(stack.env.Stdout, "debugSymbolNotFound is true, here are scopes:\n")
 		stack.env.ShowStackStackAndScopeStack()
 	}
 	return SexpNull, SymNotFound, nil
@@ -190,17 +301,16 @@ func (stack *Stack) BindSymbol(sym *SexpSymbol, expr Sexp) error {
 	if stack.IsEmpty() {
 		panic("empty stack!!")
 	}
-	cur, already := stack.elements[stack.tos].(*Scope).Map[sym.number]
+	top := stack.elements[stack.tos].(*Scope)
+	cur, already := top.lookup(sym.number)
 	if already {
-		Q("BindSymbol already sees symbol %v, currently bound to '%v'", sym.name, cur.SexpString(nil))
-
 		lhsTy := cur.Type()
 		rhsTy := expr.Type()
 		if lhsTy == nil {
 			// for backcompat with closure.zy, just do the binding for now if the LHS isn't typed.
 			//return fmt.Errorf("left-hand-side had nil type")
 			// TODO: fix this? or require removal of previous symbol binding to avoid type errors?
-			stack.elements[stack.tos].(*Scope).Map[sym.number] = expr
+			top.store(sym.number, expr)
 			return nil
 		}
 		if rhsTy == nil {
@@ -212,11 +322,10 @@ func (stack *Stack) BindSymbol(sym *SexpSymbol, expr Sexp) error {
 		}
 
 		// both sides have type
-		Q("BindSymbol: both sides have type. rhs=%v, lhs=%v", rhsTy.SexpString(nil), lhsTy.SexpString(nil))
 
 		if lhsTy == rhsTy {
 			Q("BindSymbol: YES types match exactly. Good.")
-			stack.elements[stack.tos].(*Scope).Map[sym.number] = expr
+			top.store(sym.number, expr)
 			return nil
 		}
 
@@ -235,7 +344,7 @@ func (stack *Stack) BindSymbol(sym *SexpSymbol, expr Sexp) error {
 		if lhsTy.TypeCache != nil && rhsTy.TypeCache != nil {
 			if rhsTy.TypeCache.AssignableTo(lhsTy.TypeCache) {
 				Q("BindSymbol: YES: rhsTy.TypeCache (%v) is AssigntableTo(lhsTy.TypeCache) (%v). Good.", rhsTy.TypeCache, lhsTy.TypeCache)
-				stack.elements[stack.tos].(*Scope).Map[sym.number] = expr
+				top.store(sym.number, expr)
 				return nil
 			}
 		}
@@ -244,7 +353,7 @@ func (stack *Stack) BindSymbol(sym *SexpSymbol, expr Sexp) error {
 	} else {
 		Q("BindSymbol: new symbol %v", sym.name)
 	}
-	stack.elements[stack.tos].(*Scope).Map[sym.number] = expr
+	top.store(sym.number, expr)
 	return nil
 }
 
@@ -253,32 +362,33 @@ func (stack *Stack) DeleteSymbolFromTopOfStackScope(sym *SexpSymbol) error {
 		panic("empty stack!!")
 		//return errors.New("no scope available")
 	}
-	_, present := stack.elements[stack.tos].(*Scope).Map[sym.number]
+	top := stack.elements[stack.tos].(*Scope)
+	_, present := top.lookup(sym.number)
 	if !present {
 		return fmt.Errorf("symbol `%s` not found", sym.name)
 	}
-	delete(stack.elements[stack.tos].(*Scope).Map, sym.number)
+	top.remove(sym.number)
 	return nil
 }
 
 // UpdateSymbolInScope: used to implement (set v 10)
 func (scope *Scope) UpdateSymbolInScope(sym *SexpSymbol, expr Sexp) error {
 
-	_, found := scope.Map[sym.number]
+	_, found := scope.lookup(sym.number)
 	if !found {
 		return fmt.Errorf("symbol `%s` not found", sym.name)
 	}
-	scope.Map[sym.number] = expr
+	scope.store(sym.number, expr)
 	return nil
 }
 
 func (scope *Scope) DeleteSymbolInScope(sym *SexpSymbol) error {
 
-	_, found := scope.Map[sym.number]
+	_, found := scope.lookup(sym.number)
 	if !found {
 		return fmt.Errorf("symbol `%s` not found", sym.name)
 	}
-	delete(scope.Map, sym.number)
+	scope.remove(sym.number)
 	return nil
 }
 
@@ -317,14 +427,21 @@ func (scop *Scope) Show(env *Zlisp, ps *PrintState, label string) (s string, err
 		s += fmt.Sprintf("%s (global scope - omitting content for brevity)\n", rep4)
 		return
 	}
-	if len(scop.Map) == 0 {
+	// copy out under the lock; printing values may visit other scopes.
+	var nums []int
+	var vals []Sexp
+	scop.each(func(symbolNumber int, val Sexp) {
+		nums = append(nums, symbolNumber)
+		vals = append(vals, val)
+	})
+	if len(nums) == 0 {
 		s += fmt.Sprintf("%s empty-scope: no symbols\n", rep4)
 		return
 	}
 	sortme := []*SymtabE{}
-	for symbolNumber, val := range scop.Map {
-		symbolName := env.revsymtable[symbolNumber]
-		sortme = append(sortme, &SymtabE{Key: symbolName, Val: val.SexpString(ps)})
+	for i := range nums {
+		symbolName := env.symtable.name(nums[i])
+		sortme = append(sortme, &SymtabE{Key: symbolName, Val: vals[i].SexpString(ps)})
 	}
 	sort.Sort(SymtabSorter(sortme))
 	for i := range sortme {
@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"os"
 	"strings"
 )
 
@@ -20,11 +19,14 @@ func SlurpfileFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	default:
 		return SexpNull, fmt.Errorf("slurp requires a string path to read. we got type %T / value = %v", args[0], args[0])
 	}
+	if err := env.checkRead(name, fn); err != nil {
+		return SexpNull, err
+	}
 
-	if !FileExists(string(fn)) {
+	if !env.fileExists(fn) {
 		return SexpNull, fmt.Errorf("file '%s' does not exist", fn)
 	}
-	f, err := os.Open(fn)
+	f, err := env.openFile(fn)
 	if err != nil {
 		return SexpNull, err
 	}
@@ -76,17 +78,20 @@ func WriteToFileFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	default:
 		return SexpNull, fmt.Errorf("owrite requires a string (SexpStr) path to write to as the second argument. we got type %T / value = %v", args[1], args[1])
 	}
+	if err := env.checkWrite(name, fn); err != nil {
+		return SexpNull, err
+	}
 
 	if name == "write" || name == "writef" || name == "save" {
 		// don't overwrite existing file
-		if FileExists(fn) {
+		if env.fileExists(fn) {
 			return SexpNull, fmt.Errorf("refusing to write to existing file '%s'",
 				fn)
 		}
 	}
 	// owrite / owritef overwrite indiscriminately.
 
-	f, err := os.Create(fn)
+	f, err := env.createFile(fn)
 	if err != nil {
 		return SexpNull, err
 	}
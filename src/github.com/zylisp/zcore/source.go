@@ -20,13 +20,16 @@ func SimpleSourceFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	}
 
 	file := src.S
-	if !FileExists(file) {
+	if err := env.checkRead(name, file); err != nil {
+		return SexpNull, err
+	}
+	if !env.fileExists(file) {
 		return SexpNull, fmt.Errorf("path '%s' does not exist", file)
 	}
 
 	env2 := env.Duplicate()
 
-	f, err := os.Open(file)
+	f, err := env.openFile(file)
 	if err != nil {
 		return SexpNull, err
 	}
@@ -46,20 +49,34 @@ func SimpleSourceFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 
 // SourceExpressions: SourceExpressions, this should be called from a user func context
 func (env *Zlisp) SourceExpressions(expressions []Sexp) error {
+	fun, err := env.compileSource(expressions)
+	if err != nil {
+		return err
+	}
+	return env.runSource(fun)
+}
+
+// compileSource generates the function that runs expressions.
+func (env *Zlisp) compileSource(expressions []Sexp) (*SexpFunction, error) {
 	gen := NewGenerator(env)
 
 	err := gen.GenerateBegin(expressions)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	//P("debug: in SourceExpressions, FROM expressions='%s'", (&SexpArray{Val: expressions, Env: env}).SexpString(0))
 	//P("debug: in SourceExpressions, gen=")
 	//DumpFunction(ZlispFunction(gen.instructions), -1)
+	return gen.makeFunction("__source", 0, false, nil), nil
+}
+
+// runSource runs fun, from compileSource, leaving its result on
+// the datastack.
+func (env *Zlisp) runSource(fun *SexpFunction) error {
 	curfunc := env.curfunc
 	curpc := env.pc
 
-	env.curfunc = env.MakeFunction("__source", 0, false,
-		gen.instructions, nil)
+	env.curfunc = fun
 	env.pc = 0
 
 	result, err := env.Run()
@@ -91,7 +108,7 @@ func (env *Zlisp) SourceStream(stream io.RuneScanner) error {
 }
 
 func (env *Zlisp) SourceFile(file *os.File) error {
-	return env.SourceStream(bufio.NewReader(file))
+	return env.SourceStream(&NamedInput{RuneScanner: bufio.NewReader(file), Name: file.Name()})
 }
 
 func SourceFileFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
@@ -131,14 +148,18 @@ func (env *Zlisp) sourceItem(item Sexp) error {
 			expr = list.Tail
 		}
 	case *SexpStr:
-		var f *os.File
-		var err error
-
-		if f, err = os.Open(t.S); err != nil {
+		if err := env.checkRead("source", t.S); err != nil {
+			return err
+		}
+		if env.CacheBytecode {
+			return env.sourceCached(t.S)
+		}
+		f, err := env.openFile(t.S)
+		if err != nil {
 			return err
 		}
 		defer f.Close()
-		if err = env.SourceFile(f); err != nil {
+		if err = env.SourceStream(&NamedInput{RuneScanner: bufio.NewReader(f), Name: t.S}); err != nil {
 			return err
 		}
 
@@ -0,0 +1,131 @@
+package zcore
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SrcPos locates a token, a parsed expression, or a generated
+// instruction in the source it came from.
+type SrcPos struct {
+	File string // empty when parsing a string, or at the repl
+	Line int    // 1-based
+	Col  int    // 1-based, counting runes
+
+	src *srcLine
+}
+
+// srcLine holds the text of one line of input, shared by the
+// positions on it. The lexer fills in text once the line is complete.
+type srcLine struct {
+	text string
+}
+
+// String gives file.zy:42:7, or just 42:7 without a file.
+func (p *SrcPos) String() string {
+	if p == nil {
+		return ""
+	}
+	if p.File == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Col)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+}
+
+// Source returns the text of the line that p is on, if known.
+func (p *SrcPos) Source() string {
+	if p == nil || p.src == nil {
+		return ""
+	}
+	return p.src.text
+}
+
+// showSource returns p's source line, and under it a caret
+// pointing at p's column, each indented and newline terminated.
+func (p *SrcPos) showSource() string {
+	line := p.Source()
+	if line == "" {
+		return ""
+	}
+	// keep any tabs, so the caret lines up.
+	var pad strings.Builder
+	for i, r := range []rune(line) {
+		if i >= p.Col-1 {
+			break
+		}
+		if r == '\t' {
+			pad.WriteRune('\t')
+		} else {
+			pad.WriteRune(' ')
+		}
+	}
+	return "    " + line + "\n    " + pad.String() + "^\n"
+}
+
+// NamedInput labels an input stream with the name of the file it
+// reads, for use in source positions. LoadFile does this for
+// *os.File inputs.
+type NamedInput struct {
+	io.RuneScanner
+	Name string
+}
+
+// PosOf returns where in the source sx was parsed from, or
+// nil if unknown. Lists, arrays and symbols have positions.
+func PosOf(sx Sexp) *SrcPos {
+	switch x := sx.(type) {
+	case *SexpPair:
+		return x.pos
+	case *SexpArray:
+		return x.pos
+	case *SexpSymbol:
+		return x.pos
+	}
+	return nil
+}
+
+func setPos(sx Sexp, pos *SrcPos) {
+	switch x := sx.(type) {
+	case *SexpPair:
+		if x.pos == nil {
+			x.pos = pos
+		}
+	case *SexpArray:
+		if x.pos == nil {
+			x.pos = pos
+		}
+	case *SexpSymbol:
+		if x.pos == nil {
+			x.pos = pos
+		}
+	}
+}
+
+// SrcPos returns the source position of the instruction at pc,
+// or nil if there isn't one recorded.
+func (sf *SexpFunction) SrcPos(pc int) *SrcPos {
+	if pc < 0 || pc >= len(sf.srcmap) {
+		return nil
+	}
+	return sf.srcmap[pc]
+}
+
+// Position returns the source position of the code now
+// running, or that just failed. Inside a Go builtin, that
+// is the position of the call.
+func (env *Zlisp) Position() *SrcPos {
+	fun, pc := env.curfunc, env.pc
+	if fun.user || pc < 0 {
+		if env.addrstack.IsEmpty() {
+			return nil
+		}
+		addr, ok := env.addrstack.GetTop().(Address)
+		if !ok {
+			return nil
+		}
+		// the address is that of the return, just after the call.
+		fun, pc = addr.function, addr.position-1
+	}
+	return fun.SrcPos(pc)
+}
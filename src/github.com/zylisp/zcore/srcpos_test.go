@@ -0,0 +1,58 @@
+package zcore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test460SourcePositionsReachErrors(t *testing.T) {
+
+	cv.Convey(`Given a script file, parsed lists, arrays and symbols should carry file:line:col, and runtime errors and assert failures should be reported at the position of the failing form, with its source line`, t, func() {
+
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		env.Parser.ResetAddNewInput(bytes.NewBufferString("(foo\n  [1 2]\tbar)"))
+		xs, err := env.Parser.ParseTokens()
+		cv.So(err, cv.ShouldBeNil)
+		lst := xs[0].(*SexpPair)
+		cv.So(PosOf(lst).String(), cv.ShouldEqual, "1:1")
+		cv.So(PosOf(lst.Head).String(), cv.ShouldEqual, "1:2")
+		arr := lst.Tail.(*SexpPair).Head
+		cv.So(PosOf(arr).String(), cv.ShouldEqual, "2:3")
+		cv.So(PosOf(arr).Source(), cv.ShouldEqual, "  [1 2]\tbar)")
+		bar := lst.Tail.(*SexpPair).Tail.(*SexpPair).Head
+		cv.So(PosOf(bar).String(), cv.ShouldEqual, "2:9")
+
+		dir, err := ioutil.TempDir("", "zysrcpos")
+		PanicOn(err)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "bad.zy")
+		PanicOn(ioutil.WriteFile(path, []byte(
+			"(def x 1)\n(defn f [a]\n  (+ a \"s\"))\n\n(f 2)\n"), 0644))
+
+		f, err := os.Open(path)
+		PanicOn(err)
+		defer f.Close()
+		err = env.LoadFile(f)
+		cv.So(err, cv.ShouldBeNil)
+		_, err = env.Run()
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(env.Position().String(), cv.ShouldEqual, path+":3:3")
+		trace := env.GetStackTrace(err)
+		cv.So(trace, cv.ShouldContainSubstring, "error at "+path+":3:3: Error calling '+'")
+		cv.So(trace, cv.ShouldContainSubstring, "      (+ a \"s\"))\n      ^\n")
+		cv.So(trace, cv.ShouldContainSubstring, "in (__main) at "+path+":5:1")
+
+		env.Clear()
+		_, err = env.EvalString("(def y 1)\n  (assert (== y 2))")
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(env.Position().String(), cv.ShouldEqual, "2:3")
+	})
+}
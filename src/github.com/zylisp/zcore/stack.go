@@ -48,9 +48,8 @@ func (s *Stack) Type() *RegisteredType {
 
 func (env *Zlisp) NewStack(size int) *Stack {
 	return &Stack{
-		tos: -1,
-		//		elements: make([]StackElem, size),
-		elements: make([]StackElem, 0),
+		tos:      -1,
+		elements: make([]StackElem, 0, size),
 		env:      env,
 	}
 }
@@ -139,24 +138,15 @@ func (stack *Stack) Get(n int) (StackElem, error) {
 }
 
 func (stack *Stack) Pop() (StackElem, error) {
-	// always make a new array,
-	// so we can use for the closure stack-of-scopes.
+	// pop in place: the closures keep Clones of the
+	// stack-of-scopes, not the stack itself.
 
 	elem, err := stack.Get(0)
 	if err != nil {
 		return nil, err
 	}
 
-	// invar n > 0
-	n := stack.Size()
-	if n == 0 {
-		return nil, fmt.Errorf("Stack.Pop() on emtpy stack")
-	}
-
-	el := make([]StackElem, n-1)
-	copy(el, stack.elements)
-	stack.elements = el
-	stack.tos--
+	stack.TruncateToSize(stack.tos)
 	return elem, nil
 }
 
@@ -194,9 +184,17 @@ func (stack *Stack) Show(env *Zlisp, ps *PrintState, label string) (string, erro
 
 // TruncateToSize: set newsize to 0 to truncate everything
 func (stack *Stack) TruncateToSize(newsize int) {
-	el := make([]StackElem, newsize)
-	copy(el, stack.elements)
-	stack.elements = el
+	if newsize > len(stack.elements) {
+		el := make([]StackElem, newsize)
+		copy(el, stack.elements)
+		stack.elements = el
+	} else {
+		// clear what is dropped, so it can be collected.
+		for i := newsize; i < len(stack.elements); i++ {
+			stack.elements[i] = nil
+		}
+		stack.elements = stack.elements[:newsize]
+	}
 	stack.tos = newsize - 1
 }
 
@@ -235,7 +233,7 @@ func (s *Stack) nestedPathGetSet(env *Zlisp, dotpaths []string, setVal *Sexp) (S
 			}
 
 			// assign now
-			scop.Map[curSym.number] = *setVal
+			scop.store(curSym.number, *setVal)
 			// done with SET
 			return *setVal, nil
 		}
@@ -0,0 +1,52 @@
+package zcore
+
+import (
+	"bytes"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test490OutputGoesToTheEnvsWriters(t *testing.T) {
+
+	cv.Convey(`Given an env with its own Stdout, the print builtins, timeit, DumpEnvironment and DebugExec tracing should all write there, and Clones and Duplicates should share it`, t, func() {
+
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+		var out bytes.Buffer
+		env.Stdout = &out
+
+		_, err := env.EvalString(`(println "one") (print "two") (printf " %d\n" 3)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(out.String(), cv.ShouldEqual, "one\ntwo 3\n")
+
+		out.Reset()
+		_, err = env.EvalString(`(timeit (fn [] 1))`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(out.String(), cv.ShouldContainSubstring, "average")
+
+		out.Reset()
+		env.DumpEnvironment()
+		cv.So(out.String(), cv.ShouldContainSubstring, "Instructions:")
+
+		out.Reset()
+		env.DebugExec = true
+		_, err = env.EvalString(`(+ 1 2)`)
+		env.DebugExec = false
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(out.String(), cv.ShouldContainSubstring, "about to run")
+
+		// type? reports a type it does not know as an error.
+		_, err = TypeOfErr(&SexpGoroutine{})
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(TypeOf(&SexpGoroutine{}).S, cv.ShouldEqual, "")
+
+		for _, other := range []*Zlisp{env.Clone(), env.Duplicate()} {
+			out.Reset()
+			_, err = other.EvalString(`(println "copied")`)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(out.String(), cv.ShouldEqual, "copied\n")
+		}
+	})
+}
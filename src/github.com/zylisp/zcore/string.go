@@ -41,12 +41,12 @@ func PrintFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 
 	switch name {
 	case "println":
-		fmt.Println(str)
+		fmt.Fprintln(env.Stdout, str)
 	case "print":
-		fmt.Print(str)
+		fmt.Fprint(env.Stdout, str)
 	case "printf", "sprintf":
 		if len(args) == 1 && name == "printf" {
-			fmt.Printf(str)
+			fmt.Fprintf(env.Stdout, str)
 		} else {
 			ar := make([]interface{}, len(args)-1)
 			for i := 0; i < len(ar); i++ {
@@ -68,10 +68,14 @@ func PrintFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 				}
 			}
 			if name == "printf" {
-				fmt.Printf(str, ar...)
+				fmt.Fprintf(env.Stdout, str, ar...)
 			} else {
 				// sprintf
-				return &SexpStr{S: fmt.Sprintf(str, ar...)}, nil
+				s := fmt.Sprintf(str, ar...)
+				if err := env.chargeAlloc(len(s)); err != nil {
+					return SexpNull, err
+				}
+				return &SexpStr{S: s}, nil
 			}
 		}
 	}
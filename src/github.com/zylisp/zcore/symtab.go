@@ -0,0 +1,114 @@
+package zcore
+
+import (
+	"strconv"
+	"sync"
+)
+
+// symbolTable interns symbol names to numbers. A single table
+// is shared by an env and all of its Clones and Duplicates,
+// including those running (go ...) blocks, so that symbols
+// (and hashes keyed by them) mean the same thing on both
+// ends of a channel. Hence the locking.
+type symbolTable struct {
+	mu   sync.RWMutex
+	fwd  map[string]int
+	rev  map[int]string
+	next int
+
+	// gensyms holds the names gensym has given out.
+	gensyms map[string]bool
+}
+
+func newSymbolTable() *symbolTable {
+	return &symbolTable{
+		fwd:     make(map[string]int),
+		rev:     make(map[int]string),
+		next:    1,
+		gensyms: make(map[string]bool),
+	}
+}
+
+// intern returns the number for name, allocating one if needed.
+func (t *symbolTable) intern(name string) int {
+	t.mu.RLock()
+	num, ok := t.fwd[name]
+	t.mu.RUnlock()
+	if ok {
+		return num
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// re-check, someone may have beaten us to it.
+	num, ok = t.fwd[name]
+	if ok {
+		return num
+	}
+	num = t.next
+	t.fwd[name] = num
+	t.rev[num] = name
+	t.next++
+	return num
+}
+
+// name is the reverse of intern.
+func (t *symbolTable) name(num int) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.rev[num]
+}
+
+// gensym returns a fresh, not yet interned, name starting with prefix.
+func (t *symbolTable) gensym(prefix string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for n := t.next; ; n++ {
+		name := prefix + strconv.Itoa(n)
+		if _, taken := t.fwd[name]; !taken {
+			t.gensyms[name] = true
+			return name
+		}
+	}
+}
+
+// isGensym says if name is one that gensym gave out.
+func (t *symbolTable) isGensym(name string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.gensyms[name]
+}
+
+// each calls f on each entry, under the read lock.
+func (t *symbolTable) each(f func(name string, num int)) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for k, v := range t.fwd {
+		f(k, v)
+	}
+}
+
+// macroTable holds the macros, keyed by symbol number. Like
+// the symbolTable, it is shared across Duplicates, and
+// (defmac) may run inside a (go ...) block.
+type macroTable struct {
+	mu sync.RWMutex
+	m  map[int]*SexpFunction
+}
+
+func newMacroTable() *macroTable {
+	return &macroTable{m: make(map[int]*SexpFunction)}
+}
+
+func (t *macroTable) get(num int) (*SexpFunction, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	f, ok := t.m[num]
+	return f, ok
+}
+
+func (t *macroTable) set(num int, f *SexpFunction) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.m[num] = f
+}
@@ -76,10 +76,23 @@ func SystemFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 		return SexpNull, WrongNargs
 	}
 
+	var out []byte
+	if env.policy != nil {
+		// no shell under a policy, so the allowlist can't be
+		// sidestepped with pipes, semicolons, or substitutions.
+		if err := env.checkCommand(name, flat[0]); err != nil {
+			return SexpNull, err
+		}
+		out, err = exec.Command(flat[0], flat[1:]...).CombinedOutput()
+		if err != nil {
+			return SexpNull, fmt.Errorf("error from command: '%s'. Output:'%s'", err, string(Chomp(out)))
+		}
+		return &SexpStr{S: string(Chomp(out))}, nil
+	}
+
 	joined := strings.Join(flat, " ")
 	cmd := ShellCmd
 
-	var out []byte
 	if runtime.GOOS == "windows" {
 		out, err = exec.Command(cmd, "/c", joined).CombinedOutput()
 	} else {
@@ -191,6 +204,10 @@ func GetEnvFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 		}
 	}
 
+	if err := env.checkEnvVar(name, nm[0]); err != nil {
+		return SexpNull, err
+	}
+
 	if name == "getenv" {
 		return &SexpStr{S: os.Getenv(nm[0])}, nil
 	}
@@ -203,6 +220,9 @@ func ExitFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	if len(args) > 1 {
 		return SexpNull, WrongNargs
 	}
+	if err := env.checkExit(name); err != nil {
+		return SexpNull, err
+	}
 	if len(args) == 0 {
 		os.Exit(0)
 	}
@@ -0,0 +1,343 @@
+package zcore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TestFileSuffix marks the files that FindTestFiles finds.
+const TestFileSuffix = "_test.zy"
+
+// FindTestFiles returns the test files named by paths, in fsys
+// (OSFS if nil): a file is taken as it is, and a directory is
+// searched, with those under it, for files ending in
+// TestFileSuffix. No paths means the current directory.
+func FindTestFiles(fsys fs.FS, paths []string) ([]string, error) {
+	if fsys == nil {
+		fsys = OSFS()
+	}
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	var files []string
+	for _, p := range paths {
+		fi, err := fs.Stat(fsys, fsPath(fsys, p))
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		var found []string
+		err = fs.WalkDir(fsys, fsPath(fsys, p), func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && strings.HasSuffix(name, TestFileSuffix) {
+				found = append(found, name)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(found)
+		files = append(files, found...)
+	}
+	return files, nil
+}
+
+// TestResult is how one test went.
+type TestResult struct {
+	File     string
+	Name     string  // "(load)" if the file itself failed
+	Pos      *SrcPos // where it failed, if it did and that is known
+	Err      error   // nil if it passed
+	Output   string  // what it printed
+	Duration time.Duration
+}
+
+// LoadFailure is the Name of the TestResult for a test file that
+// failed to load.
+const LoadFailure = "(load)"
+
+// Passed says if the test passed.
+func (r TestResult) Passed() bool {
+	return r.Err == nil
+}
+
+// Message is the reason the test failed: for a failed assertion,
+// its expected and actual values.
+func (r TestResult) Message() string {
+	if r.Err == nil {
+		return ""
+	}
+	var ae *AssertionError
+	if errors.As(r.Err, &ae) {
+		return ae.Error()
+	}
+	return r.Err.Error()
+}
+
+// TestRunner runs the deftests in test files, each test in an
+// env of its own, into which the test's file is loaded afresh.
+type TestRunner struct {
+	// NewEnv makes the env for a file or test. If nil, it is
+	// NewZlisp with StandardSetup.
+	NewEnv func() (*Zlisp, error)
+
+	// Run, if set, picks the tests to run by name, as go test's
+	// -run does.
+	Run *regexp.Regexp
+
+	// Report, if set, is told of each result as it comes.
+	Report func(TestResult)
+}
+
+func (tr *TestRunner) newEnv() (*Zlisp, error) {
+	if tr.NewEnv != nil {
+		return tr.NewEnv()
+	}
+	env := NewZlisp()
+	if err := env.StandardSetup(); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// RunFiles runs the tests in files, and returns the results in
+// order; it goes on past failures.
+func (tr *TestRunner) RunFiles(files []string) []TestResult {
+	var results []TestResult
+	report := func(r TestResult) {
+		results = append(results, r)
+		if tr.Report != nil {
+			tr.Report(r)
+		}
+	}
+	for _, file := range files {
+		start := time.Now()
+		env, out, err := tr.load(file)
+		if err != nil {
+			r := TestResult{File: file, Name: LoadFailure, Err: err, Output: out.String(),
+				Duration: time.Since(start)}
+			if env != nil {
+				r.Pos = env.Position()
+				env.Stop()
+			}
+			report(r)
+			continue
+		}
+		tests := env.Tests()
+		env.Stop()
+		for _, tc := range tests {
+			if tr.Run != nil && !tr.Run.MatchString(tc.Name) {
+				continue
+			}
+			report(tr.runTest(file, tc.Name))
+		}
+	}
+	return results
+}
+
+// load makes an env, with its output going to a buffer, and
+// loads file into it.
+func (tr *TestRunner) load(file string) (*Zlisp, *bytes.Buffer, error) {
+	out := new(bytes.Buffer)
+	env, err := tr.newEnv()
+	if err != nil {
+		return nil, out, err
+	}
+	env.Stdout, env.Stderr = out, out
+	f, err := env.openFile(file)
+	if err != nil {
+		return env, out, err
+	}
+	defer f.Close()
+	err = env.LoadStream(&NamedInput{RuneScanner: bufio.NewReader(f), Name: file})
+	if err == nil {
+		_, err = env.Run()
+	}
+	return env, out, err
+}
+
+func (tr *TestRunner) runTest(file, name string) TestResult {
+	start := time.Now()
+	res := TestResult{File: file, Name: name}
+	env, out, err := tr.load(file)
+	if env != nil {
+		defer env.Stop()
+	}
+	if err == nil {
+		err = fmt.Errorf("test %s went missing on loading %s again", name, file)
+		for _, tc := range env.Tests() {
+			if tc.Name == name {
+				env.Clear()
+				err = env.RunTest(tc)
+				break
+			}
+		}
+	}
+	if err != nil && env != nil {
+		res.Pos = env.Position()
+	}
+	res.Err, res.Output, res.Duration = err, out.String(), time.Since(start)
+	return res
+}
+
+// TestCounts tallies results.
+func TestCounts(results []TestResult) (passed, failed int) {
+	for i := range results {
+		if results[i].Passed() {
+			passed++
+		} else {
+			failed++
+		}
+	}
+	return
+}
+
+// WriteTestHuman writes a result as go test does: only failures,
+// with their output, unless verbose.
+func WriteTestHuman(w io.Writer, r TestResult, verbose bool) error {
+	secs := r.Duration.Seconds()
+	if r.Passed() {
+		if !verbose {
+			return nil
+		}
+		_, err := fmt.Fprintf(w, "--- PASS: %s (%s) (%.2fs)\n", r.Name, r.File, secs)
+		return err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- FAIL: %s (%s) (%.2fs)\n", r.Name, r.File, secs)
+	where := r.File
+	if r.Pos != nil {
+		where = r.Pos.String()
+	}
+	fmt.Fprintf(&b, "    %s: %s\n", where, indentLines(r.Message(), "    "))
+	if r.Output != "" {
+		fmt.Fprintf(&b, "    output:\n        %s\n", indentLines(strings.TrimRight(r.Output, "\n"), "        "))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteTestSummary ends a human report.
+func WriteTestSummary(w io.Writer, results []TestResult, elapsed time.Duration) error {
+	passed, failed := TestCounts(results)
+	status := "ok"
+	if failed > 0 {
+		status = "FAIL"
+	}
+	_, err := fmt.Fprintf(w, "%s\t%d passed, %d failed (%.2fs)\n", status, passed, failed, elapsed.Seconds())
+	return err
+}
+
+func indentLines(s, indent string) string {
+	return strings.ReplaceAll(s, "\n", "\n"+indent)
+}
+
+// WriteTestTAP writes results in the Test Anything Protocol,
+// version 13, with a YAML block for each failure.
+func WriteTestTAP(w io.Writer, results []TestResult) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "TAP version 13\n1..%d\n", len(results))
+	for i, r := range results {
+		if r.Passed() {
+			fmt.Fprintf(&b, "ok %d - %s: %s\n", i+1, r.File, r.Name)
+			continue
+		}
+		fmt.Fprintf(&b, "not ok %d - %s: %s\n  ---\n  message: |\n    %s\n",
+			i+1, r.File, r.Name, indentLines(r.Message(), "    "))
+		if r.Pos != nil {
+			fmt.Fprintf(&b, "  at: %q\n", r.Pos.String())
+		}
+		if r.Output != "" {
+			fmt.Fprintf(&b, "  output: |\n    %s\n", indentLines(strings.TrimRight(r.Output, "\n"), "    "))
+		}
+		b.WriteString("  ...\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteTestJUnit writes results as JUnit XML, a testsuite per file.
+func WriteTestJUnit(w io.Writer, results []TestResult) error {
+	var doc junitSuites
+	at := map[string]int{}
+	var times []time.Duration
+	for _, r := range results {
+		i, ok := at[r.File]
+		if !ok {
+			i = len(doc.Suites)
+			at[r.File] = i
+			doc.Suites = append(doc.Suites, junitSuite{Name: r.File})
+			times = append(times, 0)
+		}
+		times[i] += r.Duration
+		s := &doc.Suites[i]
+		c := junitCase{Name: r.Name, Classname: path.Base(r.File),
+			Time: fmt.Sprintf("%.3f", r.Duration.Seconds()), SystemOut: r.Output}
+		if !r.Passed() {
+			msg := r.Message()
+			text := msg
+			if r.Pos != nil {
+				text = r.Pos.String() + ": " + msg
+			}
+			c.Failure = &junitFailure{Message: strings.SplitN(msg, "\n", 2)[0], Text: text}
+			s.Failures++
+		}
+		s.Tests++
+		s.Cases = append(s.Cases, c)
+	}
+	for i, d := range times {
+		doc.Suites[i].Time = fmt.Sprintf("%.3f", d.Seconds())
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,247 @@
+package zcore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// A Tracer is told what the VM does, as it does it; attach one
+// with SetTracer. The callbacks run on the interpreter's own
+// goroutine, so they may look at env, but must not change it.
+type Tracer interface {
+	// Instr is called before each instruction of fun runs.
+	Instr(env *Zlisp, fun *SexpFunction, pc int, instr Instruction)
+
+	// Call is called on entering fun, whether compiled or a Go
+	// builtin, and Return on leaving it.
+	Call(env *Zlisp, fun *SexpFunction, args []Sexp)
+	Return(env *Zlisp, fun *SexpFunction, result Sexp)
+
+	// ScopePush and ScopePop are called as runtime scopes are
+	// entered and left.
+	ScopePush(env *Zlisp, scope *Scope)
+	ScopePop(env *Zlisp, scope *Scope)
+
+	// Error is called with each error the VM raises, whether
+	// or not a try catches it.
+	Error(env *Zlisp, err error)
+}
+
+// SetTracer attaches t to env, replacing any Tracer before it.
+// A nil t turns tracing off. Clones and Duplicates get the
+// same Tracer; the ones here are safe for that.
+func (env *Zlisp) SetTracer(t Tracer) {
+	env.tracer = t
+}
+
+// Tracer returns the Tracer attached to env, if any.
+func (env *Zlisp) Tracer() Tracer {
+	return env.tracer
+}
+
+// TraceEvent is a set of the kinds of event a Tracer sees.
+type TraceEvent uint
+
+const (
+	TraceInstr TraceEvent = 1 << iota
+	TraceCall
+	TraceReturn
+	TraceScope
+	TraceError
+
+	TraceAll = TraceInstr | TraceCall | TraceReturn | TraceScope | TraceError
+)
+
+// TraceFilter picks the events that LogTracer and JSONTracer report.
+type TraceFilter struct {
+	// Events to report; zero means TraceAll.
+	Events TraceEvent
+
+	// Funcs, if given, limits the report to events in the
+	// functions so named, including calls to and returns from them.
+	Funcs []string
+}
+
+func (f *TraceFilter) want(ev TraceEvent, fun *SexpFunction) bool {
+	if f.Events != 0 && f.Events&ev == 0 {
+		return false
+	}
+	if len(f.Funcs) == 0 {
+		return true
+	}
+	for _, name := range f.Funcs {
+		if fun != nil && fun.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// traceDepth is how many calls deep the VM is.
+func traceDepth(env *Zlisp) int {
+	return env.addrstack.Size()
+}
+
+func traceArgs(args []Sexp) []string {
+	strs := make([]string, len(args))
+	for i, a := range args {
+		strs[i] = a.SexpString(nil)
+	}
+	return strs
+}
+
+// LogTracer writes a line for each event, indented by call depth.
+type LogTracer struct {
+	TraceFilter
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewLogTracer returns a LogTracer writing to w the events that
+// filter picks.
+func NewLogTracer(w io.Writer, filter TraceFilter) *LogTracer {
+	return &LogTracer{TraceFilter: filter, w: w}
+}
+
+func (t *LogTracer) printf(env *Zlisp, format string, args ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(t.w, "%s"+format+"\n",
+		append([]interface{}{strings.Repeat("  ", traceDepth(env))}, args...)...)
+}
+
+func (t *LogTracer) Instr(env *Zlisp, fun *SexpFunction, pc int, instr Instruction) {
+	if t.want(TraceInstr, fun) {
+		t.printf(env, "%s:%d  %s", fun.name, pc, instr.InstrString())
+	}
+}
+
+func (t *LogTracer) Call(env *Zlisp, fun *SexpFunction, args []Sexp) {
+	if t.want(TraceCall, fun) {
+		t.printf(env, "call %s (%s)", fun.name, strings.Join(traceArgs(args), " "))
+	}
+}
+
+func (t *LogTracer) Return(env *Zlisp, fun *SexpFunction, result Sexp) {
+	if t.want(TraceReturn, fun) {
+		t.printf(env, "return %s => %s", fun.name, result.SexpString(nil))
+	}
+}
+
+func (t *LogTracer) ScopePush(env *Zlisp, scope *Scope) {
+	if t.want(TraceScope, env.curfunc) {
+		t.printf(env, "push scope %s", scope.Name)
+	}
+}
+
+func (t *LogTracer) ScopePop(env *Zlisp, scope *Scope) {
+	if t.want(TraceScope, env.curfunc) {
+		t.printf(env, "pop scope %s", scope.Name)
+	}
+}
+
+func (t *LogTracer) Error(env *Zlisp, err error) {
+	if t.want(TraceError, env.curfunc) {
+		t.printf(env, "error in %s:%d: %v", env.curfunc.name, env.pc, err)
+	}
+}
+
+// TraceRecord is one line of a JSONTracer's output.
+type TraceRecord struct {
+	Event  string   `json:"event"` // instr, call, return, push, pop or error
+	Func   string   `json:"func"`
+	PC     int      `json:"pc"`
+	Depth  int      `json:"depth"`
+	Instr  string   `json:"instr,omitempty"`
+	Args   []string `json:"args,omitempty"`
+	Result string   `json:"result,omitempty"`
+	Scope  string   `json:"scope,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// JSONTracer writes each event as a TraceRecord, one JSON
+// object per line.
+type JSONTracer struct {
+	TraceFilter
+
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+// NewJSONTracer returns a JSONTracer writing to w the events
+// that filter picks.
+func NewJSONTracer(w io.Writer, filter TraceFilter) *JSONTracer {
+	return &JSONTracer{TraceFilter: filter, enc: json.NewEncoder(w)}
+}
+
+// Err returns the first error in writing the trace, if any;
+// after it, nothing more is written.
+func (t *JSONTracer) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+func (t *JSONTracer) write(env *Zlisp, rec TraceRecord) {
+	if rec.Func == "" {
+		rec.Func = env.curfunc.name
+		rec.PC = env.pc
+	}
+	rec.Depth = traceDepth(env)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil {
+		t.err = t.enc.Encode(&rec)
+	}
+}
+
+func (t *JSONTracer) Instr(env *Zlisp, fun *SexpFunction, pc int, instr Instruction) {
+	if t.want(TraceInstr, fun) {
+		t.write(env, TraceRecord{Event: "instr", Func: fun.name, PC: pc,
+			Instr: instr.InstrString()})
+	}
+}
+
+func (t *JSONTracer) Call(env *Zlisp, fun *SexpFunction, args []Sexp) {
+	if t.want(TraceCall, fun) {
+		t.write(env, TraceRecord{Event: "call", Args: traceArgs(args)})
+	}
+}
+
+func (t *JSONTracer) Return(env *Zlisp, fun *SexpFunction, result Sexp) {
+	if t.want(TraceReturn, fun) {
+		t.write(env, TraceRecord{Event: "return", Result: result.SexpString(nil)})
+	}
+}
+
+func (t *JSONTracer) ScopePush(env *Zlisp, scope *Scope) {
+	if t.want(TraceScope, env.curfunc) {
+		t.write(env, TraceRecord{Event: "push", Scope: scope.Name})
+	}
+}
+
+func (t *JSONTracer) ScopePop(env *Zlisp, scope *Scope) {
+	if t.want(TraceScope, env.curfunc) {
+		t.write(env, TraceRecord{Event: "pop", Scope: scope.Name})
+	}
+}
+
+func (t *JSONTracer) Error(env *Zlisp, err error) {
+	if t.want(TraceError, env.curfunc) {
+		t.write(env, TraceRecord{Event: "error", Error: err.Error()})
+	}
+}
+
+// dumpInstr is what DebugExec shows before each instruction.
+func (env *Zlisp) dumpInstr(instr Instruction) {
+	fmt.Fprintf(env.Stdout, "\n ====== in '%s', about to run: '%v'\n",
+		env.curfunc.name, instr.InstrString())
+	env.DumpEnvironment()
+	fmt.Fprintf(env.Stdout, "\n ====== in '%s', now running the above.\n",
+		env.curfunc.name)
+}
@@ -0,0 +1,57 @@
+package zcore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test520TracersSeeCallsScopesAndErrors(t *testing.T) {
+
+	cv.Convey(`Given a Tracer set on an env, it should be told of instructions, of calls to and returns from compiled functions and builtins, of scopes, and of errors, filtered as asked`, t, func() {
+
+		env := NewZlisp()
+		defer env.Stop()
+		cv.So(env.StandardSetup(), cv.ShouldBeNil)
+		_, err := env.EvalString(`(defn sq [x] (* x x))`)
+		cv.So(err, cv.ShouldBeNil)
+
+		var out bytes.Buffer
+		env.SetTracer(NewLogTracer(&out, TraceFilter{Events: TraceCall | TraceReturn, Funcs: []string{"sq"}}))
+		res, err := env.EvalString(`(sq 3)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `9`)
+		cv.So(out.String(), cv.ShouldEqual, "  call sq (3)\n  return sq => 9\n")
+
+		out.Reset()
+		env.SetTracer(NewJSONTracer(&out, TraceFilter{}))
+		_, err = env.EvalString(`(let [y 2] (sq y))`)
+		cv.So(err, cv.ShouldBeNil)
+		_, err = env.EvalString(`(sq "a")`)
+		cv.So(err, cv.ShouldNotBeNil)
+		env.SetTracer(nil)
+
+		seen := map[string]bool{}
+		sc := bufio.NewScanner(&out)
+		for sc.Scan() {
+			var rec TraceRecord
+			cv.So(json.Unmarshal(sc.Bytes(), &rec), cv.ShouldBeNil)
+			seen[rec.Event+" "+rec.Func] = true
+			if rec.Event == "error" {
+				cv.So(rec.Error, cv.ShouldContainSubstring, "*")
+			}
+		}
+		for _, want := range []string{"instr __main", "call sq", "return sq", "call *", "return *", "push __main", "pop __main", "error *"} {
+			cv.So(seen[want], cv.ShouldBeTrue)
+		}
+
+		out.Reset()
+		_, err = env.EvalString(`(sq 4)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(strings.TrimSpace(out.String()), cv.ShouldEqual, "")
+	})
+}
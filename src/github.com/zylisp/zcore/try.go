@@ -0,0 +1,383 @@
+package zcore
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ThrownError is the error raised by (throw value).
+type ThrownError struct {
+	Value Sexp
+	Pos   *SrcPos // where the throw was
+}
+
+func (e *ThrownError) Error() string {
+	if s, ok := e.Value.(*SexpStr); ok {
+		return s.S
+	}
+	return e.Value.SexpString(nil)
+}
+
+// tryBlock is a (try) being compiled. break and continue use it
+// to leave the try properly: removing the scopes it opened,
+// dropping its handler, and running its finally clause.
+type tryBlock struct {
+	loops   int  // the size of the loopstack at the try
+	scopes  int  // scopes opened inside the try
+	guarded bool // whether a handler is installed
+	finally []Sexp
+}
+
+// tryHandler is a (try) now running. On an error, Run unwinds
+// the stacks to their sizes when the try began, and resumes in
+// fun at pc, with the caught error on the datastack.
+type tryHandler struct {
+	fun      *SexpFunction
+	pc       int
+	runDepth int
+	data     int
+	scopes   int
+	calls    int
+}
+
+// GenerateTry compiles
+//
+//	(try body... (catch e handler...) (finally cleanup...))
+//
+// where catch and finally are each optional. If body raises an
+// error, it is bound to e as a hash with keys msg, type, pos,
+// value and err, and the handler's value becomes that of the try.
+// The cleanup runs however the try is left, its value discarded;
+// an error not handled is raised again after it.
+func (gen *Generator) GenerateTry(args []Sexp) error {
+	body := args
+	var catchSym *SexpSymbol
+	var handler, finally []Sexp
+	hasCatch, hasFinally := false, false
+	for len(body) > 0 {
+		clause, ok := body[len(body)-1].(*SexpPair)
+		if !ok {
+			break
+		}
+		head, ok := clause.Head.(*SexpSymbol)
+		if !ok || (head.name != "catch" && head.name != "finally") {
+			break
+		}
+		forms, err := ListToArray(clause.Tail)
+		if err != nil {
+			return fmt.Errorf("try: malformed %s clause", head.name)
+		}
+		switch {
+		case head.name == "finally" && !hasFinally && !hasCatch:
+			hasFinally = true
+			finally = forms
+		case head.name == "catch" && !hasCatch:
+			if len(forms) < 1 {
+				return fmt.Errorf("try: catch needs a symbol to bind the error to, as in (catch e ...)")
+			}
+			sym, isSym := forms[0].(*SexpSymbol)
+			if !isSym {
+				return fmt.Errorf("try: catch needs a symbol to bind the error to, but got %s", forms[0].SexpString(nil))
+			}
+			hasCatch = true
+			catchSym = sym
+			handler = forms[1:]
+		default:
+			return fmt.Errorf("try: only one catch then one finally may follow the body")
+		}
+		body = body[:len(body)-1]
+	}
+	if !hasCatch && !hasFinally {
+		return fmt.Errorf("try: needs a (catch e ...) or a (finally ...) clause")
+	}
+
+	// the finally code, run on the way out.
+	cleanup, err := gen.subgen().generateFinally(finally)
+	if err != nil {
+		return err
+	}
+
+	bodyCode, err := gen.subgen().generateGuarded(&tryBlock{guarded: true, finally: finally}, body)
+	if err != nil {
+		return err
+	}
+
+	// layout:
+	//   try-start (to catch, or rethrow); body; try-end; jump to done
+	//   catch: bind e; [try-start (to rethrow)]; handler; [try-end]; jump
+	//   rethrow: cleanup; throw
+	//   done: cleanup
+	var catchCode genCode
+	var catchLex *lexScope
+	catchLen, rethrowLen := 0, 0
+	if hasFinally {
+		rethrowLen = len(cleanup.instr) + 1
+	}
+	if hasCatch {
+		// a handler runs the cleanup if the handler itself fails.
+		blk := &tryBlock{scopes: 1, guarded: hasFinally, finally: finally}
+		sub := gen.subgen()
+		sub.openScope(false, nil)
+		sub.bind(catchSym)
+		catchLex = sub.lex
+		catchCode, err = sub.generateGuarded(blk, handler)
+		if err != nil {
+			return err
+		}
+		sub.closeScope()
+		catchLen = len(catchCode.instr) + 4
+		if hasFinally {
+			catchLen += 2
+		}
+	}
+
+	gen.AddInstruction(TryStartInstr{catch: len(bodyCode.instr) + 3})
+	gen.addCode(bodyCode)
+	gen.AddInstruction(TryEndInstr{})
+	gen.AddInstruction(JumpInstr{addpc: catchLen + rethrowLen + 1, where: "try done"})
+	if hasCatch {
+		lex := gen.lex
+		gen.lex = catchLex
+		gen.AddInstruction(AddScopeInstr{Name: "catch", layout: catchLex.layout})
+		gen.AddInstruction(PopStackPutEnvInstr{catchSym})
+		gen.lex = lex
+		if hasFinally {
+			gen.AddInstruction(TryStartInstr{catch: catchLen - 2})
+		}
+		gen.addCode(catchCode)
+		if hasFinally {
+			gen.AddInstruction(TryEndInstr{})
+		}
+		gen.AddInstruction(RemoveScopeInstr{})
+		gen.AddInstruction(JumpInstr{addpc: rethrowLen + 1, where: "try done"})
+	}
+	if hasFinally {
+		gen.addCode(cleanup)
+		gen.AddInstruction(ThrowInstr{})
+		gen.addCode(cleanup)
+	}
+	return nil
+}
+
+// GenerateThrow compiles (throw value). Throwing a caught error
+// raises the original error again.
+func (gen *Generator) GenerateThrow(args []Sexp) error {
+	if len(args) != 1 {
+		return WrongNargs
+	}
+	if err := gen.Generate(args[0]); err != nil {
+		return err
+	}
+	gen.AddInstruction(ThrowInstr{})
+	return nil
+}
+
+func (gen *Generator) subgen() *Generator {
+	sub := NewGenerator(gen.env)
+	sub.scopes = gen.scopes
+	sub.funcname = gen.funcname
+	sub.lex = gen.lex
+	sub.pos = gen.pos
+	return sub
+}
+
+// generateForms generates forms for their value, like begin,
+// but giving null when there are none.
+func (gen *Generator) generateForms(forms []Sexp) error {
+	if len(forms) == 0 {
+		gen.AddInstruction(PushInstr{SexpNull})
+		return nil
+	}
+	return gen.GenerateBegin(forms)
+}
+
+// generateGuarded generates forms, with blk on the trystack
+// meanwhile.
+func (gen *Generator) generateGuarded(blk *tryBlock, forms []Sexp) (genCode, error) {
+	blk.loops = gen.env.loopstack.Size()
+	gen.env.trystack = append(gen.env.trystack, blk)
+	defer func() {
+		gen.env.trystack = gen.env.trystack[:len(gen.env.trystack)-1]
+	}()
+	if err := gen.generateForms(forms); err != nil {
+		return genCode{}, err
+	}
+	return gen.code(), nil
+}
+
+// generateFinally generates forms for effect only.
+func (gen *Generator) generateFinally(forms []Sexp) (genCode, error) {
+	if len(forms) > 0 {
+		if err := gen.GenerateBegin(forms); err != nil {
+			return genCode{}, err
+		}
+		gen.AddInstruction(PopInstr(0))
+	}
+	return gen.code(), nil
+}
+
+// exitTries generates what break and continue must do before
+// jumping to loop: leave each try inside the loop, innermost
+// first.
+func (gen *Generator) exitTries(loop *Loop) error {
+	saved := gen.env.trystack
+	defer func() { gen.env.trystack = saved }()
+
+	for i := len(saved) - 1; i >= 0 && saved[i].loops > loop.depth; i-- {
+		blk := saved[i]
+		for k := 0; k < blk.scopes; k++ {
+			gen.AddInstruction(RemoveScopeInstr{})
+		}
+		if blk.guarded {
+			gen.AddInstruction(TryEndInstr{})
+		}
+		// the cleanup runs outside of this try.
+		gen.env.trystack = saved[:i]
+		code, err := gen.subgen().generateFinally(blk.finally)
+		if err != nil {
+			return err
+		}
+		gen.addCode(code)
+	}
+	return nil
+}
+
+// TryStartInstr installs a handler for the code that follows.
+// catch is relative to the instruction.
+type TryStartInstr struct {
+	catch int
+}
+
+func (t TryStartInstr) InstrString() string {
+	return fmt.Sprintf("try catch at %d", t.catch)
+}
+
+func (t TryStartInstr) Execute(env *Zlisp) error {
+	env.handlers = append(env.handlers, tryHandler{
+		fun:      env.curfunc,
+		pc:       env.pc + t.catch,
+		runDepth: env.runDepth,
+		data:     env.datastack.Size(),
+		scopes:   env.linearstack.Size(),
+		calls:    env.addrstack.Size(),
+	})
+	env.pc++
+	return nil
+}
+
+// TryEndInstr removes the innermost handler.
+type TryEndInstr struct{}
+
+func (t TryEndInstr) InstrString() string {
+	return "try end"
+}
+
+func (t TryEndInstr) Execute(env *Zlisp) error {
+	if len(env.handlers) > 0 {
+		env.handlers = env.handlers[:len(env.handlers)-1]
+	}
+	env.pc++
+	return nil
+}
+
+// ThrowInstr raises the value on top of the datastack.
+type ThrowInstr struct{}
+
+func (t ThrowInstr) InstrString() string {
+	return "throw"
+}
+
+func (t ThrowInstr) Execute(env *Zlisp) error {
+	val, err := env.datastack.PopExpr()
+	if err != nil {
+		// not a bare StackUnderFlowErr, which Run would ignore.
+		return fmt.Errorf("throw: %v", err)
+	}
+	if h, ok := val.(*SexpHash); ok {
+		if e, err := h.HashGet(env, env.MakeSymbol("err")); err == nil {
+			if se, ok := e.(*SexpError); ok {
+				return se.error
+			}
+		}
+	}
+	if se, ok := val.(*SexpError); ok {
+		return se.error
+	}
+	return &ThrownError{Value: val, Pos: env.Position()}
+}
+
+// catch hands err to the innermost handler installed by this Run,
+// if there is one. Running out of budget, and cancellation, cannot
+// be caught.
+func (env *Zlisp) catch(err error) bool {
+	n := len(env.handlers)
+	if n == 0 || env.handlers[n-1].runDepth != env.runDepth {
+		return false
+	}
+	if env.budgetErr != nil || env.checkDone() != nil || errors.Is(err, ErrDebugAbort) {
+		return false
+	}
+	h := env.handlers[n-1]
+	env.handlers = env.handlers[:n-1]
+
+	caught, cerr := env.caughtError(err)
+	if cerr != nil {
+		return false
+	}
+	truncate(env.datastack, h.data)
+	truncate(env.linearstack, h.scopes)
+	truncate(env.addrstack, h.calls)
+	env.curfunc = h.fun
+	env.pc = h.pc
+	env.datastack.PushExpr(caught)
+	return true
+}
+
+// truncate is TruncateToSize, but never grows the stack.
+func truncate(stack *Stack, size int) {
+	if stack.Size() > size {
+		stack.TruncateToSize(size)
+	}
+}
+
+// caughtError makes the hash that (catch e ...) binds: msg is the
+// error message, type "throw" or the Go type of the error, pos
+// where it happened, value what was thrown, and err the error.
+func (env *Zlisp) caughtError(err error) (Sexp, error) {
+	pos := env.Position()
+	typ := ""
+	var value Sexp = &SexpStr{S: err.Error()}
+	var thrown *ThrownError
+	if errors.As(err, &thrown) {
+		typ = "throw"
+		value = thrown.Value
+		pos = thrown.Pos
+	} else {
+		inner := err
+		for errors.Unwrap(inner) != nil {
+			inner = errors.Unwrap(inner)
+		}
+		typ = fmt.Sprintf("%T", inner)
+	}
+	var where Sexp = SexpNull
+	if pos != nil {
+		where = &SexpStr{S: pos.String()}
+	}
+	return MakeHash([]Sexp{
+		env.MakeSymbol("msg"), &SexpStr{S: err.Error()},
+		env.MakeSymbol("type"), &SexpStr{S: typ},
+		env.MakeSymbol("pos"), where,
+		env.MakeSymbol("value"), value,
+		env.MakeSymbol("err"), &SexpError{err},
+	}, "hash", env)
+}
+
+// endRun drops the handlers left by a Run that is returning.
+func (env *Zlisp) endRun() {
+	n := len(env.handlers)
+	for n > 0 && env.handlers[n-1].runDepth >= env.runDepth {
+		n--
+	}
+	env.handlers = env.handlers[:n]
+	env.runDepth--
+}
@@ -0,0 +1,62 @@
+package zcore
+
+import (
+	"errors"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test470TryCatchFinallyUnwinds(t *testing.T) {
+
+	cv.Convey(`Given (try ... (catch e ...) (finally ...)) and (throw v), errors from deep calls should be caught as hashes of msg, type, pos and value, the stacks should be unwound, finally should always run, uncaught throws should reach Go as a ThrownError, and budget errors should not be catchable`, t, func() {
+
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		_, err := env.EvalString(`
+(defn inner [x] (cond (> x 2) (throw (hash code: x)) x))
+(defn outer [x] (let [y 1] (+ y (inner x))))
+(def cleaned 0)`)
+		cv.So(err, cv.ShouldBeNil)
+
+		res, err := env.EvalString(`(try (outer 5) (catch e e))`)
+		cv.So(err, cv.ShouldBeNil)
+		caught := res.(*SexpHash)
+		get := func(key string) string {
+			v, err := caught.HashGet(env, env.MakeSymbol(key))
+			PanicOn(err)
+			return v.SexpString(nil)
+		}
+		cv.So(get("type"), cv.ShouldEqual, `"throw"`)
+		cv.So(get("pos"), cv.ShouldEqual, `"2:31"`)
+		cv.So(get("value"), cv.ShouldEqual, ` (hash code:5)`)
+		cv.So(env.datastack.Size(), cv.ShouldEqual, 0)
+		cv.So(env.addrstack.Size(), cv.ShouldEqual, 0)
+		cv.So(len(env.handlers), cv.ShouldEqual, 0)
+
+		res, err = env.EvalString(`(try (outer 1) (catch e 0) (finally (set cleaned (+ cleaned 1))))`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `2`)
+
+		// an error in the handler still runs finally, then escapes.
+		_, err = env.EvalString(`(try (outer 9) (catch e (throw "handler failed")) (finally (set cleaned (+ cleaned 1))))`)
+		cv.So(err, cv.ShouldNotBeNil)
+		var thrown *ThrownError
+		cv.So(errors.As(err, &thrown), cv.ShouldBeTrue)
+		cv.So(thrown.Error(), cv.ShouldEqual, "handler failed")
+		env.Clear()
+		res, err = env.EvalString(`(+ cleaned 0)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `2`)
+
+		_, err = env.EvalString(`(try 1)`)
+		cv.So(err, cv.ShouldNotBeNil)
+
+		env.SetBudget(Budget{MaxInstructions: 500})
+		_, err = env.EvalString(`(try (for [(def i 0) true (set i (+ i 1))] i) (catch e "caught"))`)
+		var be *BudgetExceededError
+		cv.So(errors.As(err, &be), cv.ShouldBeTrue)
+	})
+}
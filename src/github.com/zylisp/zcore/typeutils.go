@@ -137,7 +137,18 @@ func IsFunc(expr Sexp) bool {
 	return false
 }
 
+// TypeOf gives the name of expr's type, as the type? builtin does,
+// or "" for a type it does not know; see TypeOfErr.
 func TypeOf(expr Sexp) *SexpStr {
+	typ, err := TypeOfErr(expr)
+	if err != nil {
+		return &SexpStr{}
+	}
+	return typ
+}
+
+// TypeOfErr is TypeOf, giving an error for a type it does not know.
+func TypeOfErr(expr Sexp) (*SexpStr, error) {
 	v := ""
 	switch e := expr.(type) {
 	case *SexpRaw:
@@ -179,7 +190,7 @@ func TypeOf(expr Sexp) *SexpStr {
 	case *SexpReflect:
 		rt := expr.Type()
 		if rt != nil {
-			return &SexpStr{S: rt.RegisteredName}
+			return &SexpStr{S: rt.RegisteredName}, nil
 		}
 		//v = reflect.Value(e).Type().Name()
 		//if v == "Ptr" {
@@ -189,7 +200,6 @@ func TypeOf(expr Sexp) *SexpStr {
 		if kind == reflect.Ptr {
 			v = reflect.Value(e.Val).Elem().Type().Name()
 		} else {
-			P("kind = %v", kind)
 			v = "reflect.Value"
 		}
 	case *Stack:
@@ -199,7 +209,7 @@ func TypeOf(expr Sexp) *SexpStr {
 			v = "stack"
 		}
 	default:
-		fmt.Printf("\n error: unknown type: %T in '%#v'\n", e, e)
+		return nil, fmt.Errorf("unknown type: %T in '%#v'", e, e)
 	}
-	return &SexpStr{S: v}
+	return &SexpStr{S: v}, nil
 }
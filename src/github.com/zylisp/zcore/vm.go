@@ -3,6 +3,8 @@ package zcore
 import (
 	"errors"
 	"fmt"
+	"reflect"
+	"sync"
 )
 
 type Instruction interface {
@@ -127,7 +129,7 @@ func (g EnvToStackInstr) Execute(env *Zlisp) error {
 	VPrintf("in EnvToStackInstr\n")
 	defer VPrintf("leaving EnvToStackInstr env.pc =%v\n", env.pc)
 
-	macxpr, isMacro := env.macros[g.sym.number]
+	macxpr, isMacro := env.macros.get(g.sym.number)
 	if isMacro {
 		if macxpr.orig != nil {
 			return fmt.Errorf("'%s' is a macro, with definition: %s\n", g.sym.name, macxpr.orig.SexpString(nil))
@@ -208,6 +210,106 @@ func (p UpdateInstr) Execute(env *Zlisp) error {
 	return err
 }
 
+// IncrInstr adds the number on top of the datastack to the
+// variable sym, or takes it away if op is -, and leaves the result
+// there: it is (set sym (op sym n)), or (def sym (op sym n)) with
+// def, without the call to op when both are ints or both floats.
+// addr is where the generator found sym, if it did.
+type IncrInstr struct {
+	sym  *SexpSymbol
+	op   *SexpSymbol
+	addr *lexAddr
+	def  bool
+}
+
+func (a IncrInstr) InstrString() string {
+	s := "incr "
+	if a.op.name == "-" {
+		s = "decr "
+	}
+	if a.def {
+		s += "def "
+	}
+	if a.addr == nil {
+		return s + a.sym.name
+	}
+	return s + a.sym.name + a.addr.String()
+}
+
+func (a IncrInstr) Execute(env *Zlisp) error {
+	by, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+	pc := env.pc
+	var sc *Scope
+	if a.addr != nil {
+		sc = a.addr.find(env)
+	}
+	var x Sexp
+	if sc != nil {
+		x = sc.slots[a.addr.slot]
+	} else {
+		if err := (EnvToStackInstr{a.sym}).Execute(env); err != nil {
+			return err
+		}
+		x, _ = env.datastack.PopExpr()
+	}
+
+	var res Sexp
+	if sameNumericType(x, by) && env.tracer == nil && len(env.before) == 0 && len(env.after) == 0 {
+		op := Add
+		if a.op.name == "-" {
+			op = Sub
+		}
+		res, err = NumericDo(op, x, by)
+	} else {
+		// call op, with its hooks and its errors.
+		env.datastack.PushExpr(x)
+		env.datastack.PushExpr(by)
+		env.pc = pc
+		err = CallInstr{sym: a.op, nargs: 2}.Execute(env)
+		if err == nil {
+			res, err = env.datastack.PopExpr()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	env.pc = pc + 1
+	env.datastack.PushExpr(res)
+	switch {
+	case a.def:
+		return env.LexicalBindSymbol(a.sym, res)
+	case sc != nil:
+		sc.slots[a.addr.slot] = res
+		return nil
+	}
+	env.pc = pc
+	env.datastack.PushExpr(res)
+	return UpdateInstr{a.sym}.Execute(env)
+}
+
+// sameNumericType says if a and b are both ints or both floats.
+func sameNumericType(a, b Sexp) bool {
+	switch a.(type) {
+	case *SexpInt:
+		_, ok := b.(*SexpInt)
+		return ok
+	case *SexpFloat:
+		_, ok := b.(*SexpFloat)
+		return ok
+	}
+	return false
+}
+
+// isNumericBuiltin says if sym names NumericFunction as a builtin.
+func (env *Zlisp) isNumericBuiltin(sym *SexpSymbol) bool {
+	f, ok := env.builtins[sym.number]
+	return ok && f.userfun != nil &&
+		reflect.ValueOf(f.userfun).Pointer() == reflect.ValueOf(NumericFunction).Pointer()
+}
+
 type CallInstr struct {
 	sym   *SexpSymbol
 	nargs int
@@ -369,7 +471,9 @@ func (r ReturnInstr) InstrString() string {
 }
 
 type AddScopeInstr struct {
-	Name string
+	Name    string
+	Package bool // the scope of a (package ...) being built
+	layout  *scopeLayout
 }
 
 func (a AddScopeInstr) InstrString() string {
@@ -379,7 +483,11 @@ func (a AddScopeInstr) InstrString() string {
 func (a AddScopeInstr) Execute(env *Zlisp) error {
 	sc := env.NewNamedScope(fmt.Sprintf("scope Name: '%s'",
 		a.Name))
-	env.linearstack.Push(sc)
+	if a.Package {
+		sc.PackageName = a.Name
+	}
+	sc.setLayout(a.layout)
+	env.pushScope(sc)
 	env.pc++
 	return nil
 }
@@ -387,6 +495,7 @@ func (a AddScopeInstr) Execute(env *Zlisp) error {
 type AddFuncScopeInstr struct {
 	Name   string
 	Helper *AddFuncScopeHelper // we need a pointer we can update later once we know MyFunction
+	layout *scopeLayout
 }
 
 type AddFuncScopeHelper struct {
@@ -402,7 +511,8 @@ func (a AddFuncScopeInstr) Execute(env *Zlisp) error {
 		env.curfunc.name, env.pc))
 	sc.IsFunction = true
 	sc.MyFunction = a.Helper.MyFunction
-	env.linearstack.Push(sc)
+	sc.setLayout(a.layout)
+	env.pushScope(sc)
 	env.pc++
 	return nil
 }
@@ -415,7 +525,7 @@ func (a RemoveScopeInstr) InstrString() string {
 
 func (a RemoveScopeInstr) Execute(env *Zlisp) error {
 	env.pc++
-	return env.linearstack.PopScope()
+	return env.popScope()
 }
 
 type ExplodeInstr int
@@ -523,6 +633,9 @@ func (s VectorizeInstr) Execute(env *Zlisp) error {
 		}
 		vec = append([]Sexp{expr}, vec...)
 	}
+	if err := env.chargeAlloc(len(vec)); err != nil {
+		return err
+	}
 	env.datastack.PushExpr(&SexpArray{Val: vec, Env: env})
 	return nil
 }
@@ -670,7 +783,7 @@ toploop:
 	for {
 		expr, err := env.datastack.PopExpr()
 		if err != nil {
-			P("alert: did not find SexpStackmark '%s'", s.sym.name)
+			fmt.Fprintf(env.stderr(), "\n alert: did not find SexpStackmark '%s'\n", s.sym.name)
 			return err
 		}
 		switch m := expr.(type) {
@@ -840,8 +953,12 @@ func (a PopScopeTransferToDataStackInstr) Execute(env *Zlisp) error {
 	stackClone := env.linearstack.Clone()
 	stackClone.IsPackage = true // always/only used for packages.
 	stackClone.PackageName = a.PackageName
+	if pkgScope, ok := stackClone.GetTop().(*Scope); ok && pkgScope.mu == nil {
+		// packages may be shared by goroutines, like the global scope.
+		pkgScope.mu = new(sync.RWMutex)
+	}
 	//P("PopScopeTransferToDataStackInstr: scope is '%v'", stackClone.SexpString(nil))
-	env.linearstack.PopScope()
+	env.popScope()
 	env.datastack.PushExpr(stackClone)
 	return nil
 }
@@ -0,0 +1,309 @@
+package zcore
+
+import "fmt"
+
+// A function's instructions are assembled, when the function is
+// made, into a vmcode: a dense array of opcodes, with the operands
+// of the common ones in tables beside it, so that the run loop
+// switches on a byte instead of calling through the Instruction
+// interface. The tables hold what those ops would otherwise build
+// on each run: the pushes' values ready boxed for the datastack,
+// and the names of the scopes the ops add. The Instructions stay
+// what the generator and the optimizer make, what DumpFunction and
+// the .zyc cache show and store, and what the run loop falls back
+// on for the opcodes it has no case for.
+
+// opcode names the kind of an instruction. The numbers are also
+// those the .zyc format writes, so they must not be changed or
+// reused; add new ones at the end, and bump BytecodeVersion.
+type opcode uint8
+
+// opInstr is the op of an instruction that the run loop runs by
+// calling its Execute.
+const opInstr opcode = 0
+
+const (
+	opJump = iota + 1
+	opGoto
+	opBranch
+	opPush
+	opPop
+	opDup
+	opEnvToStack
+	opPopStackPutEnv
+	opUpdate
+	opCall
+	opDispatch
+	opReturn
+	opAddScope
+	opAddFuncScope
+	opRemoveScope
+	opExplode
+	opSquash
+	opBindlist
+	opVectorize
+	opHashize
+	opLabel
+	opBreak
+	opContinue
+	opLoopStart
+	opPushStackmark
+	opPopUntilStackmark
+	opClearStackmark
+	opDebug
+	opCreateClosure
+	opAssign
+	opPopScopeTransfer
+	opTryStart
+	opTryEnd
+	opThrow
+	opDeftest
+	opAssertError
+	opLexToStack
+	opLexUpdate
+	opIncr
+)
+
+// vmcode is a function's instructions, assembled.
+type vmcode struct {
+	name   string // of the function, for the scopes it adds
+	ops    []opcode
+	a, b   []int         // the operands of each op
+	consts []StackElem   // what the pushes push, by a
+	syms   []*SexpSymbol // the symbols the ops name, by a
+	addrs  []*lexAddr    // where the ops find them, by b
+	names  []string      // of the scopes the ops add, by a
+	instrs []Instruction // what each op was assembled from
+}
+
+// assemble returns the code for fun, of the function name.
+func assemble(name string, fun ZlispFunction) *vmcode {
+	return (&vmcode{name: name}).extend(fun)
+}
+
+// extend returns the code for fun, of which c is the code for the
+// start. c itself is left as it was, as it may be running.
+func (c *vmcode) extend(fun ZlispFunction) *vmcode {
+	next := vmcode{}
+	if c != nil {
+		next = *c
+	}
+	for _, in := range fun[len(next.ops):] {
+		next.add(in)
+	}
+	return &next
+}
+
+// add assembles in onto the end of c.
+func (c *vmcode) add(in Instruction) {
+	op, a, b := opInstr, 0, 0
+	switch t := in.(type) {
+	case JumpInstr:
+		op, a = opJump, t.addpc
+	case GotoInstr:
+		op, a = opGoto, t.location
+	case BranchInstr:
+		op, a = opBranch, t.location
+		if t.direction {
+			b = 1
+		}
+	case PushInstr:
+		op, a = opPush, c.push(t.expr)
+	case PopInstr:
+		op = opPop
+	case DupInstr:
+		op = opDup
+	case PopStackPutEnvInstr:
+		op, a = opPopStackPutEnv, c.symbol(t.sym)
+	case CallInstr:
+		op, a, b = opCall, c.symbol(t.sym), t.nargs
+	case ReturnInstr:
+		op = opReturn
+		if t.err != nil {
+			b = 1
+		}
+	case AddScopeInstr:
+		op, a = opAddScope, c.scope(fmt.Sprintf("scope Name: '%s'", t.Name))
+	case AddFuncScopeInstr:
+		op, a = opAddFuncScope, c.scope(fmt.Sprintf("%s at pc=%v", c.name, len(c.ops)))
+	case RemoveScopeInstr:
+		op = opRemoveScope
+	case LabelInstr:
+		op = opLabel
+	case LoopStartInstr:
+		op = opLoopStart
+	case PushStackmarkInstr:
+		op, a = opPushStackmark, c.push(&SexpStackmark{sym: t.sym})
+	case PopUntilStackmarkInstr:
+		op, a = opPopUntilStackmark, c.symbol(t.sym)
+	case ClearStackmarkInstr:
+		op, a = opClearStackmark, c.symbol(t.sym)
+	case LexToStackInstr:
+		op, a, b = opLexToStack, c.symbol(t.sym), len(c.addrs)
+		c.addrs = append(c.addrs, t.addr)
+	case LexUpdateInstr:
+		op, a, b = opLexUpdate, c.symbol(t.sym), len(c.addrs)
+		c.addrs = append(c.addrs, t.addr)
+	}
+	c.ops = append(c.ops, op)
+	c.a = append(c.a, a)
+	c.b = append(c.b, b)
+	c.instrs = append(c.instrs, in)
+}
+
+func (c *vmcode) symbol(sym *SexpSymbol) int {
+	c.syms = append(c.syms, sym)
+	return len(c.syms) - 1
+}
+
+func (c *vmcode) push(expr Sexp) int {
+	c.consts = append(c.consts, DataStackElem{expr})
+	return len(c.consts) - 1
+}
+
+func (c *vmcode) scope(name string) int {
+	c.names = append(c.names, name)
+	return len(c.names) - 1
+}
+
+// step runs the instruction at env.pc in env.curfunc.
+func (env *Zlisp) step() error {
+	f, pc := env.curfunc, env.pc
+	c := f.code
+	if c == nil || pc >= len(c.ops) {
+		// made other than by MakeFunction, or grown since.
+		return f.fun[pc].Execute(env)
+	}
+
+	switch c.ops[pc] {
+	case opJump:
+		return env.jumpTo(pc + c.a[pc])
+	case opGoto:
+		return env.jumpTo(c.a[pc])
+	case opBranch:
+		expr, err := env.datastack.PopExpr()
+		if err != nil {
+			return err
+		}
+		if (c.b[pc] == 1) == IsTruthy(expr) {
+			return env.jumpTo(pc + c.a[pc])
+		}
+		env.pc++
+	case opPush, opPushStackmark:
+		env.datastack.Push(c.consts[c.a[pc]])
+		env.pc++
+	case opPop:
+		_, err := env.datastack.PopExpr()
+		env.pc++
+		return err
+	case opDup:
+		elem, err := env.datastack.Get(0)
+		if err != nil {
+			return err
+		}
+		env.datastack.Push(elem)
+		env.pc++
+	case opLexToStack:
+		addr := c.addrs[c.b[pc]]
+		sc := addr.find(env)
+		if sc == nil {
+			return c.instrs[pc].Execute(env)
+		}
+		env.datastack.PushExpr(sc.slots[addr.slot])
+		env.pc++
+	case opLexUpdate:
+		addr := c.addrs[c.b[pc]]
+		sc := addr.find(env)
+		if sc == nil {
+			return c.instrs[pc].Execute(env)
+		}
+		expr, err := env.datastack.PopExpr()
+		if err != nil {
+			return err
+		}
+		env.pc++
+		sc.slots[addr.slot] = expr
+	case opPopStackPutEnv:
+		expr, err := env.datastack.PopExpr()
+		if err != nil {
+			return err
+		}
+		env.pc++
+		return env.LexicalBindSymbol(c.syms[c.a[pc]], expr)
+	case opCall:
+		sym := c.syms[c.a[pc]]
+		if fn, ok := env.builtins[sym.number]; ok {
+			_, err := env.CallUserFunction(fn, sym.name, c.b[pc])
+			return err
+		}
+		return c.instrs[pc].Execute(env)
+	case opReturn:
+		if c.b[pc] == 1 {
+			return c.instrs[pc].(ReturnInstr).err
+		}
+		return env.ReturnFromFunction()
+	case opAddScope:
+		in := c.instrs[pc].(AddScopeInstr)
+		sc := env.NewNamedScope(c.names[c.a[pc]])
+		if in.Package {
+			sc.PackageName = in.Name
+		}
+		sc.setLayout(in.layout)
+		env.pushScope(sc)
+		env.pc++
+	case opAddFuncScope:
+		in := c.instrs[pc].(AddFuncScopeInstr)
+		sc := env.NewNamedScope(c.names[c.a[pc]])
+		sc.IsFunction = true
+		sc.MyFunction = in.Helper.MyFunction
+		sc.setLayout(in.layout)
+		env.pushScope(sc)
+		env.pc++
+	case opRemoveScope:
+		env.pc++
+		return env.popScope()
+	case opLabel, opLoopStart:
+		env.pc++
+	case opPopUntilStackmark:
+		// the mark stays, so what is above it can go at once.
+		if i := env.datastack.findStackmark(c.syms[c.a[pc]]); i >= 0 {
+			env.datastack.TruncateToSize(i + 1)
+			env.pc++
+			return nil
+		}
+		return c.instrs[pc].Execute(env)
+	case opClearStackmark:
+		if i := env.datastack.findStackmark(c.syms[c.a[pc]]); i >= 0 {
+			env.datastack.TruncateToSize(i)
+			env.pc++
+			return nil
+		}
+		return c.instrs[pc].Execute(env)
+	default:
+		return c.instrs[pc].Execute(env)
+	}
+	return nil
+}
+
+// findStackmark returns where on the datastack the topmost mark of
+// sym is, or -1.
+func (stack *Stack) findStackmark(sym *SexpSymbol) int {
+	for i := stack.tos; i >= 0; i-- {
+		if d, ok := stack.elements[i].(DataStackElem); ok {
+			if m, ok := d.expr.(*SexpStackmark); ok && m.sym.number == sym.number {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// jumpTo moves env.pc to, as long as it stays in the function or
+// just past its end.
+func (env *Zlisp) jumpTo(to int) error {
+	if to < 0 || to > env.CurrentFunctionSize() {
+		return OutOfBounds
+	}
+	env.pc = to
+	return nil
+}
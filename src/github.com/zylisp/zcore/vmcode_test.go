@@ -0,0 +1,140 @@
+package zcore
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test590CodeIsAssembledInStepWithTheInstructions(t *testing.T) {
+
+	cv.Convey(`Given a function and a main that grows, the assembled code should match their instructions op for op, and a function without code, naming its scopes the same, or a stack popped after a Clone, should run as before`, t, func() {
+
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+		_, err := env.EvalString(`(defn f [x] (cond (> x 1) (+ x 1) (- 0 x)))`)
+		cv.So(err, cv.ShouldBeNil)
+
+		x, found := env.FindObject("f")
+		cv.So(found, cv.ShouldBeTrue)
+		f := x.(*SexpFunction)
+		inStep := func(fun *SexpFunction) {
+			cv.So(fun.code, cv.ShouldNotBeNil)
+			cv.So(len(fun.code.ops), cv.ShouldEqual, len(fun.fun))
+			for i, in := range fun.fun {
+				cv.So(fun.code.instrs[i].InstrString(), cv.ShouldEqual, in.InstrString())
+			}
+		}
+		inStep(f)
+		ops := map[opcode]bool{}
+		for _, op := range f.code.ops {
+			ops[op] = true
+		}
+		cv.So(ops[opBranch] && ops[opCall] && ops[opLexToStack] && ops[opReturn], cv.ShouldBeTrue)
+
+		for _, src := range []string{`(def a (f 5))`, `(def b (f -2))`} {
+			cv.So(env.LoadString(src), cv.ShouldBeNil)
+			inStep(env.mainfunc)
+		}
+		res, err := env.Run()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "2")
+
+		cv.So(assemble("", ZlispFunction{ReturnInstr{err: io.EOF}}).b[0], cv.ShouldEqual, 1)
+
+		// the scopes the ops add are named as their Execute names them.
+		var names []string
+		env.AddFunction("scopeName", func(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+			top, err := env.linearstack.Get(0)
+			names = append(names, top.(*Scope).Name)
+			return SexpNull, err
+		})
+		_, err = env.EvalString(`(defn g [] (scopeName)) (g)`)
+		cv.So(err, cv.ShouldBeNil)
+		x, _ = env.FindObject("g")
+		x.(*SexpFunction).code = nil
+		f.code = nil
+		res, err = env.EvalString(`(g) [a b (f 7)]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "[6 2 8]")
+		cv.So(names, cv.ShouldResemble, []string{"g at pc=0", "g at pc=0"})
+
+		stk := env.NewStack(0)
+		stk.PushExpr(&SexpInt{Val: 1})
+		stk.PushExpr(&SexpInt{Val: 2})
+		clone := stk.Clone()
+		stk.PopExpr()
+		stk.PushExpr(&SexpInt{Val: 3})
+		top, err := clone.PopExpr()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(top.SexpString(nil), cv.ShouldEqual, "2")
+	})
+}
+
+// benchmarkScript runs the script at name, from the top of the
+// repo, once per iteration, from code loaded once.
+func benchmarkScript(b *testing.B, name string) {
+	wd, err := os.Getwd()
+	if err != nil {
+		b.Fatal(err)
+	}
+	here, err := filepath.EvalSymlinks(wd)
+	if err != nil {
+		b.Fatal(err)
+	}
+	src, err := os.ReadFile(filepath.Join(here, "../../../..", name))
+	if err != nil {
+		b.Skip(err)
+	}
+	benchmarkSource(b, string(src))
+}
+
+// benchmarkSource runs src once per iteration, from code loaded
+// once.
+func benchmarkSource(b *testing.B, src string) {
+	env := NewZlisp()
+	defer env.Stop()
+	env.Stdout = io.Discard
+	if err := env.StandardSetup(); err != nil {
+		b.Fatal(err)
+	}
+	if err := env.LoadString(src); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		env.pc = 0
+		if _, err := env.Run(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkArrayMult(b *testing.B) {
+	benchmarkScript(b, "benchmarks/array-mult.zy")
+}
+
+func BenchmarkFib(b *testing.B) {
+	benchmarkSource(b, `(defn fib [n] (cond (< n 2) n (+ (fib (- n 1)) (fib (- n 2)))))
+(fib 20)`)
+}
+
+func BenchmarkForLoop(b *testing.B) {
+	benchmarkSource(b, `(def sum 0)
+(for [(def i 0) (< i 100000) (set i (+ i 1))] (set sum (+ sum i)))
+sum`)
+}
+
+// BenchmarkForScripts runs the for loops of tests/.
+func BenchmarkForScripts(b *testing.B) {
+	for _, name := range []string{"for.zy", "break.zy", "continue.zy", "range.zy"} {
+		b.Run(name, func(b *testing.B) {
+			benchmarkScript(b, filepath.Join("tests", name))
+		})
+	}
+}
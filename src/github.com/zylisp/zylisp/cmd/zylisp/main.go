@@ -19,6 +19,10 @@ func usage(myflags *flag.FlagSet) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "test" {
+		os.Exit(zylisp.TestCommand(os.Args[2:]))
+	}
+
 	cfg := zcore.NewZlispConfig("zylisp")
 	cfg.DefineFlags()
 	err := cfg.Flags.Parse(os.Args[1:])
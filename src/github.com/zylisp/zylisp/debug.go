@@ -0,0 +1,159 @@
+package zylisp
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/zylisp/zcore"
+)
+
+var debugPrompt = "debug> "
+
+// replDebugger drives a zcore.Debugger from the repl: when the
+// run pauses, it reads debugger commands, and expressions to
+// evaluate in the selected frame, until told to go on.
+type replDebugger struct {
+	*zcore.Debugger
+
+	env     *zcore.Zlisp
+	pr      *Prompter
+	reader  *bufio.Reader
+	noLiner bool
+	frame   int
+}
+
+func newReplDebugger(env *zcore.Zlisp, pr *Prompter, reader *bufio.Reader, noLiner bool) *replDebugger {
+	d := &replDebugger{
+		Debugger: &zcore.Debugger{},
+		env:      env,
+		pr:       pr,
+		reader:   reader,
+		noLiner:  noLiner,
+	}
+	d.OnPause = d.pause
+	return d
+}
+
+// command runs the debugger commands allowed at the top level,
+// and reports if line was one.
+func (d *replDebugger) command(parts []string) bool {
+	env := d.env
+	switch parts[0] {
+	case ".break":
+		if len(parts) == 1 {
+			for i, b := range d.Breakpoints() {
+				fmt.Fprintf(env.Stdout, "%d: %s\n", i, b)
+			}
+			return true
+		}
+		b, err := zcore.ParseBreakpoint(strings.Join(parts[1:], " "))
+		if err != nil {
+			fmt.Fprintf(env.Stdout, "error: %s\n", err)
+			return true
+		}
+		d.AddBreakpoint(b)
+		env.SetDebugger(d.Debugger)
+		fmt.Fprintf(env.Stdout, "breakpoint set at %s.\n", b)
+	case ".clear":
+		d.ClearBreakpoints()
+		fmt.Fprintf(env.Stdout, "breakpoints cleared.\n")
+	case ".step", ".next":
+		mode := zcore.Step
+		if parts[0] == ".next" {
+			mode = zcore.Next
+		}
+		d.SetMode(mode)
+		env.SetDebugger(d.Debugger)
+		fmt.Fprintf(env.Stdout, "will stop at the first line run.\n")
+	case ".continue", ".bt", ".frame", ".locals":
+		fmt.Fprintf(env.Stdout, "not paused; set a breakpoint with .break fn or .break file:line, or use .step\n")
+	default:
+		return false
+	}
+	return true
+}
+
+func (d *replDebugger) getLine() (string, error) {
+	if d.noLiner {
+		fmt.Fprint(d.env.Stdout, debugPrompt)
+		return getLine(d.reader)
+	}
+	return d.pr.Getline(&debugPrompt)
+}
+
+func (d *replDebugger) pause(env *zcore.Zlisp, pos *zcore.SrcPos, why string) zcore.StepMode {
+	d.frame = 0
+	fmt.Fprintf(env.Stdout, "paused (%s)", why)
+	if pos != nil {
+		fmt.Fprintf(env.Stdout, " at %s\n    %s\n", pos, pos.Source())
+	} else {
+		fmt.Fprintln(env.Stdout)
+	}
+
+	for {
+		line, err := d.getLine()
+		if err != nil {
+			return zcore.Abort
+		}
+		parts := strings.Fields(line)
+		if len(parts) == 0 {
+			continue
+		}
+		switch parts[0] {
+		case ".step", ".s":
+			return zcore.Step
+		case ".next", ".n":
+			return zcore.Next
+		case ".continue", ".c":
+			return zcore.Continue
+		case ".abort", ".quit":
+			return zcore.Abort
+		case ".bt":
+			for i, f := range env.Frames() {
+				mark := " "
+				if i == d.frame {
+					mark = "*"
+				}
+				fmt.Fprintf(env.Stdout, "%s%d: %s\n", mark, i, f.String())
+			}
+		case ".frame":
+			frames := env.Frames()
+			n, err := strconv.Atoi(strings.Join(parts[1:], ""))
+			if err != nil || n < 0 || n >= len(frames) {
+				fmt.Fprintf(env.Stdout, "give a frame number from 0 to %d, as .bt lists them.\n", len(frames)-1)
+				continue
+			}
+			d.frame = n
+			fmt.Fprintf(env.Stdout, "%d: %s\n", n, frames[n].String())
+		case ".locals":
+			scopes, err := env.FrameScopes(d.frame)
+			if err != nil {
+				fmt.Fprintf(env.Stdout, "error: %s\n", err)
+				continue
+			}
+			if len(scopes) == 0 {
+				fmt.Fprintf(env.Stdout, "no locals.\n")
+			}
+			for _, sc := range scopes {
+				s, err := sc.Show(env, nil, "scope")
+				if err != nil {
+					fmt.Fprintf(env.Stdout, "error: %s\n", err)
+					continue
+				}
+				fmt.Fprint(env.Stdout, s)
+			}
+		default:
+			if d.command(parts) {
+				continue
+			}
+			res, err := env.EvalInFrame(d.frame, ReplLineInfixWrap(line))
+			if err != nil {
+				fmt.Fprintf(env.Stdout, "error: %s\n", err)
+				continue
+			}
+			fmt.Fprintln(env.Stdout, res.SexpString(nil))
+		}
+	}
+}
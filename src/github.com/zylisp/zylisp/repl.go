@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
 	"strconv"
@@ -68,14 +69,14 @@ func isBalanced(str string) bool {
 
 var continuationPrompt = "... "
 
-func (pr *Prompter) getExpressionOrig(reader *bufio.Reader) (readin string, err error) {
+func (pr *Prompter) getExpressionOrig(env *zcore.Zlisp, reader *bufio.Reader) (readin string, err error) {
 	line, err := getLine(reader)
 	if err != nil {
 		return "", err
 	}
 
 	for !isBalanced(line) {
-		fmt.Printf(continuationPrompt)
+		fmt.Fprintf(env.Stdout, continuationPrompt)
 		nextline, err := getLine(reader)
 		if err != nil {
 			return "", err
@@ -85,13 +86,14 @@ func (pr *Prompter) getExpressionOrig(reader *bufio.Reader) (readin string, err
 	return line, nil
 }
 
-// liner reads Stdin only. If noLiner, then we read from reader.
+// liner reads the terminal only. If noLiner, then we read from reader,
+// which Repl makes from env.Stdin.
 func (pr *Prompter) getExpressionWithLiner(env *zcore.Zlisp, reader *bufio.Reader, noLiner bool) (readin string, xs []zcore.Sexp, err error) {
 
 	var line, nextline string
 
 	if noLiner {
-		fmt.Printf(pr.prompt)
+		fmt.Fprintf(env.Stdout, pr.prompt)
 		line, err = getLine(reader)
 	} else {
 		line, err = pr.Getline(nil)
@@ -114,7 +116,7 @@ func (pr *Prompter) getExpressionWithLiner(env *zcore.Zlisp, reader *bufio.Reade
 
 	for err == zcore.ErrMoreInputNeeded || err == zcore.UnexpectedEnd || err == zcore.ResetRequested {
 		if noLiner {
-			fmt.Printf(continuationPrompt)
+			fmt.Fprintf(env.Stdout, continuationPrompt)
 			nextline, err = getLine(reader)
 		} else {
 			nextline, err = pr.Getline(&continuationPrompt)
@@ -143,7 +145,7 @@ func (pr *Prompter) getExpressionWithLiner(env *zcore.Zlisp, reader *bufio.Reade
 		case zcore.ErrMoreInputNeeded:
 			continue
 		default:
-			return "", nil, fmt.Errorf("Error on line %d: %v\n", env.Parser.Lexer.Linenum(), err)
+			return "", nil, fmt.Errorf("Error at %s: %v\n", env.Parser.Lexer.Position(), err)
 		}
 	}
 	return line, xs, nil
@@ -155,7 +157,7 @@ func processDumpCommand(env *zcore.Zlisp, args []string) {
 	} else {
 		err := env.DumpFunctionByName(args[0])
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(env.Stdout, err)
 		}
 	}
 }
@@ -165,23 +167,23 @@ func Repl(env *zcore.Zlisp, cfg *zcore.ZlispConfig) {
 	if cfg.NoLiner {
 		// reader is used if one wishes to drop the liner library.
 		// Useful for not full terminal env, like under test.
-		reader = bufio.NewReader(os.Stdin)
+		reader = bufio.NewReader(env.Stdin)
 	}
 
 	if cfg.Trace {
 		// debug tracing
-		env.DebugExec = true
+		env.SetTracer(zcore.NewLogTracer(env.Stdout, zcore.TraceFilter{}))
 	}
 
 	if !cfg.Quiet {
-		fmt.Println(ReplBanner)
+		fmt.Fprintln(env.Stdout, ReplBanner)
 		if cfg.Sandboxed {
-			fmt.Printf("ZYLISP version: %s, [sandbox mode]\n", Version())
+			fmt.Fprintf(env.Stdout, "ZYLISP version: %s, [sandbox mode]\n", Version())
 		} else {
-			fmt.Printf("ZYLISP version: %s\n", Version())
+			fmt.Fprintf(env.Stdout, "ZYLISP version: %s\n", Version())
 		}
-		fmt.Printf("Go version: %s\n", runtime.Version())
-		fmt.Println(ReplHelp)
+		fmt.Fprintf(env.Stdout, "Go version: %s\n", runtime.Version())
+		fmt.Fprintln(env.Stdout, ReplHelp)
 	}
 	var pr *Prompter // can be nil if noLiner
 	if !cfg.NoLiner {
@@ -191,16 +193,17 @@ func Repl(env *zcore.Zlisp, cfg *zcore.ZlispConfig) {
 		pr = &Prompter{prompt: cfg.Prompt}
 	}
 	infixSym := env.MakeSymbol("infix")
+	dbg := newReplDebugger(env, pr, reader, cfg.NoLiner)
 
 	for {
 		line, exprsInput, err := pr.getExpressionWithLiner(env, reader, cfg.NoLiner)
 		//zcore.Q("\n exprsInput(len=%d) = '%v'\n line = '%s'\n", len(exprsInput), (&SexpArray{Val: exprsInput}).SexpString(nil), line)
 		if err != nil {
 			if err == io.EOF {
-				fmt.Println(ReplExitMsg)
-				os.Exit(0)
+				fmt.Fprintln(env.Stdout, ReplExitMsg)
+				exit(0)
 			} else {
-				fmt.Println(err)
+				fmt.Fprintln(env.Stdout, err)
 			}
 			env.Clear()
 			continue
@@ -219,19 +222,19 @@ func Repl(env *zcore.Zlisp, cfg *zcore.ZlispConfig) {
 
 		if first == ".cd" {
 			if len(parts) < 2 {
-				fmt.Printf("provide directory path to change to.\n")
+				fmt.Fprintf(env.Stdout, "provide directory path to change to.\n")
 				continue
 			}
 			err := os.Chdir(parts[1])
 			if err != nil {
-				fmt.Printf("error: %s\n", err)
+				fmt.Fprintf(env.Stdout, "error: %s\n", err)
 				continue
 			}
 			pwd, err := os.Getwd()
 			if err == nil {
-				fmt.Printf("cur dir: %s\n", pwd)
+				fmt.Fprintf(env.Stdout, "cur dir: %s\n", pwd)
 			} else {
-				fmt.Printf("error: %s\n", err)
+				fmt.Fprintf(env.Stdout, "error: %s\n", err)
 			}
 			continue
 		}
@@ -254,13 +257,13 @@ func Repl(env *zcore.Zlisp, cfg *zcore.ZlispConfig) {
 		}
 
 		if first == ".gls" {
-			fmt.Printf("\nScopes:\n")
+			fmt.Fprintf(env.Stdout, "\nScopes:\n")
 			prev := env.ShowGlobalScope
 			env.ShowGlobalScope = true
 			err = env.ShowStackStackAndScopeStack()
 			env.ShowGlobalScope = prev
 			if err != nil {
-				fmt.Printf("%s\n", err)
+				fmt.Fprintf(env.Stdout, "%s\n", err)
 			}
 			continue
 		}
@@ -268,26 +271,30 @@ func Repl(env *zcore.Zlisp, cfg *zcore.ZlispConfig) {
 		if first == ".ls" {
 			err := env.ShowStackStackAndScopeStack()
 			if err != nil {
-				fmt.Println(err)
+				fmt.Fprintln(env.Stdout, err)
 			}
 			continue
 		}
 
 		if first == ".verb" {
 			zcore.Verbose = !zcore.Verbose
-			fmt.Printf("verbose: %v.\n", zcore.Verbose)
+			fmt.Fprintf(env.Stdout, "verbose: %v.\n", zcore.Verbose)
 			continue
 		}
 
 		if first == ".debug" {
-			env.DebugExec = true
-			fmt.Printf("instruction debugging on.\n")
+			env.SetTracer(zcore.NewLogTracer(env.Stdout, zcore.TraceFilter{}))
+			fmt.Fprintf(env.Stdout, "instruction debugging on.\n")
 			continue
 		}
 
 		if first == ".undebug" {
-			env.DebugExec = false
-			fmt.Printf("instruction debugging off.\n")
+			env.SetTracer(nil)
+			fmt.Fprintf(env.Stdout, "instruction debugging off.\n")
+			continue
+		}
+
+		if dbg.command(parts) {
 			continue
 		}
 
@@ -300,13 +307,15 @@ func Repl(env *zcore.Zlisp, cfg *zcore.ZlispConfig) {
 			line = ReplLineInfixWrap(line)
 			expr, err = env.EvalString(line + " ") // print standalone variables
 		}
+		// a step that ran off the end stops here, not in the next input.
+		dbg.SetMode(zcore.Continue)
 		switch err {
 		case nil:
 		case zcore.NoExpressionsFound:
 			env.Clear()
 			continue
 		default:
-			fmt.Print(env.GetStackTrace(err))
+			fmt.Fprint(env.Stdout, env.GetStackTrace(err))
 			env.Clear()
 			continue
 		}
@@ -316,9 +325,9 @@ func Repl(env *zcore.Zlisp, cfg *zcore.ZlispConfig) {
 			switch e := expr.(type) {
 			case *zcore.SexpStr:
 				if e.Backtick {
-					fmt.Printf("`%s`\n", e.S)
+					fmt.Fprintf(env.Stdout, "`%s`\n", e.S)
 				} else {
-					fmt.Printf("%s\n", strconv.Quote(e.S))
+					fmt.Fprintf(env.Stdout, "%s\n", strconv.Quote(e.S))
 				}
 			default:
 				switch sym := expr.(type) {
@@ -327,27 +336,27 @@ func Repl(env *zcore.Zlisp, cfg *zcore.ZlispConfig) {
 					rhs, err := sym.RHS(env)
 					if err != nil {
 						zcore.Q("repl problem in call to RHS() on SexpSelector: '%v'", err)
-						fmt.Print(env.GetStackTrace(err))
+						fmt.Fprint(env.Stdout, env.GetStackTrace(err))
 						env.Clear()
 						continue
 					} else {
 						zcore.Q("got back rhs of type %T", rhs)
-						fmt.Println(rhs.SexpString(nil))
+						fmt.Fprintln(env.Stdout, rhs.SexpString(nil))
 						continue
 					}
 				case *zcore.SexpSymbol:
 					if sym.IsDot() {
 						resolved, err := zcore.DotGetSetHelper(env, sym.Name(), nil)
 						if err != nil {
-							fmt.Print(env.GetStackTrace(err))
+							fmt.Fprint(env.Stdout, env.GetStackTrace(err))
 							env.Clear()
 							continue
 						}
-						fmt.Println(resolved.SexpString(nil))
+						fmt.Fprintln(env.Stdout, resolved.SexpString(nil))
 						continue
 					}
 				}
-				fmt.Println(expr.SexpString(nil))
+				fmt.Fprintln(env.Stdout, expr.SexpString(nil))
 			}
 		}
 	}
@@ -356,36 +365,37 @@ func Repl(env *zcore.Zlisp, cfg *zcore.ZlispConfig) {
 func runScript(env *zcore.Zlisp, fname string, cfg *zcore.ZlispConfig) {
 	file, err := os.Open(fname)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(env.Stdout, err)
 		return
 	}
 	defer file.Close()
 
 	err = env.LoadFile(file)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(env.Stdout, err)
 		if cfg.ExitOnFailure {
-			os.Exit(-1)
+			exit(-1)
 		}
 		return
 	}
 
 	_, err = env.Run()
 	if cfg.CountFuncCalls {
-		fmt.Println("Pre:")
+		fmt.Fprintln(env.Stdout, "Pre:")
 		for name, count := range precounts {
-			fmt.Printf("\t%s: %d\n", name, count)
+			fmt.Fprintf(env.Stdout, "\t%s: %d\n", name, count)
 		}
-		fmt.Println("Post:")
+		fmt.Fprintln(env.Stdout, "Post:")
 		for name, count := range postcounts {
-			fmt.Printf("\t%s: %d\n", name, count)
+			fmt.Fprintf(env.Stdout, "\t%s: %d\n", name, count)
 		}
 	}
 	if err != nil {
-		fmt.Print(env.GetStackTrace(err))
+		fmt.Fprint(env.Stdout, env.GetStackTrace(err))
 		if cfg.ExitOnFailure {
-			os.Exit(-1)
+			exit(-1)
 		}
+		env.Clear()
 		Repl(env, cfg)
 	}
 }
@@ -401,7 +411,16 @@ func ReplMain(cfg *zcore.ZlispConfig) {
 	} else {
 		env = zcore.NewZlisp()
 	}
-	env.StandardSetup()
+	env.RePanic = cfg.RePanic
+	env.CacheBytecode = cfg.CacheBytecode
+	env.NoOptimize = cfg.NoOptimize
+	env.MaxRecursionDepth = cfg.MaxRecursionDepth
+	env.SetBudget(zcore.Budget{MaxDataStackDepth: cfg.MaxDataStackDepth, MaxScopeDepth: cfg.MaxScopeDepth})
+	env.SetModulePath(filepath.SplitList(cfg.ModulePath)...)
+	if err := env.StandardSetup(); err != nil {
+		fmt.Fprintf(env.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
 	if cfg.LoadDemoStructs {
 		// avoid data conflicts by only loading these in demo mode.
 		env.ImportDemoData()
@@ -410,17 +429,45 @@ func ReplMain(cfg *zcore.ZlispConfig) {
 	if cfg.CpuProfile != "" {
 		f, err := os.Create(cfg.CpuProfile)
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(env.Stdout, err)
 			os.Exit(-1)
 		}
 		err = pprof.StartCPUProfile(f)
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(env.Stdout, err)
 			os.Exit(-1)
 		}
 		defer pprof.StopCPUProfile()
 	}
 
+	defer runAtExit()
+	if cfg.ScriptProfile != "" {
+		f, err := os.Create(cfg.ScriptProfile)
+		if err != nil {
+			fmt.Fprintln(env.Stdout, err)
+			os.Exit(-1)
+		}
+		err = env.StartScriptProfile(f, 0)
+		if err != nil {
+			fmt.Fprintln(env.Stdout, err)
+			os.Exit(-1)
+		}
+		atExit = append(atExit, func() {
+			if err := env.StopScriptProfile(); err != nil {
+				fmt.Fprintln(env.Stdout, err)
+			}
+			f.Close()
+		})
+	}
+
+	if cfg.CoverProfile != "" || cfg.CoverHTML != "" {
+		cov := zcore.NewCoverage()
+		env.SetCoverage(cov)
+		atExit = append(atExit, func() {
+			writeCoverage(env, cov, cfg)
+		})
+	}
+
 	precounts = make(map[string]int)
 	postcounts = make(map[string]int)
 
@@ -432,10 +479,10 @@ func ReplMain(cfg *zcore.ZlispConfig) {
 	if cfg.Command != "" {
 		_, err := env.EvalString(cfg.Command)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "%v\n", err)
-			os.Exit(1)
+			fmt.Fprintf(env.Stderr, "%v\n", err)
+			exit(1)
 		}
-		os.Exit(0)
+		exit(0)
 	}
 
 	runRepl := true
@@ -454,19 +501,59 @@ func ReplMain(cfg *zcore.ZlispConfig) {
 	if cfg.MemProfile != "" {
 		f, err := os.Create(cfg.MemProfile)
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(-1)
+			fmt.Fprintln(env.Stdout, err)
+			exit(-1)
 		}
 		defer f.Close()
 
 		err = pprof.Lookup("heap").WriteTo(f, 1)
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(-1)
+			fmt.Fprintln(env.Stdout, err)
+			exit(-1)
 		}
 	}
 }
 
+// atExit holds what ReplMain has to do before the process ends,
+// such as writing profiles. os.Exit skips defers, so call exit.
+var atExit []func()
+
+func exit(code int) {
+	runAtExit()
+	os.Exit(code)
+}
+
+func runAtExit() {
+	for i := len(atExit) - 1; i >= 0; i-- {
+		atExit[i]()
+	}
+	atExit = nil
+}
+
+// writeCoverage prints the coverage summary, and writes the
+// profile and HTML that cfg asks for.
+func writeCoverage(env *zcore.Zlisp, cov *zcore.Coverage, cfg *zcore.ZlispConfig) {
+	cov.WriteSummary(env.Stdout)
+	write := func(name string, to func(f *os.File) error) {
+		f, err := os.Create(name)
+		if err == nil {
+			err = to(f)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(env.Stderr, err)
+		}
+	}
+	if cfg.CoverProfile != "" {
+		write(cfg.CoverProfile, func(f *os.File) error { return cov.WriteProfile(f) })
+	}
+	if cfg.CoverHTML != "" {
+		write(cfg.CoverHTML, func(f *os.File) error { return cov.WriteHTML(f, env.FS()) })
+	}
+}
+
 func ReplLineInfixWrap(line string) string {
 	return "{" + line + "}"
 }
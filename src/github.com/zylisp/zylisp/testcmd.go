@@ -0,0 +1,107 @@
+package zylisp
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/zylisp/zcore"
+)
+
+// TestCommand is `zylisp test [flags] [dirs or files]`: it runs
+// the deftests in the *_test.zy files found, and returns the exit
+// code, 1 if any failed.
+func TestCommand(args []string) int {
+	flags := flag.NewFlagSet("zylisp test", flag.ContinueOnError)
+	run := flags.String("run", "", "run only the tests whose names match this regexp")
+	format := flags.String("format", "human", "report format: human, tap or junit")
+	out := flags.String("o", "", "write the report to file, instead of stdout")
+	verbose := flags.Bool("v", false, "in the human format, list the tests that pass too")
+	sandboxed := flags.Bool("sandbox", false, "run sandboxed; disallow system/external interaction functions")
+	demo := flags.Bool("demo", false, "load the demo structs: Event, Snoopy, Hornet, Weather and friends.")
+	modpath := flags.String("modpath", os.Getenv(zcore.ModulePathEnvVar), "directories, separated as in PATH, for import to find modules by name in")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	tr := &zcore.TestRunner{
+		NewEnv: func() (*zcore.Zlisp, error) {
+			var env *zcore.Zlisp
+			if *sandboxed {
+				env = zcore.NewZlispSandbox()
+			} else {
+				env = zcore.NewZlisp()
+			}
+			env.SetModulePath(filepath.SplitList(*modpath)...)
+			if err := env.StandardSetup(); err != nil {
+				return nil, err
+			}
+			if *demo {
+				env.ImportDemoData()
+			}
+			return env, nil
+		},
+	}
+	if *demo {
+		zcore.RegisterDemoStructs()
+	}
+	if *run != "" {
+		re, err := regexp.Compile(*run)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "zylisp test: bad -run: %v\n", err)
+			return 2
+		}
+		tr.Run = re
+	}
+	switch *format {
+	case "human", "tap", "junit":
+	default:
+		fmt.Fprintf(os.Stderr, "zylisp test: unknown -format '%s'; use human, tap or junit\n", *format)
+		return 2
+	}
+
+	files, err := zcore.FindTestFiles(nil, flags.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "zylisp test: %v\n", err)
+		return 2
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "zylisp test: %v\n", err)
+			return 2
+		}
+		defer f.Close()
+		w = f
+	}
+
+	start := time.Now()
+	if *format == "human" {
+		tr.Report = func(r zcore.TestResult) {
+			zcore.WriteTestHuman(w, r, *verbose)
+		}
+	}
+	results := tr.RunFiles(files)
+	switch *format {
+	case "human":
+		err = zcore.WriteTestSummary(w, results, time.Since(start))
+	case "tap":
+		err = zcore.WriteTestTAP(w, results)
+	case "junit":
+		err = zcore.WriteTestJUnit(w, results)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "zylisp test: %v\n", err)
+		return 2
+	}
+	if _, failed := zcore.TestCounts(results); failed > 0 {
+		return 1
+	}
+	return 0
+}
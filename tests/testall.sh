@@ -5,5 +5,6 @@ do
     zylisp -demo -exitonfail "${lispfile}" || (echo "${lispfile} failed" && exit 1)
     echo "${lispfile} passed"
 done
+zylisp test tests || (echo "deftests failed" && exit 1)
 echo
 echo "good: all tests/ scripts passed."